@@ -0,0 +1,308 @@
+package vmap
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/CarlLindqvist/xmltokenizer"
+)
+
+// Backend is an implementation of decoding that a Decoder can use.
+type Backend int
+
+const (
+	// BackendStd decodes with encoding/xml through the struct tags of the
+	// types, as xml.Unmarshal does. It is the slowest, and the reference
+	// the other backends are held to.
+	BackendStd Backend = iota
+	// BackendTokenizer decodes with the xmltokenizer package, as DecodeVmap
+	// does.
+	BackendTokenizer
+	// BackendScan decodes by scanning the input bytes, as DecodeVmapScan
+	// does. It is the fastest.
+	BackendScan
+)
+
+var backendNames = [...]string{
+	BackendStd:       "std",
+	BackendTokenizer: "tokenizer",
+	BackendScan:      "scan",
+}
+
+func (b Backend) String() string {
+	if b < 0 || int(b) >= len(backendNames) {
+		return "Backend(" + strconv.Itoa(int(b)) + ")"
+	}
+	return backendNames[b]
+}
+
+// ParseBackend returns the Backend named s, as returned by Backend.String.
+func ParseBackend(s string) (Backend, error) {
+	for b, name := range backendNames {
+		if s == name {
+			return Backend(b), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown decoder backend %q", s)
+}
+
+// MarshalText encodes b as its name.
+func (b Backend) MarshalText() ([]byte, error) {
+	if b < 0 || int(b) >= len(backendNames) {
+		return nil, fmt.Errorf("unknown decoder backend %d", int(b))
+	}
+	return []byte(backendNames[b]), nil
+}
+
+// UnmarshalText decodes a Backend from its name, so that a backend can be
+// chosen in JSON, YAML or flag configuration.
+func (b *Backend) UnmarshalText(text []byte) error {
+	v, err := ParseBackend(string(text))
+	if err != nil {
+		return err
+	}
+	*b = v
+	return nil
+}
+
+// Decoder decodes VMAP and VAST documents with one of the backends. All
+// backends keep to the same contract, so that one can be swapped for
+// another through configuration, the output staying the same:
+//
+//   - The VMAP or VAST element is looked for anywhere in the document.
+//     Without one, decoding fails with ErrNoVMAP or ErrNoVAST.
+//   - Unterminated elements, unknown entity references and values that do
+//     not parse, such as a timeOffset or Duration, fail decoding with a
+//     *DecodeError. Where the error is reported, and its message, depend
+//     on the backend. Other malformed XML, such as mismatched end tags or
+//     markup after the root element, is outside the contract: BackendStd
+//     rejects mismatched end tags, BackendTokenizer markup after the root.
+//   - Exceeding the Limits of the options fails decoding with a
+//     *LimitError, wrapped in a *DecodeError but for MaxBytes. BackendScan
+//     checks the lengths of only the values it decodes.
+//   - Text is unescaped and then trimmed of surrounding whitespace. The
+//     whitespace between elements is dropped, leaving VMAP.Text and
+//     VAST.Text empty. Attribute values are kept as they are, in either
+//     kind of quotes.
+//   - A self-closing element, such as a VAST or an AdBreak, decodes with
+//     its attributes and no children.
+//   - Elements and attributes that the types have no field for are
+//     ignored. Known elements nested in unknown ones are outside the
+//     contract: BackendStd ignores them, the others may decode them.
+//
+// Decoding does not modify the input. The result of BackendScan may share
+// memory with it, so the input must not be modified while the result is in
+// use, unless DecodeOptions.CopyStrings is set. A Decoder is safe for
+// concurrent use.
+type Decoder interface {
+	DecodeVmap(input []byte) (VMAP, error)
+	DecodeVast(input []byte) (VAST, error)
+}
+
+// NewDecoder returns a Decoder using backend b with opts. Decoding is
+// always strict, whether or not opts.Strict is set: lenient decoding, with
+// warnings, is only available from DecodeVmapScanWithOptions and
+// DecodeVastScanWithOptions. Limits apply to every backend. The other options are those of the scan
+// decoders: BackendScan honours them, the others ignore Workers and
+// CopyStrings, which they have no use for, and reject Lossless. Lazy is
+// rejected, as a Decoder returns documents decoded in full.
+func NewDecoder(b Backend, opts DecodeOptions) (Decoder, error) {
+	opts.Strict = true
+	if opts.Lazy {
+		return nil, fmt.Errorf("decoder backend %s: Lazy is not supported", b)
+	}
+	if opts.Lossless && b != BackendScan {
+		return nil, fmt.Errorf("decoder backend %s: Lossless is not supported", b)
+	}
+	switch b {
+	case BackendStd:
+		return stdDecoder{limits: opts.Limits}, nil
+	case BackendTokenizer:
+		return tokenizerDecoder{limits: opts.Limits}, nil
+	case BackendScan:
+		return scanDecoder{opts: opts}, nil
+	}
+	return nil, fmt.Errorf("unknown decoder backend %d", int(b))
+}
+
+type stdDecoder struct {
+	limits Limits
+}
+
+func (d stdDecoder) DecodeVmap(input []byte) (VMAP, error) {
+	var v VMAP
+	err := decodeStd(input, "VMAP", &v, &d.limits)
+	if err == io.EOF {
+		err = ErrNoVMAP
+	}
+	v.trimText()
+	return v, err
+}
+
+func (d stdDecoder) DecodeVast(input []byte) (VAST, error) {
+	var v VAST
+	err := decodeStd(input, "VAST", &v, &d.limits)
+	if err == io.EOF {
+		err = ErrNoVAST
+	}
+	v.trimText()
+	return v, err
+}
+
+// decodeStd decodes the first element named root in input into v with
+// encoding/xml, returning io.EOF if there is none.
+func decodeStd(input []byte, root string, v any, limits *Limits) error {
+	if err := limits.checkBytes(input); err != nil {
+		return err
+	}
+	if err := checkLimits(input, limits); err != nil {
+		return err
+	}
+	d := xml.NewDecoder(bytes.NewReader(input))
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			return err
+		}
+		if err != nil {
+			return newDecodeError(input, int(d.InputOffset()), err)
+		}
+		if se, ok := t.(xml.StartElement); ok && se.Name.Local == root {
+			if err := d.DecodeElement(v, &se); err != nil {
+				return newDecodeError(input, int(d.InputOffset()), err)
+			}
+			return nil
+		}
+	}
+}
+
+// checkLimits returns the error of input exceeding limits, found by
+// tokenizing it as the tokenizer decoders do. Malformed XML is left for the
+// caller to report.
+func checkLimits(input []byte, limits *Limits) (err error) {
+	lim := newLimiter(limits)
+	if lim == nil {
+		return nil
+	}
+	r := &tokenReader{tok: xmltokenizer.New(bytes.NewReader(input)), limit: lim}
+	defer func() {
+		if p := recover(); p != nil {
+			tokenizerPanic(p)
+			err = nil
+		}
+	}()
+	for {
+		_, err := r.Token()
+		if err == nil {
+			continue
+		}
+		if isLimitError(err) {
+			return r.errorAt(input, err)
+		}
+		return nil
+	}
+}
+
+type tokenizerDecoder struct {
+	limits Limits
+}
+
+func (d tokenizerDecoder) DecodeVmap(input []byte) (VMAP, error) {
+	v, err := DecodeVmapWithOptions(input, DecodeOptions{Limits: d.limits})
+	v.trimText()
+	return v, err
+}
+
+func (d tokenizerDecoder) DecodeVast(input []byte) (VAST, error) {
+	v, err := DecodeVastWithOptions(input, DecodeOptions{Limits: d.limits})
+	v.trimText()
+	return v, err
+}
+
+type scanDecoder struct {
+	opts DecodeOptions
+}
+
+func (d scanDecoder) DecodeVmap(input []byte) (VMAP, error) {
+	v, _, err := DecodeVmapScanWithOptions(input, d.opts)
+	v.trimText()
+	return v, err
+}
+
+func (d scanDecoder) DecodeVast(input []byte) (VAST, error) {
+	v, _, err := DecodeVastScanWithOptions(input, d.opts)
+	v.trimText()
+	return v, err
+}
+
+// trimText trims the text of v of surrounding whitespace, as the backends
+// of a Decoder leave different amounts of it.
+func (v *VMAP) trimText() {
+	v.Text = strings.TrimSpace(v.Text)
+	for i := range v.AdBreaks {
+		ab := &v.AdBreaks[i]
+		if ab.AdSource != nil && ab.AdSource.VASTData != nil && ab.AdSource.VASTData.VAST != nil {
+			ab.AdSource.VASTData.VAST.trimText()
+		}
+		trimTracking(ab.TrackingEvents)
+	}
+}
+
+func (v *VAST) trimText() {
+	v.Text = strings.TrimSpace(v.Text)
+	for i := range v.Ad {
+		il := v.Ad[i].InLine
+		if il == nil {
+			continue
+		}
+		il.AdSystem = strings.TrimSpace(il.AdSystem)
+		il.AdTitle = strings.TrimSpace(il.AdTitle)
+		for j := range il.Impression {
+			il.Impression[j].Text = strings.TrimSpace(il.Impression[j].Text)
+		}
+		for j := range il.Creatives {
+			c := &il.Creatives[j]
+			if c.UniversalAdId != nil {
+				c.UniversalAdId.Id = strings.TrimSpace(c.UniversalAdId.Id)
+			}
+			if c.Linear != nil {
+				c.Linear.trimText()
+			}
+		}
+		for j := range il.Extensions {
+			params := il.Extensions[j].CreativeParameters
+			for k := range params {
+				params[k].Value = strings.TrimSpace(params[k].Value)
+			}
+		}
+		if il.Error != nil {
+			il.Error.Value = strings.TrimSpace(il.Error.Value)
+		}
+	}
+}
+
+func (l *Linear) trimText() {
+	trimTracking(l.TrackingEvents)
+	for i := range l.MediaFiles {
+		l.MediaFiles[i].Text = strings.TrimSpace(l.MediaFiles[i].Text)
+	}
+	if l.ClickThrough != nil {
+		l.ClickThrough.Text = strings.TrimSpace(l.ClickThrough.Text)
+	}
+	for i := range l.ClickTracking {
+		l.ClickTracking[i].Text = strings.TrimSpace(l.ClickTracking[i].Text)
+	}
+	for i := range l.CustomClick {
+		l.CustomClick[i].Text = strings.TrimSpace(l.CustomClick[i].Text)
+	}
+}
+
+func trimTracking(events []TrackingEvent) {
+	for i := range events {
+		events[i].Text = strings.TrimSpace(events[i].Text)
+	}
+}
@@ -0,0 +1,282 @@
+package vmap
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+// conformingDecoders are the decoders held to the contract of Decoder, the
+// first being the reference the others are compared with.
+var conformingDecoders = []struct {
+	name    string
+	backend Backend
+	opts    DecodeOptions
+}{
+	{"std", BackendStd, DecodeOptions{}},
+	{"tokenizer", BackendTokenizer, DecodeOptions{}},
+	{"scan", BackendScan, DecodeOptions{}},
+	{"scan/copy", BackendScan, DecodeOptions{CopyStrings: true}},
+	{"scan/workers", BackendScan, DecodeOptions{Workers: 4}},
+	{"scan/limits", BackendScan, DecodeOptions{Limits: DefaultLimits}},
+}
+
+func newDecoders(t testing.TB) []Decoder {
+	var ds []Decoder
+	for _, c := range conformingDecoders {
+		d, err := NewDecoder(c.backend, c.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ds = append(ds, d)
+	}
+	return ds
+}
+
+// testVmapUnknown.xml is left out: it nests known elements in unknown ones.
+var conformanceVmaps = []string{"testVmap.xml", "testVmap2.xml", "testVmapEmptyVast.xml"}
+
+var conformanceVasts = []string{"testVast.xml", "testVast2.xml", "testVast3.xml", "testVastSpecialChars.xml"}
+
+func TestDecoderConformance(t *testing.T) {
+	decoders := newDecoders(t)
+	for _, file := range conformanceVmaps {
+		doc, err := os.ReadFile("sample-vmap/" + file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := decoders[0].DecodeVmap(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, d := range decoders[1:] {
+			t.Run(file+"/"+conformingDecoders[i+1].name, func(t *testing.T) {
+				is := is.New(t)
+				got, err := d.DecodeVmap(doc)
+				is.NoErr(err)
+				is.Equal(got, want)
+			})
+		}
+	}
+	for _, file := range conformanceVasts {
+		doc, err := os.ReadFile("sample-vmap/" + file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := decoders[0].DecodeVast(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, d := range decoders[1:] {
+			t.Run(file+"/"+conformingDecoders[i+1].name, func(t *testing.T) {
+				is := is.New(t)
+				got, err := d.DecodeVast(doc)
+				is.NoErr(err)
+				is.Equal(got, want)
+			})
+		}
+	}
+}
+
+func TestDecoderContract(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want VAST
+	}{
+		{
+			name: "text",
+			doc: "<VAST version=\"4.0\">\n <Ad id=\"1\"><InLine>\n  <AdSystem>\n   a &amp; b&#x20;\n  </AdSystem>\n" +
+				"  <AdTitle> <![CDATA[ title ]]> </AdTitle>\n </InLine></Ad>\n</VAST>",
+			want: VAST{Version: "4.0", Ad: []Ad{{Id: "1", InLine: &InLine{AdSystem: "a & b", AdTitle: "title"}}}},
+		},
+		{
+			name: "quotes",
+			doc: `<VAST version='4.0'><Ad id='1'><InLine><Extensions><Extension type='FreeWheel'>` +
+				`<CreativeParameters><CreativeParameter creativeId='c' name="n" type='Linear'>v</CreativeParameter>` +
+				`</CreativeParameters></Extension></Extensions></InLine></Ad></VAST>`,
+			want: VAST{Version: "4.0", Ad: []Ad{{Id: "1", InLine: &InLine{Extensions: []Extension{{
+				ExtensionType: "FreeWheel",
+				CreativeParameters: []CreativeParameter{
+					{CreativeId: "c", Name: "n", CreativeParameterType: "Linear", Value: "v"},
+				},
+			}}}}}},
+		},
+		{
+			name: "self-closing",
+			doc: `<?xml version="1.0"?><VAST xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" ` +
+				`xsi:noNamespaceSchemaLocation="vast.xsd" version="4.1"/>`,
+			want: VAST{Xsi: "http://www.w3.org/2001/XMLSchema-instance", NoNamespaceSchemaLocation: "vast.xsd", Version: "4.1"},
+		},
+		{
+			name: "self-closing elements",
+			doc: `<VAST><Ad id="1"/><Ad id="2"><InLine/></Ad><Ad id="3"><InLine><Creatives><Creative id="c"/>` +
+				`<Creative id="d"/></Creatives><Extensions><Extension type="e"/></Extensions></InLine></Ad></VAST>`,
+			want: VAST{Ad: []Ad{{Id: "1"}, {Id: "2", InLine: &InLine{}}, {Id: "3", InLine: &InLine{
+				Creatives:  []Creative{{Id: "c"}, {Id: "d"}},
+				Extensions: []Extension{{ExtensionType: "e"}},
+			}}}},
+		},
+		{
+			name: "custom click",
+			doc: `<VAST><Ad><InLine><Creatives><Creative><Linear><VideoClicks>` +
+				`<CustomClick id="cc"> http://c/1 </CustomClick></VideoClicks></Linear></Creative></Creatives>` +
+				`</InLine></Ad></VAST>`,
+			want: VAST{Ad: []Ad{{InLine: &InLine{Creatives: []Creative{{Linear: &Linear{
+				CustomClick: []CustomClick{{Id: "cc", Text: "http://c/1"}},
+			}}}}}}},
+		},
+	}
+	decoders := newDecoders(t)
+	for _, tt := range tests {
+		for i, d := range decoders {
+			t.Run(tt.name+"/"+conformingDecoders[i].name, func(t *testing.T) {
+				is := is.New(t)
+				got, err := d.DecodeVast([]byte(tt.doc))
+				is.NoErr(err)
+				is.Equal(marshalXML(t, got), marshalXML(t, tt.want))
+			})
+		}
+	}
+}
+
+func TestDecoderSelfClosingAdBreak(t *testing.T) {
+	doc := []byte(`<VMAP version="1.0"><AdBreak breakId="a" timeOffset="start"/>` +
+		`<AdBreak breakId="b" timeOffset="end"><AdSource><VASTAdData><VAST><Ad id="1"/></VAST></VASTAdData>` +
+		`</AdSource></AdBreak></VMAP>`)
+	for i, d := range newDecoders(t) {
+		t.Run(conformingDecoders[i].name, func(t *testing.T) {
+			is := is.New(t)
+			v, err := d.DecodeVmap(doc)
+			is.NoErr(err)
+			is.Equal(len(v.AdBreaks), 2) // the self-closing AdBreak holds nothing
+			is.Equal(v.AdBreaks[0].Id, "a")
+			is.Equal(v.AdBreaks[1].Id, "b")
+			is.Equal(v.AdBreaks[1].AdSource.VASTData.VAST.Ad[0].Id, "1")
+		})
+	}
+}
+
+func TestDecoderErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		doc   string
+		want  error // the error matched with errors.Is, if any
+		limit string
+	}{
+		{name: "no VAST", doc: `<VMAP/>`, want: ErrNoVAST},
+		{name: "empty", doc: ``, want: ErrNoVAST},
+		{name: "unterminated", doc: `<VAST version="4.0"><Ad id="1"><InLine><AdSystem>a</AdSystem>`},
+		{name: "entity", doc: `<VAST><Ad><InLine><AdSystem>a &bogus; b</AdSystem></InLine></Ad></VAST>`},
+		{
+			name: "duration",
+			doc: `<VAST><Ad><InLine><Creatives><Creative><Linear><Duration>bad</Duration></Linear></Creative>` +
+				`</Creatives></InLine></Ad></VAST>`,
+		},
+		{name: "sequence", doc: `<VAST><Ad sequence="x"><InLine/></Ad></VAST>`},
+		{name: "truncated tag", doc: `<VAST></>0`}, // the tokenizer panics on it
+		{name: "depth", doc: `<VAST><Ad><InLine><AdSystem>a</AdSystem></InLine></Ad></VAST>`, limit: "MaxDepth"},
+	}
+	for _, tt := range tests {
+		for _, c := range conformingDecoders {
+			t.Run(tt.name+"/"+c.name, func(t *testing.T) {
+				is := is.New(t)
+				opts := c.opts
+				if tt.limit != "" {
+					opts.Limits.MaxDepth = 2
+				}
+				d, err := NewDecoder(c.backend, opts)
+				is.NoErr(err)
+				_, err = d.DecodeVast([]byte(tt.doc))
+				is.True(err != nil) // an error
+				if tt.want != nil {
+					is.True(errors.Is(err, tt.want))
+					return
+				}
+				var derr *DecodeError
+				is.True(errors.As(err, &derr)) // a DecodeError
+				var lerr *LimitError
+				is.Equal(errors.As(err, &lerr), tt.limit != "")
+				if lerr != nil {
+					is.Equal(lerr.Limit, tt.limit)
+				}
+			})
+		}
+	}
+
+	for _, c := range conformingDecoders {
+		d, err := NewDecoder(c.backend, c.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.DecodeVmap([]byte(`<VAST/>`)); !errors.Is(err, ErrNoVMAP) {
+			t.Errorf("%s: got %v, want ErrNoVMAP", c.name, err)
+		}
+	}
+}
+
+func TestCheckLimitsMalformed(t *testing.T) {
+	is := is.New(t)
+	is.NoErr(checkLimits([]byte(`</>0`), &DefaultLimits)) // left for encoding/xml to report
+}
+
+func TestNewDecoder(t *testing.T) {
+	is := is.New(t)
+	// Decoding is strict with the zero options too.
+	doc := []byte(`<VAST><Ad sequence="x"><InLine/></Ad></VAST>`)
+	for _, b := range []Backend{BackendStd, BackendTokenizer, BackendScan} {
+		d, err := NewDecoder(b, DecodeOptions{})
+		is.NoErr(err)
+		_, err = d.DecodeVast(doc)
+		is.True(err != nil)
+	}
+	_, err := NewDecoder(BackendScan, DecodeOptions{Lazy: true})
+	is.True(err != nil) // Lazy is rejected
+	_, err = NewDecoder(BackendTokenizer, DecodeOptions{Lossless: true})
+	is.True(err != nil) // Lossless is rejected but for scan
+	_, err = NewDecoder(BackendScan, DecodeOptions{Lossless: true})
+	is.NoErr(err)
+	_, err = NewDecoder(Backend(7), DecodeOptions{})
+	is.True(err != nil) // unknown backend
+}
+
+func TestBackendText(t *testing.T) {
+	is := is.New(t)
+	var cfg struct {
+		Backend Backend `json:"backend"`
+	}
+	is.NoErr(json.Unmarshal([]byte(`{"backend":"tokenizer"}`), &cfg))
+	is.Equal(cfg.Backend, BackendTokenizer)
+	b, err := json.Marshal(cfg)
+	is.NoErr(err)
+	is.Equal(string(b), `{"backend":"tokenizer"}`)
+
+	for _, b := range []Backend{BackendStd, BackendTokenizer, BackendScan} {
+		got, err := ParseBackend(b.String())
+		is.NoErr(err)
+		is.Equal(got, b)
+	}
+	_, err = ParseBackend("sax")
+	is.True(err != nil) // unknown name
+	is.Equal(Backend(7).String(), "Backend(7)")
+}
+
+func BenchmarkDecoder(b *testing.B) {
+	doc, err := os.ReadFile("sample-vmap/testVmap.xml")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i, d := range newDecoders(b) {
+		b.Run(conformingDecoders[i].name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := d.DecodeVmap(doc); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
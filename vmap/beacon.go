@@ -0,0 +1,495 @@
+package vmap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Beacon is a tracking URL to request from the server at a given time.
+type Beacon struct {
+	// ID identifies the beacon across restarts. It must be unique among all
+	// beacons given to a Beaconer.
+	ID    string `json:"id"`
+	Event string `json:"event"`
+	URL   string `json:"url"`
+	// Due is when the beacon should be sent, or retried after a failure.
+	Due time.Time `json:"due"`
+	// Attempts counts the failed attempts to send the beacon so far.
+	Attempts int `json:"attempts"`
+}
+
+// ScheduleBeacons returns the impression and progress beacons of a pod of
+// ads stitched into a stream of the given session, played from start. Ads
+// play in document order and the linear creatives of an ad one after the
+// other; impressions and start fire when an ad starts, quartiles and
+// complete at their share of the creative duration. The result is ordered
+// by due time.
+func ScheduleBeacons(session string, pod *VAST, start time.Time) []Beacon {
+	var beacons []Beacon
+	at := start
+	for i := range pod.Ad {
+		ad := &pod.Ad[i]
+		if ad.InLine == nil {
+			continue
+		}
+		prefix := session + "/ad" + strconv.Itoa(i)
+		for j, imp := range ad.InLine.Impression {
+			if u := strings.TrimSpace(imp.Text); u != "" {
+				beacons = append(beacons, Beacon{
+					ID:    prefix + "/impression/" + strconv.Itoa(j),
+					Event: "impression",
+					URL:   u,
+					Due:   at,
+				})
+			}
+		}
+		for j := range ad.InLine.Creatives {
+			linear := ad.InLine.Creatives[j].Linear
+			if linear == nil {
+				continue
+			}
+			d := linear.Duration.Duration
+			for k, te := range linear.TrackingEvents {
+				offset, ok := progressOffset(te.Event, d)
+				u := strings.TrimSpace(te.Text)
+				if !ok || u == "" {
+					continue
+				}
+				beacons = append(beacons, Beacon{
+					ID:    prefix + "/creative" + strconv.Itoa(j) + "/" + strconv.Itoa(k),
+					Event: te.Event,
+					URL:   u,
+					Due:   at.Add(offset),
+				})
+			}
+			at = at.Add(d)
+		}
+	}
+	sortBeacons(beacons)
+	return beacons
+}
+
+// progressOffset returns when a tracking event fires within a creative of
+// duration d, and false for events that depend on the viewer.
+func progressOffset(event string, d time.Duration) (time.Duration, bool) {
+	switch event {
+	case EventStart:
+		return 0, true
+	case EventFirstQuartile:
+		return d / 4, true
+	case EventMidpoint:
+		return d / 2, true
+	case EventThirdQuartile:
+		return d * 3 / 4, true
+	case EventComplete:
+		return d, true
+	}
+	return 0, false
+}
+
+// Sender sends a single beacon.
+type Sender interface {
+	Send(ctx context.Context, url string) error
+}
+
+// HTTPSender sends beacons as HTTP GET requests. Responses other than 2xx
+// are errors.
+type HTTPSender struct {
+	// Client is the client to use. Defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// Send requests url and discards the response body.
+func (s HTTPSender) Send(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("beacon %s: %s", url, resp.Status)
+	}
+	return nil
+}
+
+// BeaconerOptions configures a Beaconer.
+type BeaconerOptions struct {
+	// Sender sends the beacons. Defaults to an HTTPSender.
+	Sender Sender
+	// Concurrency bounds the number of beacons in flight. Defaults to 4.
+	Concurrency int
+	// MaxAttempts is the number of attempts after which a beacon is given
+	// up on. Defaults to 5.
+	MaxAttempts int
+	// Backoff returns how long to wait before retrying after the given
+	// number of failed attempts. Defaults to doubling from one second up to
+	// a minute.
+	Backoff func(attempts int) time.Duration
+	// QueueFile is where the queue is persisted. When empty the queue is
+	// kept in memory only.
+	QueueFile string
+	// Retention is how long finished beacon IDs are remembered after their
+	// due time, to ignore them if they are added again. Defaults to a day.
+	Retention time.Duration
+	// OnDrop, if set, is called for beacons given up on.
+	OnDrop func(b Beacon, err error)
+}
+
+// Beaconer sends beacons when they are due. Beacons stay queued until they
+// have been sent or given up on, and the queue is written to
+// BeaconerOptions.QueueFile after every change, so a restarted Beaconer
+// picks up where the previous one stopped. Changes made while the file is
+// being written are written together once it is done. Beacons whose IDs
+// have been sent are ignored when added again. A beacon is only sent again
+// after a restart if the process stopped between sending it and recording
+// that.
+//
+// The methods of a Beaconer are safe for concurrent use.
+type Beaconer struct {
+	opts BeaconerOptions
+	wake chan struct{}
+
+	mu       sync.Mutex
+	pending  map[string]Beacon
+	done     map[string]time.Time
+	inFlight map[string]bool
+	version  uint64 // counts the changes to pending and done
+
+	saveMu sync.Mutex // held while writing the queue file
+	saved  uint64     // the version last written, under saveMu
+}
+
+// beaconQueue is the on-disk form of the queue.
+type beaconQueue struct {
+	Pending []Beacon             `json:"pending"`
+	Done    map[string]time.Time `json:"done"`
+}
+
+// NewBeaconer creates a Beaconer, loading the queue file if it exists.
+func NewBeaconer(opts BeaconerOptions) (*Beaconer, error) {
+	if opts.Sender == nil {
+		opts.Sender = HTTPSender{}
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 4
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 5
+	}
+	if opts.Backoff == nil {
+		opts.Backoff = defaultBackoff
+	}
+	if opts.Retention <= 0 {
+		opts.Retention = 24 * time.Hour
+	}
+	b := &Beaconer{
+		opts:     opts,
+		wake:     make(chan struct{}, 1),
+		pending:  make(map[string]Beacon),
+		done:     make(map[string]time.Time),
+		inFlight: make(map[string]bool),
+	}
+	if opts.QueueFile == "" {
+		return b, nil
+	}
+	data, err := os.ReadFile(opts.QueueFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var q beaconQueue
+	if err := json.Unmarshal(data, &q); err != nil {
+		return nil, fmt.Errorf("beacon queue %s: %w", opts.QueueFile, err)
+	}
+	for _, bc := range q.Pending {
+		b.pending[bc.ID] = bc
+	}
+	for id, due := range q.Done {
+		b.done[id] = due
+	}
+	return b, nil
+}
+
+func defaultBackoff(attempts int) time.Duration {
+	attempts = max(attempts, 1)
+	if attempts > 6 {
+		return time.Minute
+	}
+	return min(time.Second<<(attempts-1), time.Minute)
+}
+
+// Add queues beacons. Beacons with the ID of a queued or finished beacon are
+// ignored. It returns once the queue file has been written, or the error of
+// writing it; the beacons are queued either way.
+func (b *Beaconer) Add(beacons ...Beacon) error {
+	b.mu.Lock()
+	added := false
+	for _, bc := range beacons {
+		if _, ok := b.pending[bc.ID]; ok {
+			continue
+		}
+		if _, ok := b.done[bc.ID]; ok {
+			continue
+		}
+		b.pending[bc.ID] = bc
+		added = true
+	}
+	if added {
+		b.version++
+		b.notify()
+	}
+	b.mu.Unlock()
+	return b.save()
+}
+
+// Pending returns the queued beacons ordered by due time.
+func (b *Beaconer) Pending() []Beacon {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	beacons := make([]Beacon, 0, len(b.pending))
+	for _, bc := range b.pending {
+		beacons = append(beacons, bc)
+	}
+	sortBeacons(beacons)
+	return beacons
+}
+
+// Run sends beacons as they fall due until ctx is cancelled, and returns
+// once the beacons in flight have finished. Beacons that have not been
+// sent stay queued.
+//
+// If the queue file cannot be written, Run stops sending beacons and
+// returns the error, as a restart could no longer tell which beacons were
+// sent. The queue is kept in memory, and written by the next Add or Run.
+func (b *Beaconer) Run(ctx context.Context) error {
+	if err := b.save(); err != nil {
+		return err
+	}
+	sem := make(chan struct{}, b.opts.Concurrency)
+	failed := make(chan error, 1)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		due, wait := b.takeDue(time.Now())
+		for i, bc := range due {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				b.release(due[i:])
+				return ctx.Err()
+			}
+			// A send reports its failure before freeing its slot.
+			select {
+			case err := <-failed:
+				<-sem
+				b.release(due[i:])
+				return err
+			default:
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				if err := b.send(ctx, bc); err != nil {
+					select {
+					case failed <- err:
+					default:
+					}
+				}
+			}()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case err := <-failed:
+			timer.Stop()
+			return err
+		case <-b.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// takeDue marks the beacons due at now as in flight and returns them, with
+// how long to wait for the next one.
+func (b *Beaconer) takeDue(now time.Time) ([]Beacon, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var due []Beacon
+	wait := time.Hour
+	for id, bc := range b.pending {
+		if b.inFlight[id] {
+			continue
+		}
+		if d := bc.Due.Sub(now); d > 0 {
+			wait = min(wait, d)
+			continue
+		}
+		b.inFlight[id] = true
+		due = append(due, bc)
+	}
+	sortBeacons(due)
+	return due, wait
+}
+
+func (b *Beaconer) release(beacons []Beacon) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, bc := range beacons {
+		delete(b.inFlight, bc.ID)
+	}
+}
+
+// send sends bc and records the outcome, returning the error of writing the
+// queue file.
+func (b *Beaconer) send(ctx context.Context, bc Beacon) error {
+	u := expandMacros(bc.URL, func(name string) (string, bool) {
+		switch name {
+		case "TIMESTAMP":
+			return formatTimestamp(time.Now()), true
+		case "CACHEBUSTING":
+			return randomCacheBuster(), true
+		}
+		return "", false
+	})
+	err := b.opts.Sender.Send(ctx, u)
+	if err != nil && ctx.Err() != nil {
+		// Interrupted by shutdown; leave it for the next run.
+		b.release([]Beacon{bc})
+		return nil
+	}
+
+	b.mu.Lock()
+	delete(b.inFlight, bc.ID)
+	b.version++
+	retry := false
+	if err != nil {
+		bc.Attempts++
+		retry = bc.Attempts < b.opts.MaxAttempts
+	}
+	if retry {
+		bc.Due = time.Now().Add(b.opts.Backoff(bc.Attempts))
+		b.pending[bc.ID] = bc
+		b.notify()
+	} else {
+		if err != nil && b.opts.OnDrop != nil {
+			b.opts.OnDrop(bc, err)
+		}
+		delete(b.pending, bc.ID)
+		b.done[bc.ID] = bc.Due
+	}
+	b.mu.Unlock()
+	return b.save()
+}
+
+// notify wakes Run without blocking.
+func (b *Beaconer) notify() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// save writes the queue file, replacing it atomically, unless it is up to
+// date. The queue is copied under b.mu and written without holding it, one
+// writer at a time; a writer that waited for another finds its changes
+// written already, or writes them together with those of the others that
+// waited.
+func (b *Beaconer) save() error {
+	if b.opts.QueueFile == "" {
+		b.mu.Lock()
+		b.prune(time.Now())
+		b.mu.Unlock()
+		return nil
+	}
+	b.saveMu.Lock()
+	defer b.saveMu.Unlock()
+	b.mu.Lock()
+	version := b.version
+	if version == b.saved {
+		b.mu.Unlock()
+		return nil
+	}
+	b.prune(time.Now())
+	q := beaconQueue{Pending: make([]Beacon, 0, len(b.pending)), Done: maps.Clone(b.done)}
+	for _, bc := range b.pending {
+		q.Pending = append(q.Pending, bc)
+	}
+	b.mu.Unlock()
+
+	if err := writeQueue(b.opts.QueueFile, q); err != nil {
+		return fmt.Errorf("beacon queue %s: %w", b.opts.QueueFile, err)
+	}
+	b.saved = version
+	return nil
+}
+
+// prune forgets the finished beacons that are past their retention at now.
+// b.mu must be held.
+func (b *Beaconer) prune(now time.Time) {
+	cutoff := now.Add(-b.opts.Retention)
+	maps.DeleteFunc(b.done, func(_ string, due time.Time) bool { return due.Before(cutoff) })
+}
+
+func writeQueue(file string, q beaconQueue) error {
+	sortBeacons(q.Pending)
+	data, err := json.Marshal(q)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// sortBeacons orders beacons by due time, then ID.
+func sortBeacons(beacons []Beacon) {
+	slices.SortFunc(beacons, func(a, b Beacon) int {
+		if c := a.Due.Compare(b.Due); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+}
@@ -0,0 +1,353 @@
+package vmap
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+// beaconServer records the paths requested from it. Paths listed in fail
+// answer 500 that many times before succeeding.
+type beaconServer struct {
+	*httptest.Server
+	mu   sync.Mutex
+	hits []string
+	fail map[string]int
+}
+
+func newBeaconServer(t *testing.T) *beaconServer {
+	s := &beaconServer{fail: map[string]int{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.fail[r.URL.Path] > 0 {
+			s.fail[r.URL.Path]--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		s.hits = append(s.hits, r.URL.Path)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *beaconServer) Hits() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hits := slices.Clone(s.hits)
+	slices.Sort(hits)
+	return hits
+}
+
+func (s *beaconServer) waitFor(t *testing.T, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if hits := s.Hits(); len(hits) >= n {
+			return hits
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("got %d beacons, want %d", len(s.Hits()), n)
+	return nil
+}
+
+// waitPending waits until n beacons are queued. The server sees a beacon
+// before the beaconer has handled the response.
+func waitPending(t *testing.T, b *Beaconer, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(b.Pending()) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d pending beacons, want %d", len(b.Pending()), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func beaconTestPod(base string, d time.Duration) *VAST {
+	ad := func(id string) Ad {
+		var te []TrackingEvent
+		for _, e := range []string{
+			EventStart, EventFirstQuartile, EventMidpoint, EventThirdQuartile, EventComplete, EventPause,
+		} {
+			te = append(te, TrackingEvent{Event: e, Text: base + "/" + id + "/" + e + "?cb=[CACHEBUSTING]"})
+		}
+		return Ad{Id: id, InLine: &InLine{
+			Impression: []Impression{{Text: "\n" + base + "/" + id + "/impression\n"}},
+			Creatives:  []Creative{{Linear: &Linear{Duration: Duration{d}, TrackingEvents: te}}},
+		}}
+	}
+	return &VAST{Ad: []Ad{ad("a1"), ad("a2")}}
+}
+
+func runBeaconer(t *testing.T, b *Beaconer) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- b.Run(ctx) }()
+	return func() {
+		cancel()
+		if err := <-done; !errors.Is(err, context.Canceled) {
+			t.Errorf("Run: %v", err)
+		}
+	}
+}
+
+func TestScheduleBeacons(t *testing.T) {
+	is := is.New(t)
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	beacons := ScheduleBeacons("s1", beaconTestPod("http://t", 20*time.Second), start)
+
+	type due struct {
+		id     string
+		offset time.Duration
+	}
+	var got []due
+	for _, b := range beacons {
+		got = append(got, due{b.ID, b.Due.Sub(start)})
+	}
+	is.Equal(got, []due{
+		{"s1/ad0/creative0/0", 0},
+		{"s1/ad0/impression/0", 0},
+		{"s1/ad0/creative0/1", 5 * time.Second},
+		{"s1/ad0/creative0/2", 10 * time.Second},
+		{"s1/ad0/creative0/3", 15 * time.Second},
+		{"s1/ad0/creative0/4", 20 * time.Second},
+		{"s1/ad1/creative0/0", 20 * time.Second},
+		{"s1/ad1/impression/0", 20 * time.Second},
+		{"s1/ad1/creative0/1", 25 * time.Second},
+		{"s1/ad1/creative0/2", 30 * time.Second},
+		{"s1/ad1/creative0/3", 35 * time.Second},
+		{"s1/ad1/creative0/4", 40 * time.Second},
+	})
+	is.Equal(beacons[1].URL, "http://t/a1/impression") // trimmed
+	is.Equal(beacons[1].Event, "impression")
+}
+
+func TestBeaconerSendsPod(t *testing.T) {
+	is := is.New(t)
+	srv := newBeaconServer(t)
+	b, err := NewBeaconer(BeaconerOptions{})
+	is.NoErr(err)
+	stop := runBeaconer(t, b)
+	defer stop()
+
+	is.NoErr(b.Add(ScheduleBeacons("s1", beaconTestPod(srv.URL, 40*time.Millisecond), time.Now())...))
+	hits := srv.waitFor(t, 12)
+	is.Equal(hits, []string{
+		"/a1/complete", "/a1/firstQuartile", "/a1/impression", "/a1/midpoint", "/a1/start", "/a1/thirdQuartile",
+		"/a2/complete", "/a2/firstQuartile", "/a2/impression", "/a2/midpoint", "/a2/start", "/a2/thirdQuartile",
+	})
+	waitPending(t, b, 0)
+}
+
+func TestBeaconerRetries(t *testing.T) {
+	is := is.New(t)
+	srv := newBeaconServer(t)
+	srv.fail["/a1/start"] = 2
+	srv.fail["/a2/start"] = 10
+
+	var dropped []string
+	var mu sync.Mutex
+	b, err := NewBeaconer(BeaconerOptions{
+		MaxAttempts: 3,
+		Backoff:     func(int) time.Duration { return time.Millisecond },
+		OnDrop: func(bc Beacon, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			dropped = append(dropped, bc.ID)
+		},
+	})
+	is.NoErr(err)
+	stop := runBeaconer(t, b)
+
+	is.NoErr(b.Add(ScheduleBeacons("s1", beaconTestPod(srv.URL, 0), time.Now())...))
+	srv.waitFor(t, 11)
+	waitPending(t, b, 0)
+	stop()
+
+	is.True(slices.Contains(srv.Hits(), "/a1/start")) // succeeded on the third attempt
+	is.True(!slices.Contains(srv.Hits(), "/a2/start"))
+	is.Equal(dropped, []string{"s1/ad1/creative0/0"})
+	is.Equal(srv.fail["/a2/start"], 7) // given up after three attempts
+}
+
+// blockingSender reports every send on started, and finishes each once it
+// receives from release.
+type blockingSender struct {
+	started, release chan struct{}
+	cur, max, called atomic.Int32
+}
+
+func (s *blockingSender) Send(ctx context.Context, _ string) error {
+	s.called.Add(1)
+	n := s.cur.Add(1)
+	defer s.cur.Add(-1)
+	for {
+		m := s.max.Load()
+		if n <= m || s.max.CompareAndSwap(m, n) {
+			break
+		}
+	}
+	s.started <- struct{}{}
+	select {
+	case <-s.release:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestBeaconerConcurrency(t *testing.T) {
+	is := is.New(t)
+	sender := &blockingSender{started: make(chan struct{}, 12), release: make(chan struct{})}
+	b, err := NewBeaconer(BeaconerOptions{Sender: sender, Concurrency: 3})
+	is.NoErr(err)
+	stop := runBeaconer(t, b)
+
+	// Every send finished lets the next one start.
+	is.NoErr(b.Add(ScheduleBeacons("s1", beaconTestPod("http://t", 0), time.Now())...))
+	for range 3 {
+		<-sender.started
+	}
+	for range 9 {
+		sender.release <- struct{}{}
+		<-sender.started
+		is.Equal(sender.cur.Load(), int32(3))
+	}
+	close(sender.release)
+	waitPending(t, b, 0)
+	stop()
+	is.Equal(sender.called.Load(), int32(12))
+	is.Equal(sender.max.Load(), int32(3))
+}
+
+func TestBeaconerPersistsQueue(t *testing.T) {
+	is := is.New(t)
+	srv := newBeaconServer(t)
+	file := filepath.Join(t.TempDir(), "beacons.json")
+	start := time.Now().UTC() // as it reads back from JSON
+	// The first ad is due now, the second only after a long first ad.
+	pod := beaconTestPod(srv.URL, 0)
+	pod.Ad[0].InLine.Creatives[0].Linear.Duration = Duration{time.Hour}
+	pod.Ad[1].InLine.Creatives[0].Linear.Duration = Duration{time.Hour}
+	beacons := ScheduleBeacons("s1", pod, start)
+
+	b, err := NewBeaconer(BeaconerOptions{QueueFile: file})
+	is.NoErr(err)
+	is.NoErr(b.Add(beacons...))
+	stop := runBeaconer(t, b)
+	srv.waitFor(t, 2)
+	waitPending(t, b, 10)
+	stop()
+	is.Equal(srv.Hits(), []string{"/a1/impression", "/a1/start"})
+
+	// A restarted beaconer resumes the queue, and ignores beacons scheduled
+	// again for the same session.
+	b, err = NewBeaconer(BeaconerOptions{QueueFile: file, Concurrency: 1})
+	is.NoErr(err)
+	is.Equal(b.Pending(), beacons[2:])
+	is.NoErr(b.Add(beacons...))
+	is.Equal(len(b.Pending()), 10)
+
+	// Beacons are sent one at a time in due order, so once a beacon due now
+	// has been sent, the first ad's would have been too.
+	stop = runBeaconer(t, b)
+	is.NoErr(b.Add(Beacon{ID: "s1/next", URL: srv.URL + "/next", Due: time.Now()}))
+	srv.waitFor(t, 3)
+	stop()
+	is.Equal(srv.Hits(), []string{"/a1/impression", "/a1/start", "/next"})
+}
+
+func TestBeaconerRetention(t *testing.T) {
+	is := is.New(t)
+	srv := newBeaconServer(t)
+	b, err := NewBeaconer(BeaconerOptions{Retention: time.Minute})
+	is.NoErr(err)
+	stop := runBeaconer(t, b)
+	is.NoErr(b.Add(
+		Beacon{ID: "old", URL: srv.URL + "/old", Due: time.Now().Add(-time.Hour)},
+		Beacon{ID: "new", URL: srv.URL + "/new", Due: time.Now()},
+	))
+	srv.waitFor(t, 2)
+	waitPending(t, b, 0)
+	stop()
+
+	// Without a queue file too, only the beacons within retention are
+	// remembered.
+	is.NoErr(b.Add(Beacon{ID: "old", URL: srv.URL + "/old", Due: time.Now()}))
+	is.NoErr(b.Add(Beacon{ID: "new", URL: srv.URL + "/new", Due: time.Now()}))
+	is.Equal(len(b.Pending()), 1)
+	is.Equal(b.Pending()[0].ID, "old")
+}
+
+func TestDefaultBackoff(t *testing.T) {
+	is := is.New(t)
+	is.Equal(defaultBackoff(0), time.Second)
+	is.Equal(defaultBackoff(1), time.Second)
+	is.Equal(defaultBackoff(3), 4*time.Second)
+	is.Equal(defaultBackoff(7), time.Minute)
+	is.Equal(defaultBackoff(100), time.Minute)
+}
+
+func TestBeaconerBadQueueFile(t *testing.T) {
+	is := is.New(t)
+	file := filepath.Join(t.TempDir(), "beacons.json")
+	b, err := NewBeaconer(BeaconerOptions{QueueFile: file})
+	is.NoErr(err) // a missing file is an empty queue
+	is.NoErr(b.Add(Beacon{ID: "x", URL: "http://t/x", Due: time.Now().Add(time.Hour)}))
+
+	is.NoErr(os.WriteFile(file, []byte("{"), 0o600))
+	_, err = NewBeaconer(BeaconerOptions{QueueFile: file})
+	is.True(err != nil)
+}
+
+func TestBeaconerSaveError(t *testing.T) {
+	is := is.New(t)
+	srv := newBeaconServer(t)
+	dir := filepath.Join(t.TempDir(), "queue")
+	is.NoErr(os.Mkdir(dir, 0o700))
+	file := filepath.Join(dir, "beacons.json")
+	beacons := ScheduleBeacons("s1", beaconTestPod(srv.URL, 0), time.Now().UTC())
+
+	b, err := NewBeaconer(BeaconerOptions{QueueFile: file, Concurrency: 1})
+	is.NoErr(err)
+	is.NoErr(b.Add(beacons[:2]...))
+
+	// Run stops at the first failure to record a sent beacon.
+	is.NoErr(os.RemoveAll(dir))
+	err = b.Run(context.Background())
+	is.True(errors.Is(err, os.ErrNotExist))
+	is.Equal(len(srv.Hits()), 1)
+	is.Equal(len(b.Pending()), 1)
+
+	// Add reports the failure too, but still queues the beacons.
+	err = b.Add(beacons[2:]...)
+	is.True(errors.Is(err, os.ErrNotExist))
+	is.Equal(len(b.Pending()), len(beacons)-1)
+
+	// Once the file can be written again, the queue is written and Run
+	// carries on where it stopped.
+	is.NoErr(os.Mkdir(dir, 0o700))
+	stop := runBeaconer(t, b)
+	srv.waitFor(t, len(beacons))
+	waitPending(t, b, 0)
+	stop()
+	is.Equal(len(srv.Hits()), len(beacons))
+
+	b, err = NewBeaconer(BeaconerOptions{QueueFile: file})
+	is.NoErr(err)
+	is.Equal(len(b.Pending()), 0)
+	is.NoErr(b.Add(beacons...)) // all remembered as sent
+	is.Equal(len(b.Pending()), 0)
+}
@@ -0,0 +1,359 @@
+package vmap
+
+import "slices"
+
+// Clone returns a deep copy of v that shares no memory with it. Its strings
+// are copied into a single buffer of their own, so a clone of a VMAP from
+// DecodeVmapScan stays valid when the input is modified or reused.
+func (v *VMAP) Clone() VMAP {
+	c := *v
+	c.AdBreaks = cloneEach(v.AdBreaks, (*AdBreak).clone)
+	c.Extra = v.Extra.clone()
+	copyStrings(c.eachString)
+	return c
+}
+
+// Clone returns a deep copy of v that shares no memory with it, as
+// VMAP.Clone does.
+func (v *VAST) Clone() VAST {
+	c := v.clone()
+	copyStrings(c.eachString)
+	return c
+}
+
+// copyStrings copies the strings that each passes to its function into one
+// buffer, sized up front, and points them there.
+func copyStrings(each func(fn func(*string))) {
+	n := 0
+	each(func(s *string) { n += len(*s) })
+	buf := make([]byte, 0, n)
+	each(func(s *string) {
+		if *s == "" {
+			return
+		}
+		start := len(buf)
+		buf = append(buf, *s...)
+		*s = byteStr(buf[start:])
+	})
+}
+
+func cloneEach[T any](s []T, clone func(*T) T) []T {
+	if s == nil {
+		return nil
+	}
+	out := make([]T, len(s))
+	for i := range s {
+		out[i] = clone(&s[i])
+	}
+	return out
+}
+
+func clonePtr[T any](p *T, clone func(*T) T) *T {
+	if p == nil {
+		return nil
+	}
+	c := clone(p)
+	return &c
+}
+
+// --- structure ---
+//
+// The clone methods copy the slices and structs an element holds, but not
+// its strings.
+
+func (x *Extra) clone() *Extra {
+	if x == nil {
+		return nil
+	}
+	c := *x
+	c.Attrs, c.Nodes = slices.Clone(x.Attrs), slices.Clone(x.Nodes)
+	c.Tags = cloneEach(x.Tags, (*RawTag).clone)
+	return &c
+}
+
+func (t *RawTag) clone() RawTag {
+	c := *t
+	c.Attrs, c.Children = slices.Clone(t.Attrs), slices.Clone(t.Children)
+	return c
+}
+
+func (ab *AdBreak) clone() AdBreak {
+	c := *ab
+	c.lazy = ab.lazy.clone() // before AdSource, which Vast may be filling in
+	c.AdSource = clonePtr(ab.AdSource, (*AdSource).clone)
+	c.TrackingEvents = cloneEach(ab.TrackingEvents, (*TrackingEvent).clone)
+	c.Extra = ab.Extra.clone()
+	return c
+}
+
+func (src *AdSource) clone() AdSource {
+	return AdSource{VASTData: clonePtr(src.VASTData, (*VASTData).clone), Extra: src.Extra.clone()}
+}
+
+func (d *VASTData) clone() VASTData {
+	return VASTData{VAST: clonePtr(d.VAST, (*VAST).clone), Extra: d.Extra.clone()}
+}
+
+func (v *VAST) clone() VAST {
+	c := *v
+	c.Ad = cloneEach(v.Ad, (*Ad).clone)
+	c.Extra = v.Extra.clone()
+	return c
+}
+
+func (ad *Ad) clone() Ad {
+	c := *ad
+	c.InLine = clonePtr(ad.InLine, (*InLine).clone)
+	c.Extra = ad.Extra.clone()
+	return c
+}
+
+func (il *InLine) clone() InLine {
+	c := *il
+	c.Impression = cloneEach(il.Impression, (*Impression).clone)
+	c.Creatives = cloneEach(il.Creatives, (*Creative).clone)
+	c.Extensions = cloneEach(il.Extensions, (*Extension).clone)
+	c.Error = clonePtr(il.Error, (*Error).clone)
+	c.Extra = il.Extra.clone()
+	return c
+}
+
+func (cr *Creative) clone() Creative {
+	c := *cr
+	c.UniversalAdId = clonePtr(cr.UniversalAdId, (*UniversalAdId).clone)
+	c.Linear = clonePtr(cr.Linear, (*Linear).clone)
+	c.Extra = cr.Extra.clone()
+	return c
+}
+
+func (l *Linear) clone() Linear {
+	c := *l
+	c.TrackingEvents = cloneEach(l.TrackingEvents, (*TrackingEvent).clone)
+	c.MediaFiles = cloneEach(l.MediaFiles, (*MediaFile).clone)
+	c.ClickThrough = clonePtr(l.ClickThrough, (*ClickThrough).clone)
+	c.ClickTracking = cloneEach(l.ClickTracking, (*ClickTracking).clone)
+	c.CustomClick = cloneEach(l.CustomClick, (*CustomClick).clone)
+	c.Extra = l.Extra.clone()
+	return c
+}
+
+func (ext *Extension) clone() Extension {
+	c := *ext
+	c.CreativeParameters = cloneEach(ext.CreativeParameters, (*CreativeParameter).clone)
+	c.Extra = ext.Extra.clone()
+	return c
+}
+
+func (t *TrackingEvent) clone() TrackingEvent {
+	c := *t
+	c.Extra = t.Extra.clone()
+	return c
+}
+
+func (e *Error) clone() Error {
+	return Error{Value: e.Value, Extra: e.Extra.clone()}
+}
+
+func (imp *Impression) clone() Impression {
+	c := *imp
+	c.Extra = imp.Extra.clone()
+	return c
+}
+
+func (u *UniversalAdId) clone() UniversalAdId {
+	c := *u
+	c.Extra = u.Extra.clone()
+	return c
+}
+
+func (ct *ClickThrough) clone() ClickThrough {
+	c := *ct
+	c.Extra = ct.Extra.clone()
+	return c
+}
+
+func (ct *ClickTracking) clone() ClickTracking {
+	c := *ct
+	c.Extra = ct.Extra.clone()
+	return c
+}
+
+func (cc *CustomClick) clone() CustomClick {
+	c := *cc
+	c.Extra = cc.Extra.clone()
+	return c
+}
+
+func (m *MediaFile) clone() MediaFile {
+	c := *m
+	c.Extra = m.Extra.clone()
+	return c
+}
+
+func (p *CreativeParameter) clone() CreativeParameter {
+	c := *p
+	c.Extra = p.Extra.clone()
+	return c
+}
+
+// --- strings ---
+//
+// The eachString methods pass every string field of an element, and of the
+// elements it holds, to fn.
+
+func (x *Extra) eachString(fn func(*string)) {
+	if x == nil {
+		return
+	}
+	for i := range x.Attrs {
+		fn(&x.Attrs[i].In)
+		fn(&x.Attrs[i].XML)
+	}
+	for i := range x.Nodes {
+		fn(&x.Nodes[i].In)
+		fn(&x.Nodes[i].XML)
+	}
+	for i := range x.Tags {
+		t := &x.Tags[i]
+		fn(&t.In)
+		fn(&t.Prefix)
+		for j := range t.Attrs {
+			fn(&t.Attrs[j])
+		}
+		for j := range t.Children {
+			fn(&t.Children[j])
+		}
+	}
+	fn(&x.Prolog)
+	fn(&x.Epilog)
+}
+
+func (v *VMAP) eachString(fn func(*string)) {
+	fn(&v.XMLName.Space)
+	fn(&v.XMLName.Local)
+	fn(&v.Text)
+	fn(&v.Vmap)
+	fn(&v.Version)
+	for i := range v.AdBreaks {
+		v.AdBreaks[i].eachString(fn)
+	}
+	v.Extra.eachString(fn)
+}
+
+func (ab *AdBreak) eachString(fn func(*string)) {
+	if src := ab.AdSource; src != nil {
+		if d := src.VASTData; d != nil {
+			if d.VAST != nil {
+				d.VAST.eachString(fn)
+			}
+			d.Extra.eachString(fn)
+		}
+		src.Extra.eachString(fn)
+	}
+	for i := range ab.TrackingEvents {
+		ab.TrackingEvents[i].eachString(fn)
+	}
+	fn(&ab.Id)
+	fn(&ab.BreakType)
+	ab.Extra.eachString(fn)
+}
+
+func (t *TrackingEvent) eachString(fn func(*string)) {
+	fn(&t.Event)
+	fn(&t.Text)
+	t.Extra.eachString(fn)
+}
+
+func (v *VAST) eachString(fn func(*string)) {
+	fn(&v.Text)
+	fn(&v.Xsi)
+	fn(&v.NoNamespaceSchemaLocation)
+	fn(&v.Version)
+	for i := range v.Ad {
+		ad := &v.Ad[i]
+		fn(&ad.Id)
+		if ad.InLine != nil {
+			ad.InLine.eachString(fn)
+		}
+		ad.Extra.eachString(fn)
+	}
+	v.Extra.eachString(fn)
+}
+
+func (il *InLine) eachString(fn func(*string)) {
+	fn(&il.AdSystem)
+	fn(&il.AdTitle)
+	for i := range il.Impression {
+		imp := &il.Impression[i]
+		fn(&imp.Id)
+		fn(&imp.Text)
+		imp.Extra.eachString(fn)
+	}
+	for i := range il.Creatives {
+		il.Creatives[i].eachString(fn)
+	}
+	for i := range il.Extensions {
+		ext := &il.Extensions[i]
+		fn(&ext.ExtensionType)
+		for j := range ext.CreativeParameters {
+			p := &ext.CreativeParameters[j]
+			fn(&p.CreativeId)
+			fn(&p.Name)
+			fn(&p.Value)
+			fn(&p.CreativeParameterType)
+			p.Extra.eachString(fn)
+		}
+		ext.Extra.eachString(fn)
+	}
+	if il.Error != nil {
+		fn(&il.Error.Value)
+		il.Error.Extra.eachString(fn)
+	}
+	il.Extra.eachString(fn)
+}
+
+func (c *Creative) eachString(fn func(*string)) {
+	fn(&c.Id)
+	fn(&c.AdId)
+	if u := c.UniversalAdId; u != nil {
+		fn(&u.IdRegistry)
+		fn(&u.Id)
+		u.Extra.eachString(fn)
+	}
+	if l := c.Linear; l != nil {
+		l.eachString(fn)
+	}
+	c.Extra.eachString(fn)
+}
+
+func (l *Linear) eachString(fn func(*string)) {
+	for i := range l.TrackingEvents {
+		l.TrackingEvents[i].eachString(fn)
+	}
+	for i := range l.MediaFiles {
+		m := &l.MediaFiles[i]
+		fn(&m.Text)
+		fn(&m.Delivery)
+		fn(&m.MediaType)
+		fn(&m.Codec)
+		m.Extra.eachString(fn)
+	}
+	if ct := l.ClickThrough; ct != nil {
+		fn(&ct.Id)
+		fn(&ct.Text)
+		ct.Extra.eachString(fn)
+	}
+	for i := range l.ClickTracking {
+		ct := &l.ClickTracking[i]
+		fn(&ct.Id)
+		fn(&ct.Text)
+		ct.Extra.eachString(fn)
+	}
+	for i := range l.CustomClick {
+		cc := &l.CustomClick[i]
+		fn(&cc.Id)
+		fn(&cc.Text)
+		cc.Extra.eachString(fn)
+	}
+	l.Extra.eachString(fn)
+}
@@ -0,0 +1,121 @@
+package vmap
+
+import (
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestClone(t *testing.T) {
+	is := is.New(t)
+	doc, err := os.ReadFile("sample-vmap/testVmapUnknown.xml")
+	is.NoErr(err)
+	v, _, err := DecodeVmapScanWithOptions(doc, DecodeOptions{Lossless: true})
+	is.NoErr(err)
+	want := encodeString(t, v)
+
+	c := v.Clone()
+	is.Equal(c, v)
+	clear(doc)
+	is.Equal(encodeString(t, c), want) // the clone does not reference the input
+
+	// Nor does it share structs with the original.
+	c.AdBreaks[0].Id = "changed"
+	c.AdBreaks[0].AdSource.VASTData.VAST.Ad[0].InLine.AdTitle = "changed"
+	is.True(v.AdBreaks[0].Id != "changed")
+	is.True(v.AdBreaks[0].AdSource.VASTData.VAST.Ad[0].InLine.AdTitle != "changed")
+}
+
+func TestCloneVast(t *testing.T) {
+	is := is.New(t)
+	doc, err := os.ReadFile("sample-vmap/testVast.xml")
+	is.NoErr(err)
+	v, err := DecodeVastScan(doc)
+	is.NoErr(err)
+	want, err := MarshalVast(&v)
+	is.NoErr(err)
+
+	c := v.Clone()
+	is.Equal(c, v)
+	clear(doc)
+	got, err := MarshalVast(&c)
+	is.NoErr(err)
+	is.Equal(string(got), string(want))
+
+	var zero VAST
+	is.Equal(zero.Clone(), zero)
+}
+
+// TestCopyStringsReuseInput decodes into results that are read while the
+// input buffer is reused for the next document, as a pooled reader would.
+// Run with -race, any string still referencing the buffer is reported.
+func TestCopyStringsReuseInput(t *testing.T) {
+	is := is.New(t)
+	files := []string{"testVmap.xml", "testVmap2.xml", "testVmapEmptyVast.xml"}
+	docs := make([][]byte, len(files))
+	wants := make([]string, len(files))
+	for i, f := range files {
+		doc, err := os.ReadFile("sample-vmap/" + f)
+		is.NoErr(err)
+		v, err := DecodeVmapScan(doc)
+		is.NoErr(err)
+		docs[i], wants[i] = doc, encodeString(t, v)
+	}
+
+	var buf []byte
+	var wg sync.WaitGroup
+	results := make([][]byte, len(files))
+	for i := range docs {
+		buf = append(buf[:0], docs[i]...)
+		v, _, err := DecodeVmapScanWithOptions(buf, DecodeOptions{CopyStrings: true})
+		is.NoErr(err)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], _ = MarshalVmap(&v)
+		}()
+	}
+	clear(buf)
+	wg.Wait()
+	for i := range results {
+		is.Equal(string(results[i]), wants[i]) // files[i]
+	}
+}
+
+func TestCopyStringsVast(t *testing.T) {
+	is := is.New(t)
+	doc, err := os.ReadFile("sample-vmap/testVastSpecialChars.xml")
+	is.NoErr(err)
+	want, err := DecodeVastScan(doc)
+	is.NoErr(err)
+
+	buf := append([]byte(nil), doc...)
+	v, _, err := DecodeVastScanWithOptions(buf, DecodeOptions{CopyStrings: true})
+	is.NoErr(err)
+	clear(buf)
+	is.Equal(v, want)
+}
+
+func BenchmarkScanDecodeCopyStrings(b *testing.B) {
+	doc, err := os.ReadFile("sample-vmap/testVmap.xml")
+	if err != nil {
+		panic(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _, _ = DecodeVmapScanWithOptions(doc, DecodeOptions{CopyStrings: true})
+	}
+}
+
+func encodeString(t *testing.T, v VMAP) string {
+	t.Helper()
+	b, err := MarshalVmap(&v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
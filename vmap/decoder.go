@@ -3,104 +3,314 @@ package vmap
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"runtime"
 	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/CarlLindqvist/xmltokenizer"
 )
 
+// DecodeVast decodes a VAST document using the xmltokenizer package.
+// Malformed input is reported as an error; it never causes a panic.
+// Errors found within the document are of type *DecodeError.
 func DecodeVast(input []byte) (VAST, error) {
-	var vast VAST
+	return DecodeVastWithOptions(input, DecodeOptions{})
+}
+
+// DecodeVastWithOptions is like DecodeVast but enforces opts.Limits.
+// Decoding is always strict, so Strict may be set; the other options are
+// those of the scan decoders, and are an error.
+func DecodeVastWithOptions(input []byte, opts DecodeOptions) (vast VAST, err error) {
+	if err := checkTokenizerOptions(opts); err != nil {
+		return vast, err
+	}
+	if err := opts.Limits.checkBytes(input); err != nil {
+		return vast, err
+	}
 	found := false
 	f := bytes.NewReader([]byte(input))
 
 	tok := xmltokenizer.New(f, xmltokenizer.WithAttrBufferSize(5))
+	r := &tokenReader{tok: tok, limit: newLimiter(&opts.Limits)}
+	defer r.recoverMalformed(input, &err)
 
 	for {
-		token, err := tok.Token() // Token is only valid until next tok.Token() invocation (short-lived object).
+		token, err := r.Token() // Token is only valid until next r.Token() invocation (short-lived object).
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			panic(err)
+			return vast, r.errorAt(input, err)
 		}
 		switch string(token.Name.Local) {
 		case "VAST":
 			found = true
-			if token.SelfClosing {
-				break
-			}
 			// Reuse Token object in the sync.Pool since we only use it temporarily.
 			se := xmltokenizer.GetToken().Copy(token)
-			err = vast.UnmarshalToken(tok, se)
+			err = vast.decodeToken(r, se)
 			xmltokenizer.PutToken(se) // Put back to sync.Pool.
 			if err != nil {
-				return vast, err
+				return vast, r.errorAt(input, err)
 			}
 		}
 	}
 
 	if !found {
-		return vast, errors.New("no VAST token found in document")
+		return vast, ErrNoVAST
 	}
 	return vast, nil
 }
 
+// DecodeVmap decodes a VMAP document using the xmltokenizer package.
+// Malformed input is reported as an error; it never causes a panic.
+// Errors found within the document are of type *DecodeError.
 func DecodeVmap(input []byte) (VMAP, error) {
-	var vmap VMAP
-	found := false
-
-	f := bytes.NewReader([]byte(input))
+	return DecodeVmapWithOptions(input, DecodeOptions{})
+}
 
-	tok := xmltokenizer.New(f, xmltokenizer.WithAttrBufferSize(5))
+// DecodeVmapWithOptions is like DecodeVmap but enforces opts.Limits, with
+// the other options as for DecodeVastWithOptions.
+func DecodeVmapWithOptions(input []byte, opts DecodeOptions) (vmap VMAP, err error) {
+	if err := checkTokenizerOptions(opts); err != nil {
+		return vmap, err
+	}
+	if err := opts.Limits.checkBytes(input); err != nil {
+		return vmap, err
+	}
+	d := NewVmapDecoder(bytes.NewReader(input))
+	d.r.limit = newLimiter(&opts.Limits)
+	defer d.r.recoverMalformed(input, &err)
 
+	var adBreaks []AdBreak
 	for {
-		token, err := tok.Token() // Token is only valid until next tok.Token() invocation (short-lived object).
+		adBreak, err := d.next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			panic(err)
+			vmap = d.header
+			vmap.AdBreaks = adBreaks
+			return vmap, d.r.errorAt(input, err)
 		}
-		switch string(token.Name.Local) {
-		case "VMAP":
-			found = true
-			for i := range token.Attrs {
-				attr := &token.Attrs[i]
-				switch string(attr.Name.Local) {
-				case "version":
-					vmap.Version = string(attr.Value)
-				case "vmap":
-					vmap.Vmap = string(attr.Value)
-					vmap.XMLName.Space = string(attr.Value)
-				}
-				vmap.XMLName.Local = "VMAP"
-			}
+		adBreaks = append(adBreaks, adBreak)
+	}
 
-		case "AdBreak":
-			var adBreak AdBreak
-			// Reuse Token object in the sync.Pool since we only use it temporarily.
-			se := xmltokenizer.GetToken().Copy(token)
-			err = adBreak.UnmarshalToken(tok, se)
-			xmltokenizer.PutToken(se) // Put back to sync.Pool.
-			if err != nil {
-				return vmap, err
-			}
-			vmap.AdBreaks = append(vmap.AdBreaks, adBreak)
+	if !d.found {
+		return d.header, ErrNoVMAP
+	}
+	vmap = d.header
+	vmap.AdBreaks = adBreaks
+	return vmap, nil
+}
+
+// tokenReader wraps a Tokenizer and counts the tokens read from it, so that
+// the position of a decode error can be recovered from the input.
+type tokenReader struct {
+	tok   *xmltokenizer.Tokenizer
+	n     int
+	limit *limiter // nil without limits
+}
+
+// Token returns the next token of the underlying Tokenizer, or the error of
+// a limit it exceeds.
+func (r *tokenReader) Token() (xmltokenizer.Token, error) {
+	r.n++
+	token, err := r.tok.Token()
+	if err != nil || r.limit == nil {
+		return token, err
+	}
+	return token, r.limit.token(&token)
+}
+
+// token accounts for a token of the tokenizer.
+func (l *limiter) token(t *xmltokenizer.Token) error {
+	if len(t.Name.Local) == 0 {
+		return nil // declaration or comment
+	}
+	if err := l.tag(t.Name.Local, t.IsEndElement, t.SelfClosing); err != nil {
+		return err
+	}
+	for i := range t.Attrs {
+		if err := l.attr(t.Attrs[i].Value); err != nil {
+			return err
 		}
 	}
+	return l.text(t.Data)
+}
 
-	if !found {
-		return vmap, errors.New("no VMAP token found in document")
+// errorAt wraps err in a DecodeError positioned at the last token read, or
+// at the value in it that a *valueError names. Running out of input inside
+// an element is reported as io.ErrUnexpectedEOF.
+func (r *tokenReader) errorAt(input []byte, err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	off := tokenOffset(input, r.n)
+	var verr *valueError
+	if errors.As(err, &verr) {
+		off = valueOffset(input, off, verr.attr)
+		err = verr.err
+	}
+	return newDecodeError(input, off, err)
+}
+
+// valueError is an error in the value of attribute attr of the last token
+// read, or in its text if attr is "".
+type valueError struct {
+	attr string
+	err  error
+}
+
+func (e *valueError) Error() string { return e.err.Error() }
+
+func (e *valueError) Unwrap() error { return e.err }
+
+// valueOffset returns the offset in input of the value of attribute attr,
+// or of the text if attr is "", of the start tag at offset start. The value
+// is found as the scan decoders find it, so that both report errors in it
+// at the same position. It returns start if there is no such value.
+func valueOffset(input []byte, start int, attr string) int {
+	s := scan{data: input, pos: start}
+	if name, isEnd, _ := s.next(); name == nil || isEnd {
+		return start
+	}
+	var v []byte
+	if attr != "" {
+		v = s.attr(attr)
+	} else {
+		s.endAttrs()
+		v, _ = s.text()
+	}
+	if v == nil {
+		return start
+	}
+	return s.offsetOf(v)
+}
+
+// checkTokenizerOptions returns the error of opts setting an option of the
+// scan decoders, which the tokenizer decoders do not support.
+func checkTokenizerOptions(opts DecodeOptions) error {
+	var name string
+	switch {
+	case opts.Lossless:
+		name = "Lossless"
+	case opts.CopyStrings:
+		name = "CopyStrings"
+	case opts.Lazy:
+		name = "Lazy"
+	case opts.Workers > 1:
+		name = "Workers"
+	default:
+		return nil
+	}
+	return fmt.Errorf("decoder backend %s: %s is not supported", BackendTokenizer, name)
+}
+
+// recoverMalformed converts a panic raised while tokenizing into an error
+// stored in *err. The tokenizer indexes past the end of its buffer on some
+// truncated tags, and a single bad document must not bring down the caller.
+func (r *tokenReader) recoverMalformed(input []byte, err *error) {
+	if p := recover(); p != nil {
+		*err = r.errorAt(input, tokenizerPanic(p))
+	}
+}
+
+// tokenizerPanic returns the error for p, recovered while tokenizing, if it
+// is the tokenizer indexing out of range, and panics again with p for any
+// other panic. It must be called from the deferred function that recovered
+// p, while the frames of the panic are still on the stack.
+func tokenizerPanic(p any) error {
+	if re, ok := p.(runtime.Error); !ok || !strings.Contains(re.Error(), "out of range") || !panickedIn(tokenizerPkg) {
+		panic(p)
+	}
+	return fmt.Errorf("malformed XML document: %v", p)
+}
+
+const tokenizerPkg = "github.com/CarlLindqvist/xmltokenizer."
+
+// panickedIn reports whether the panic being handled was raised by a
+// function whose name starts with prefix.
+func panickedIn(prefix string) bool {
+	var pcs [64]uintptr
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs[:])])
+	inPanic := false
+	for {
+		f, more := frames.Next()
+		switch {
+		case f.Function == "runtime.gopanic":
+			inPanic = true
+		case inPanic && !strings.HasPrefix(f.Function, "runtime."):
+			return strings.HasPrefix(f.Function, prefix)
+		}
+		if !more {
+			return false
+		}
+	}
+}
+
+// tokenOffset returns the offset in input at which the tokenizer's n-th
+// token (1-based) starts, by repeating its tokenization rules: a token runs
+// from '<' to the matching '>', and a regular tag also takes the character
+// data or CDATA section that follows it.
+func tokenOffset(input []byte, n int) int {
+	pos := 0
+	for k := 1; ; k++ {
+		i := bytes.IndexByte(input[pos:], '<')
+		if i < 0 {
+			return len(input)
+		}
+		start := pos + i
+		if k >= n {
+			return start
+		}
+
+		depth := 0
+		end := start
+		for ; end < len(input); end++ {
+			if input[end] == '<' {
+				depth++
+			} else if input[end] == '>' {
+				if depth--; depth == 0 {
+					break
+				}
+			}
+		}
+		if end >= len(input) {
+			return len(input)
+		}
+		pos = end + 1
+		if c := input[start+1]; c == '?' || c == '!' {
+			continue
+		}
+
+		i = bytes.IndexByte(input[pos:], '<')
+		if i < 0 {
+			return len(input)
+		}
+		pos += i
+		if bytes.HasPrefix(input[pos:], []byte("<![CDATA[")) {
+			pos = skipPast(input, pos, "]]>")
+		}
 	}
-	return vmap, nil
 }
 
+// UnmarshalToken decodes an AdBreak from tok, given its start element se.
 func (adBreak *AdBreak) UnmarshalToken(tok *xmltokenizer.Tokenizer, se *xmltokenizer.Token) error {
+	return adBreak.decodeToken(&tokenReader{tok: tok}, se)
+}
+
+func (adBreak *AdBreak) decodeToken(r *tokenReader, se *xmltokenizer.Token) error {
 	adBreak.AdSource = &AdSource{
 		VASTData: &VASTData{},
 	}
 	var err error
+	if err := unescapeAttrs(se.Attrs); err != nil {
+		return err
+	}
 	for i := range se.Attrs {
 		attr := &se.Attrs[i]
 		switch string(attr.Name.Local) {
@@ -111,13 +321,16 @@ func (adBreak *AdBreak) UnmarshalToken(tok *xmltokenizer.Tokenizer, se *xmltoken
 		case "timeOffset":
 			err = adBreak.TimeOffset.UnmarshalText(attr.Value)
 			if err != nil {
-				return err
+				return &valueError{attr: "timeOffset", err: err}
 			}
 		}
 	}
+	if se.SelfClosing {
+		return nil
+	}
 
 	for {
-		token, err := tok.Token()
+		token, err := r.Token()
 		if err != nil {
 			return err
 		}
@@ -130,13 +343,9 @@ func (adBreak *AdBreak) UnmarshalToken(tok *xmltokenizer.Tokenizer, se *xmltoken
 		switch string(token.Name.Local) {
 		case "VAST":
 			var vast VAST
-			if token.SelfClosing {
-				adBreak.AdSource.VASTData.VAST = &VAST{}
-				break
-			}
 			// Reuse Token object in the sync.Pool since we only use it temporarily.
 			se := xmltokenizer.GetToken().Copy(token)
-			err = vast.UnmarshalToken(tok, se)
+			err = vast.decodeToken(r, se)
 			xmltokenizer.PutToken(se) // Put back to sync.Pool.
 			if err != nil {
 				return err
@@ -147,6 +356,9 @@ func (adBreak *AdBreak) UnmarshalToken(tok *xmltokenizer.Tokenizer, se *xmltoken
 				adBreak.TrackingEvents = []TrackingEvent{}
 			}
 			var t TrackingEvent
+			if err := unescapeAttrs(token.Attrs); err != nil {
+				return err
+			}
 			for i := range token.Attrs {
 				attr := &token.Attrs[i]
 				switch string(attr.Name.Local) {
@@ -154,27 +366,30 @@ func (adBreak *AdBreak) UnmarshalToken(tok *xmltokenizer.Tokenizer, se *xmltoken
 					t.Event = string(attr.Value)
 				}
 			}
-			if token.WasCDATA {
-				t.Text = string(token.Data)
-			} else {
-				t.Text = string(xmlStringToString(token.Data))
+			t.Text, err = tokenText(&token)
+			if err != nil {
+				return err
 			}
 			adBreak.TrackingEvents = append(adBreak.TrackingEvents, t)
 		}
 	}
 }
 
+// UnmarshalToken decodes a VAST from tok, given its start element se.
 func (vast *VAST) UnmarshalToken(tok *xmltokenizer.Tokenizer, se *xmltokenizer.Token) error {
-	for i := range se.Attrs {
-		attr := &se.Attrs[i]
-		switch string(attr.Name.Local) {
-		case "version":
-			vast.Version = string(attr.Value)
-		}
+	return vast.decodeToken(&tokenReader{tok: tok}, se)
+}
+
+func (vast *VAST) decodeToken(r *tokenReader, se *xmltokenizer.Token) error {
+	if err := vast.decodeAttrs(se); err != nil {
+		return err
+	}
+	if se.SelfClosing {
+		return nil
 	}
 
 	for {
-		token, err := tok.Token()
+		token, err := r.Token()
 		if err != nil {
 			return err
 		}
@@ -189,7 +404,7 @@ func (vast *VAST) UnmarshalToken(tok *xmltokenizer.Tokenizer, se *xmltokenizer.T
 			var ad Ad
 			// Reuse Token object in the sync.Pool since we only use it temporarily.
 			se := xmltokenizer.GetToken().Copy(token)
-			err = ad.UnmarshalToken(tok, se)
+			err = ad.decodeToken(r, se)
 			xmltokenizer.PutToken(se) // Put back to sync.Pool.
 			if err != nil {
 				return err
@@ -199,22 +414,52 @@ func (vast *VAST) UnmarshalToken(tok *xmltokenizer.Tokenizer, se *xmltokenizer.T
 	}
 }
 
+func (vast *VAST) decodeAttrs(se *xmltokenizer.Token) error {
+	if err := unescapeAttrs(se.Attrs); err != nil {
+		return err
+	}
+	for i := range se.Attrs {
+		attr := &se.Attrs[i]
+		switch string(attr.Name.Local) {
+		case "xsi":
+			vast.Xsi = string(attr.Value)
+		case "noNamespaceSchemaLocation":
+			vast.NoNamespaceSchemaLocation = string(attr.Value)
+		case "version":
+			vast.Version = string(attr.Value)
+		}
+	}
+	return nil
+}
+
+// UnmarshalToken decodes an Ad from tok, given its start element se.
 func (ad *Ad) UnmarshalToken(tok *xmltokenizer.Tokenizer, se *xmltokenizer.Token) error {
+	return ad.decodeToken(&tokenReader{tok: tok}, se)
+}
+
+func (ad *Ad) decodeToken(r *tokenReader, se *xmltokenizer.Token) error {
+	if err := unescapeAttrs(se.Attrs); err != nil {
+		return err
+	}
 	for i := range se.Attrs {
 		attr := &se.Attrs[i]
 		switch string(attr.Name.Local) {
 		case "sequence":
 			seq, err := strconv.Atoi(string(attr.Value))
 			if err != nil {
-				return err
+				return &valueError{attr: "sequence", err: err}
 			}
 			ad.Sequence = seq
 		case "id":
 			ad.Id = string(attr.Value)
 		}
 	}
+	if se.SelfClosing {
+		return nil
+	}
+
 	for {
-		token, err := tok.Token()
+		token, err := r.Token()
 		if err != nil {
 			return err
 		}
@@ -229,7 +474,7 @@ func (ad *Ad) UnmarshalToken(tok *xmltokenizer.Tokenizer, se *xmltokenizer.Token
 			var inline InLine
 			// Reuse Token object in the sync.Pool since we only use it temporarily.
 			se := xmltokenizer.GetToken().Copy(token)
-			err = inline.UnmarshalToken(tok, se)
+			err = inline.decodeToken(r, se)
 			xmltokenizer.PutToken(se) // Put back to sync.Pool.
 			if err != nil {
 				return err
@@ -239,9 +484,18 @@ func (ad *Ad) UnmarshalToken(tok *xmltokenizer.Tokenizer, se *xmltokenizer.Token
 	}
 }
 
+// UnmarshalToken decodes an InLine from tok, given its start element se.
 func (inline *InLine) UnmarshalToken(tok *xmltokenizer.Tokenizer, se *xmltokenizer.Token) error {
+	return inline.decodeToken(&tokenReader{tok: tok}, se)
+}
+
+func (inline *InLine) decodeToken(r *tokenReader, se *xmltokenizer.Token) error {
+	if se.SelfClosing {
+		return nil
+	}
+
 	for {
-		token, err := tok.Token()
+		token, err := r.Token()
 		if err != nil {
 			return err
 		}
@@ -255,7 +509,7 @@ func (inline *InLine) UnmarshalToken(tok *xmltokenizer.Tokenizer, se *xmltokeniz
 		case "Creative":
 			var c Creative
 			se := xmltokenizer.GetToken().Copy(token)
-			err = c.UnmarshalToken(tok, se)
+			err = c.decodeToken(r, se)
 			xmltokenizer.PutToken(se) // Put back to sync.Pool.
 			if err != nil {
 				return err
@@ -263,6 +517,9 @@ func (inline *InLine) UnmarshalToken(tok *xmltokenizer.Tokenizer, se *xmltokeniz
 			inline.Creatives = append(inline.Creatives, c)
 		case "Impression":
 			var imp Impression
+			if err := unescapeAttrs(token.Attrs); err != nil {
+				return err
+			}
 			for i := range token.Attrs {
 				attr := &token.Attrs[i]
 				switch string(attr.Name.Local) {
@@ -270,29 +527,26 @@ func (inline *InLine) UnmarshalToken(tok *xmltokenizer.Tokenizer, se *xmltokeniz
 					imp.Id = string(attr.Value)
 				}
 			}
-			if token.WasCDATA {
-				imp.Text = string(token.Data)
-			} else {
-				imp.Text = string(xmlStringToString(token.Data))
+			imp.Text, err = tokenText(&token)
+			if err != nil {
+				return err
 			}
 			inline.Impression = append(inline.Impression, imp)
 		case "AdSystem":
-			if token.WasCDATA {
-				inline.AdSystem = string(token.Data)
-			} else {
-				inline.AdSystem = string(xmlStringToString(token.Data))
+			inline.AdSystem, err = tokenText(&token)
+			if err != nil {
+				return err
 			}
 		case "AdTitle":
-			if token.WasCDATA {
-				inline.AdTitle = string(token.Data)
-			} else {
-				inline.AdTitle = string(xmlStringToString(token.Data))
+			inline.AdTitle, err = tokenText(&token)
+			if err != nil {
+				return err
 			}
 		case "Extension":
 			var e Extension
 			// Reuse Token object in the sync.Pool since we only use it temporarily.
 			se := xmltokenizer.GetToken().Copy(token)
-			err = e.UnmarshalToken(tok, se)
+			err = e.decodeToken(r, se)
 			xmltokenizer.PutToken(se) // Put back to sync.Pool.
 			if err != nil {
 				return err
@@ -300,18 +554,24 @@ func (inline *InLine) UnmarshalToken(tok *xmltokenizer.Tokenizer, se *xmltokeniz
 			inline.Extensions = append(inline.Extensions, e)
 		case "Error":
 			var er Error
-			er.Value = string(token.Data)
-			if token.WasCDATA {
-				er.Value = string(token.Data)
-			} else {
-				er.Value = string(xmlStringToString(token.Data))
+			er.Value, err = tokenText(&token)
+			if err != nil {
+				return err
 			}
 			inline.Error = &er
 		}
 	}
 }
 
+// UnmarshalToken decodes a Creative from tok, given its start element se.
 func (c *Creative) UnmarshalToken(tok *xmltokenizer.Tokenizer, se *xmltokenizer.Token) error {
+	return c.decodeToken(&tokenReader{tok: tok}, se)
+}
+
+func (c *Creative) decodeToken(r *tokenReader, se *xmltokenizer.Token) error {
+	if err := unescapeAttrs(se.Attrs); err != nil {
+		return err
+	}
 	for i := range se.Attrs {
 		attr := &se.Attrs[i]
 		switch string(attr.Name.Local) {
@@ -323,9 +583,12 @@ func (c *Creative) UnmarshalToken(tok *xmltokenizer.Tokenizer, se *xmltokenizer.
 			//TODO
 		}
 	}
+	if se.SelfClosing {
+		return nil
+	}
 
 	for {
-		token, err := tok.Token()
+		token, err := r.Token()
 		if err != nil {
 			return err
 		}
@@ -339,6 +602,9 @@ func (c *Creative) UnmarshalToken(tok *xmltokenizer.Tokenizer, se *xmltokenizer.
 		switch string(token.Name.Local) {
 		case "UniversalAdId":
 			var uaid UniversalAdId
+			if err := unescapeAttrs(token.Attrs); err != nil {
+				return err
+			}
 			for i := range token.Attrs {
 				attr := &token.Attrs[i]
 				switch string(attr.Name.Local) {
@@ -346,10 +612,9 @@ func (c *Creative) UnmarshalToken(tok *xmltokenizer.Tokenizer, se *xmltokenizer.
 					uaid.IdRegistry = string(attr.Value)
 				}
 			}
-			if token.WasCDATA {
-				uaid.Id = string(token.Data)
-			} else {
-				uaid.Id = string(xmlStringToString(token.Data))
+			uaid.Id, err = tokenText(&token)
+			if err != nil {
+				return err
 			}
 			c.UniversalAdId = &uaid
 		case "Tracking":
@@ -357,6 +622,9 @@ func (c *Creative) UnmarshalToken(tok *xmltokenizer.Tokenizer, se *xmltokenizer.
 				c.Linear = &Linear{}
 			}
 			var t TrackingEvent
+			if err := unescapeAttrs(token.Attrs); err != nil {
+				return err
+			}
 			for i := range token.Attrs {
 				attr := &token.Attrs[i]
 				switch string(attr.Name.Local) {
@@ -364,14 +632,19 @@ func (c *Creative) UnmarshalToken(tok *xmltokenizer.Tokenizer, se *xmltokenizer.
 					t.Event = string(attr.Value)
 				}
 			}
-			if token.WasCDATA {
-				t.Text = string(token.Data)
-			} else {
-				t.Text = string(xmlStringToString(token.Data))
+			t.Text, err = tokenText(&token)
+			if err != nil {
+				return err
 			}
 			c.Linear.TrackingEvents = append(c.Linear.TrackingEvents, t)
 		case "ClickThrough":
+			if c.Linear == nil {
+				c.Linear = &Linear{}
+			}
 			c.Linear.ClickThrough = &ClickThrough{}
+			if err := unescapeAttrs(token.Attrs); err != nil {
+				return err
+			}
 			for i := range token.Attrs {
 				attr := &token.Attrs[i]
 				switch string(attr.Name.Local) {
@@ -379,16 +652,18 @@ func (c *Creative) UnmarshalToken(tok *xmltokenizer.Tokenizer, se *xmltokenizer.
 					c.Linear.ClickThrough.Id = string(attr.Value)
 				}
 			}
-			if token.WasCDATA {
-				c.Linear.ClickThrough.Text = string(token.Data)
-			} else {
-				c.Linear.ClickThrough.Text = string(xmlStringToString(token.Data))
+			c.Linear.ClickThrough.Text, err = tokenText(&token)
+			if err != nil {
+				return err
 			}
 		case "ClickTracking":
 			if c.Linear == nil {
 				c.Linear = &Linear{}
 			}
 			var ct ClickTracking
+			if err := unescapeAttrs(token.Attrs); err != nil {
+				return err
+			}
 			for i := range token.Attrs {
 				attr := &token.Attrs[i]
 				switch string(attr.Name.Local) {
@@ -396,47 +671,71 @@ func (c *Creative) UnmarshalToken(tok *xmltokenizer.Tokenizer, se *xmltokenizer.
 					ct.Id = string(attr.Value)
 				}
 			}
-			if token.WasCDATA {
-				ct.Text = string(token.Data)
-			} else {
-				ct.Text = string(xmlStringToString(token.Data))
+			ct.Text, err = tokenText(&token)
+			if err != nil {
+				return err
 			}
 			c.Linear.ClickTracking = append(c.Linear.ClickTracking, ct)
-		case "Duration":
+		case "CustomClick":
 			if c.Linear == nil {
 				c.Linear = &Linear{}
 			}
-			if token.WasCDATA {
-				err = c.Linear.Duration.UnmarshalText(token.Data)
-			} else {
-				err = c.Linear.Duration.UnmarshalText(xmlStringToString(token.Data))
+			var cc CustomClick
+			if err := unescapeAttrs(token.Attrs); err != nil {
+				return err
 			}
-
+			for i := range token.Attrs {
+				attr := &token.Attrs[i]
+				switch string(attr.Name.Local) {
+				case "id":
+					cc.Id = string(attr.Value)
+				}
+			}
+			cc.Text, err = tokenText(&token)
 			if err != nil {
 				return err
 			}
+			c.Linear.CustomClick = append(c.Linear.CustomClick, cc)
+		case "Duration":
+			if c.Linear == nil {
+				c.Linear = &Linear{}
+			}
+			data := token.Data
+			if !token.WasCDATA {
+				data, err = unescapeXML(data)
+				if err != nil {
+					return &valueError{err: err}
+				}
+			}
+			err = c.Linear.Duration.UnmarshalText(data)
+			if err != nil {
+				return &valueError{err: err}
+			}
 		case "MediaFile":
 			if c.Linear == nil {
 				c.Linear = &Linear{}
 			}
 			var m MediaFile
+			if err := unescapeAttrs(token.Attrs); err != nil {
+				return err
+			}
 			for i := range token.Attrs {
 				attr := &token.Attrs[i]
 				switch string(attr.Name.Local) {
 				case "bitrate":
 					m.Bitrate, err = strconv.Atoi(string(attr.Value))
 					if err != nil {
-						return err
+						return &valueError{attr: "bitrate", err: err}
 					}
 				case "height":
 					m.Height, err = strconv.Atoi(string(attr.Value))
 					if err != nil {
-						return err
+						return &valueError{attr: "height", err: err}
 					}
 				case "width":
 					m.Width, err = strconv.Atoi(string(attr.Value))
 					if err != nil {
-						return err
+						return &valueError{attr: "width", err: err}
 					}
 				case "delivery":
 					m.Delivery = string(attr.Value)
@@ -446,17 +745,24 @@ func (c *Creative) UnmarshalToken(tok *xmltokenizer.Tokenizer, se *xmltokenizer.
 					m.Codec = string(attr.Value)
 				}
 			}
-			if token.WasCDATA {
-				m.Text = string(token.Data)
-			} else {
-				m.Text = string(xmlStringToString(token.Data))
+			m.Text, err = tokenText(&token)
+			if err != nil {
+				return err
 			}
 			c.Linear.MediaFiles = append(c.Linear.MediaFiles, m)
 		}
 	}
 }
 
+// UnmarshalToken decodes an Extension from tok, given its start element se.
 func (ext *Extension) UnmarshalToken(tok *xmltokenizer.Tokenizer, se *xmltokenizer.Token) error {
+	return ext.decodeToken(&tokenReader{tok: tok}, se)
+}
+
+func (ext *Extension) decodeToken(r *tokenReader, se *xmltokenizer.Token) error {
+	if err := unescapeAttrs(se.Attrs); err != nil {
+		return err
+	}
 	for i := range se.Attrs {
 		attr := &se.Attrs[i]
 		switch string(attr.Name.Local) {
@@ -464,8 +770,12 @@ func (ext *Extension) UnmarshalToken(tok *xmltokenizer.Tokenizer, se *xmltokeniz
 			ext.ExtensionType = string(attr.Value)
 		}
 	}
+	if se.SelfClosing {
+		return nil
+	}
+
 	for {
-		token, err := tok.Token()
+		token, err := r.Token()
 		if err != nil {
 			return err
 		}
@@ -479,6 +789,9 @@ func (ext *Extension) UnmarshalToken(tok *xmltokenizer.Tokenizer, se *xmltokeniz
 		switch string(token.Name.Local) {
 		case "CreativeParameter":
 			var par CreativeParameter
+			if err := unescapeAttrs(token.Attrs); err != nil {
+				return err
+			}
 			for i := range token.Attrs {
 				attr := &token.Attrs[i]
 				switch string(attr.Name.Local) {
@@ -490,69 +803,139 @@ func (ext *Extension) UnmarshalToken(tok *xmltokenizer.Tokenizer, se *xmltokeniz
 					par.CreativeParameterType = string(attr.Value)
 				}
 			}
-			if token.WasCDATA {
-				par.Value = string(token.Data)
-			} else {
-				par.Value = string(xmlStringToString(token.Data))
+			par.Value, err = tokenText(&token)
+			if err != nil {
+				return err
 			}
 			ext.CreativeParameters = append(ext.CreativeParameters, par)
 		}
 	}
 }
 
-func xmlStringToString(input []byte) []byte {
-	o := 0
-	for i := 0; i < len(input); i++ {
-		b := input[i]
-
-		switch b {
-		//If we see a '&' we have a special character that needs decoding
-		case '&':
-			cb := make([]byte, 0, 4)
-		specialCharLoop:
-			for {
-				i++
-				if i >= len(input) {
-					break
-				}
-
-				c := input[i]
-				switch c {
-				case '#', 'x':
-				case ';':
-					break specialCharLoop
-				default:
-					cb = append(cb, c)
-				}
-			}
-			ch := decodeSpecialCharacterFromHexCode(cb)
-			for _, l := range []byte(string(ch)) {
-				input[o] = l
-				o++
-			}
-		//This is just a normal byte, just output it
-		default:
-			input[o] = b
+// unescapeXML decodes the character references (&#10; and &#xA;) and the
+// five predefined entities (&amp; &lt; &gt; &apos; &quot;) in b. Decoding is
+// done in place: a decoded reference is never longer than its escaped form,
+// so the write position can never overtake the read position. The returned
+// slice is the decoded prefix of b.
+func unescapeXML(b []byte) ([]byte, error) {
+	i := bytes.IndexByte(b, '&')
+	if i < 0 {
+		return b, nil
+	}
+	o := i
+	for i < len(b) {
+		c := b[i]
+		if c != '&' {
+			b[o] = c
 			o++
+			i++
+			continue
+		}
+		end := bytes.IndexByte(b[i+1:], ';')
+		if end < 0 || end > maxEntityLen {
+			return nil, fmt.Errorf("unterminated entity reference: %q", snippet(b[i:]))
+		}
+		r, err := decodeEntity(b[i+1 : i+1+end])
+		if err != nil {
+			return nil, err
 		}
+		o += utf8.EncodeRune(b[o:], r)
+		i += end + 2
 	}
-	return input[0:o]
+	return b[:o], nil
 }
 
-func decodeSpecialCharacterFromHexCode(input []byte) rune {
-	// Handle &amp; &lt; &gt; &apos; &quot;
-	switch string(input) {
+// maxEntityLen bounds the search for the ';' that terminates a reference,
+// so a stray '&' in a long text node is reported without scanning to the end.
+const maxEntityLen = 32
+
+// decodeEntity resolves the name of a reference, without the surrounding
+// '&' and ';', to the rune it represents.
+func decodeEntity(name []byte) (rune, error) {
+	switch string(name) {
 	case "amp":
-		return '&'
+		return '&', nil
 	case "lt":
-		return '<'
+		return '<', nil
 	case "gt":
-		return '>'
+		return '>', nil
 	case "apos":
-		return '\''
+		return '\'', nil
 	case "quot":
-		return '"'
+		return '"', nil
+	}
+	if len(name) < 2 || name[0] != '#' {
+		return 0, fmt.Errorf("unknown entity: &%s;", name)
+	}
+	digits, base := name[1:], rune(10)
+	if digits[0] == 'x' {
+		digits, base = digits[1:], 16
+	}
+	if len(digits) == 0 {
+		return 0, fmt.Errorf("invalid character reference: &%s;", name)
+	}
+	var r rune
+	for _, c := range digits {
+		var d rune
+		switch {
+		case c >= '0' && c <= '9':
+			d = rune(c - '0')
+		case base == 16 && c >= 'a' && c <= 'f':
+			d = rune(c-'a') + 10
+		case base == 16 && c >= 'A' && c <= 'F':
+			d = rune(c-'A') + 10
+		default:
+			return 0, fmt.Errorf("invalid character reference: &%s;", name)
+		}
+		r = r*base + d
+		if r > unicode.MaxRune {
+			return 0, fmt.Errorf("invalid character reference: &%s;", name)
+		}
+	}
+	if !isXMLChar(r) {
+		return 0, fmt.Errorf("character reference to illegal character: &%s;", name)
+	}
+	return r, nil
+}
+
+// isXMLChar reports whether r is in the Char production of XML 1.0.
+func isXMLChar(r rune) bool {
+	return r == 0x09 || r == 0x0A || r == 0x0D ||
+		r >= 0x20 && r <= 0xD7FF ||
+		r >= 0xE000 && r <= 0xFFFD ||
+		r >= 0x10000 && r <= unicode.MaxRune
+}
+
+// snippet returns at most the first 16 bytes of b, for use in error messages.
+func snippet(b []byte) []byte {
+	if len(b) > 16 {
+		return b[:16]
+	}
+	return b
+}
+
+// tokenText returns the character data of token. Entity references are
+// decoded unless the data came from a CDATA section.
+func tokenText(token *xmltokenizer.Token) (string, error) {
+	if token.WasCDATA {
+		return string(token.Data), nil
+	}
+	b, err := unescapeXML(token.Data)
+	if err != nil {
+		return "", &valueError{err: err}
+	}
+	return string(b), nil
+}
+
+// unescapeAttrs decodes the entity references of every attribute value in
+// place, so the values can be used directly afterwards.
+func unescapeAttrs(attrs []xmltokenizer.Attr) error {
+	for i := range attrs {
+		v, err := unescapeXML(attrs[i].Value)
+		if err != nil {
+			return &valueError{attr: string(attrs[i].Name.Local), err: err}
+		}
+		attrs[i].Value = v
 	}
-	codePoint, _ := strconv.ParseInt(string(input), 16, 32)
-	return rune(codePoint)
+	return nil
 }
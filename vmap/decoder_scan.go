@@ -3,10 +3,51 @@ package vmap
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"strconv"
 	"unsafe"
 )
 
+// DecodeOptions controls the behaviour of the scan decoders.
+type DecodeOptions struct {
+	// Strict makes decoding fail on the first malformed value (time offset,
+	// duration, integer attribute, entity reference) or unterminated element.
+	// By default such problems are skipped over and returned as warnings.
+	Strict bool
+	// Lossless keeps the attributes and elements that have no field in the
+	// structs, in the Extra fields of the structs they were found in, so
+	// that the fast encoder writes them back. Unknown elements are skipped
+	// whole, so known elements nested in them are not decoded. The layout
+	// of the document is kept with them: the markup around the root and
+	// between elements, such as whitespace and comments, element prefixes,
+	// the order of attributes and child elements and CDATA sections, so
+	// that the document is written back as found, but for the quotes
+	// around known attributes and the spacing between attributes and
+	// within elements holding text.
+	Lossless bool
+	// CopyStrings copies the strings of the result into a single buffer of
+	// their own rather than referencing the input, so that the input can be
+	// modified or reused once decoding returns.
+	CopyStrings bool
+	// Lazy leaves the VAST of each AdBreak undecoded, for AdBreak.Vast to
+	// decode when it is first needed, which also returns the warnings of
+	// the VAST; the rest of the VMAP is decoded as usual. AdBreak.Vast
+	// lists the functions that decode VASTs this way. The input is kept for
+	// it, as with CopyStrings a copy of the input. It applies to VMAP
+	// documents only.
+	Lazy bool
+	// Workers, when above 1, decodes the VAST of the AdBreaks of a VMAP on
+	// up to that many goroutines, once a first pass has found where each
+	// is. The VMAP and warnings are the same as when decoding on one; so is
+	// the error, but not the VMAP decoded up to it. It is ignored with
+	// Lazy, and for VAST documents.
+	Workers int
+	// Limits bounds what decoding may take. Unlike the other options, it
+	// also applies to DecodeVmapWithOptions and DecodeVastWithOptions,
+	// which are always strict.
+	Limits Limits
+}
+
 // byteStr converts b to a string without copying. The returned string
 // shares memory with b; b must not be modified while the string is in use.
 func byteStr(b []byte) string {
@@ -17,23 +58,101 @@ func byteStr(b []byte) string {
 }
 
 // decodeXMLStr converts XML text bytes to a Go string, decoding entities.
-// Zero-copy when no entities are present.
-func decodeXMLStr(b []byte) string {
+// Zero-copy when no entities are present. Text with malformed or unknown
+// references is returned as-is, together with the error.
+func decodeXMLStr(b []byte) (string, error) {
 	if len(b) == 0 {
-		return ""
+		return "", nil
 	}
 	if bytes.IndexByte(b, '&') < 0 {
-		return byteStr(b)
+		return byteStr(b), nil
 	}
 	cp := make([]byte, len(b))
 	copy(cp, b)
-	return string(xmlStringToString(cp))
+	dec, err := unescapeXML(cp)
+	if err != nil {
+		return byteStr(b), err
+	}
+	return byteStr(dec), nil
 }
 
 // scan is a minimal byte scanner for VMAP/VAST XML.
 type scan struct {
-	data []byte
-	pos  int
+	data     []byte
+	pos      int
+	tagStart int // offset of the '<' of the tag last read by next
+	// In lossless mode, tagEnd is the offset after the '>' of the tag last
+	// read by next, and gap the markup skipped before it.
+	tagEnd int
+	gap    []byte
+
+	strict   bool
+	lossless bool
+	lazy     bool
+	parallel bool     // lazy, for decodeVmapParallel to decode the VASTs
+	limit    *limiter // nil without limits
+	err      error    // first problem found in strict mode
+	warnings []error  // problems skipped over in lenient mode
+}
+
+// maxWarnings caps the warnings kept by a lenient decode. Locating each
+// one walks the input, so an unbounded number would make a document full
+// of bad values quadratic to decode.
+const maxWarnings = 100
+
+// reportAt records a problem with the document at input offset off as a
+// *DecodeError. In strict mode the first problem becomes the decode error
+// and scanning stops; otherwise it is kept as a warning and decoding
+// carries on.
+func (s *scan) reportAt(off int, err error) {
+	if s.err != nil || len(s.warnings) >= maxWarnings {
+		return
+	}
+	derr := newDecodeError(s.data, off, err)
+	if s.strict {
+		s.err = derr
+		s.pos = len(s.data)
+		return
+	}
+	s.warnings = append(s.warnings, derr)
+}
+
+// offsetOf returns the input offset of b, which must be a subslice of the
+// input. Values returned by attr and text are.
+func (s *scan) offsetOf(b []byte) int {
+	return cap(s.data) - cap(b)
+}
+
+// fail stops the scan on err, found at offset off, in any mode.
+func (s *scan) fail(off int, err error) {
+	if s.err == nil {
+		s.err = newDecodeError(s.data, off, err)
+	}
+	s.pos = len(s.data)
+}
+
+// unterminated reports an element, whose start tag was read at offset
+// start, whose end tag was never found.
+func (s *scan) unterminated(name string, start int) {
+	s.reportAt(start, fmt.Errorf("unterminated %s element", name))
+}
+
+// str decodes an attribute value or text node, reporting malformed entities.
+func (s *scan) str(b []byte) string {
+	str, err := decodeXMLStr(b)
+	if err != nil {
+		s.reportAt(s.offsetOf(b), err)
+	}
+	return str
+}
+
+// atoi parses an integer attribute value, reporting malformed numbers.
+func (s *scan) atoi(attr string, b []byte) int {
+	n, err := strconv.Atoi(byteStr(b))
+	if err != nil {
+		s.reportAt(s.offsetOf(b), fmt.Errorf("invalid %s attribute: %w", attr, err))
+	}
+	return n
 }
 
 // next finds the next XML tag. Returns the tag name as a slice of the
@@ -41,12 +160,15 @@ type scan struct {
 // After return, pos is right after the tag name (before attrs and '>').
 // For end tags, pos is advanced past '>'.
 func (s *scan) next() (name []byte, isEnd, selfClose bool) {
+	from := max(s.pos, s.tagEnd)
+	s.gap = nil
 	for {
 		i := bytes.IndexByte(s.data[s.pos:], '<')
 		if i < 0 {
 			s.pos = len(s.data)
 			return nil, false, false
 		}
+		s.tagStart = s.pos + i
 		s.pos += i + 1
 		if s.pos >= len(s.data) {
 			return nil, false, false
@@ -54,12 +176,19 @@ func (s *scan) next() (name []byte, isEnd, selfClose bool) {
 
 		c := s.data[s.pos]
 		if c == '?' || c == '!' {
-			j := bytes.IndexByte(s.data[s.pos:], '>')
+			// Comments and CDATA sections may contain '>'.
+			end := ">"
+			if bytes.HasPrefix(s.data[s.pos:], []byte("![CDATA[")) {
+				end = "]]>"
+			} else if bytes.HasPrefix(s.data[s.pos:], []byte("!--")) {
+				end = "-->"
+			}
+			j := bytes.Index(s.data[s.pos:], []byte(end))
 			if j < 0 {
 				s.pos = len(s.data)
 				return nil, false, false
 			}
-			s.pos += j + 1
+			s.pos += j + len(end)
 			continue
 		}
 
@@ -82,19 +211,30 @@ func (s *scan) next() (name []byte, isEnd, selfClose bool) {
 			name = name[colon+1:]
 		}
 
+		j := bytes.IndexByte(s.data[s.pos:], '>')
 		if isEnd {
-			j := bytes.IndexByte(s.data[s.pos:], '>')
 			if j >= 0 {
 				s.pos += j + 1
 			}
-			return name, true, false
-		}
-
-		j := bytes.IndexByte(s.data[s.pos:], '>')
-		if j >= 0 && j > 0 && s.data[s.pos+j-1] == '/' {
+		} else if j > 0 && s.data[s.pos+j-1] == '/' {
 			selfClose = true
 		}
-		return name, false, selfClose
+		if s.lossless {
+			if from < s.tagStart {
+				s.gap = s.data[from:s.tagStart]
+			}
+			s.tagEnd = s.pos
+			if !isEnd && j >= 0 {
+				s.tagEnd += j + 1
+			}
+		}
+		if s.limit != nil {
+			if err := s.limit.tag(name, isEnd, selfClose); err != nil {
+				s.fail(s.tagStart, err)
+				return nil, false, false
+			}
+		}
+		return name, isEnd, selfClose
 	}
 }
 
@@ -109,34 +249,74 @@ func (s *scan) attr(name string) []byte {
 	end := s.pos + gt
 	region := s.data[s.pos:end]
 
-	// Try ' name="' (no namespace prefix)
+	// Try ' name=' (no namespace prefix), then ':name=' (namespace-prefixed,
+	// e.g. xmlns:vmap="..."), with the value in either kind of quotes.
 	var buf [64]byte
 	buf[0] = ' '
 	n := 1 + copy(buf[1:], name)
 	buf[n] = '='
-	buf[n+1] = '"'
-
-	i := bytes.Index(region, buf[:n+2])
-	if i >= 0 {
+	for _, sep := range []byte{' ', ':'} {
+		buf[0] = sep
+		i := indexAttr(region, buf[:n+1])
+		if i < 0 || i+n+1 >= len(region) {
+			continue
+		}
 		valStart := i + n + 2
-		valEnd := bytes.IndexByte(region[valStart:], '"')
+		quote := region[valStart-1]
+		if quote != '"' && quote != '\'' {
+			continue
+		}
+		valEnd := bytes.IndexByte(region[valStart:], quote)
 		if valEnd >= 0 {
-			return s.data[s.pos+valStart : s.pos+valStart+valEnd]
+			return s.checkAttr(s.data[s.pos+valStart : s.pos+valStart+valEnd])
 		}
 	}
 
-	// Try ':name="' (namespace-prefixed, e.g. xmlns:vmap="...")
-	buf[0] = ':'
-	i = bytes.Index(region, buf[:n+2])
-	if i >= 0 {
-		valStart := i + n + 2
-		valEnd := bytes.IndexByte(region[valStart:], '"')
-		if valEnd >= 0 {
-			return s.data[s.pos+valStart : s.pos+valStart+valEnd]
+	return nil
+}
+
+// indexAttr returns the index of sep, a separator and attribute name and
+// '=', in region, the attributes of a tag, outside of attribute values.
+func indexAttr(region, sep []byte) int {
+	from := 0
+	for {
+		i := bytes.Index(region[from:], sep)
+		if i < 0 {
+			return -1
 		}
+		i += from
+		if !inValue(region[:i]) {
+			return i
+		}
+		from = i + 1
 	}
+}
 
-	return nil
+// inValue reports whether attributes ends within an attribute value.
+func inValue(attrs []byte) bool {
+	var quote byte
+	for _, c := range attrs {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		}
+	}
+	return quote != 0
+}
+
+// checkAttr returns the attribute value v, or nil if it exceeds the limits.
+func (s *scan) checkAttr(v []byte) []byte {
+	if s.limit != nil {
+		if err := s.limit.attr(v); err != nil {
+			s.fail(s.offsetOf(v), err)
+			return nil
+		}
+	}
+	return v
 }
 
 // endAttrs advances past the '>' of the current start tag.
@@ -166,10 +346,18 @@ func (s *scan) text() (content []byte, wasCDATA bool) {
 		start := p + len(cdataOpen)
 		end := bytes.Index(s.data[start:], []byte(cdataClose))
 		if end < 0 {
+			s.reportAt(p, errors.New("unterminated CDATA section"))
 			return nil, false
 		}
 		s.pos = start + end + len(cdataClose)
-		return s.data[start : start+end], true
+		content = s.data[start : start+end]
+		if s.limit != nil {
+			if err := s.limit.text(content); err != nil {
+				s.fail(start, err)
+				return nil, false
+			}
+		}
+		return content, true
 	}
 
 	i := bytes.IndexByte(s.data[s.pos:], '<')
@@ -181,6 +369,12 @@ func (s *scan) text() (content []byte, wasCDATA bool) {
 	if len(content) == 0 {
 		return nil, false
 	}
+	if s.limit != nil {
+		if err := s.limit.text(content); err != nil {
+			s.fail(s.offsetOf(content), err)
+			return nil, false
+		}
+	}
 	return content, false
 }
 
@@ -193,55 +387,162 @@ func (s *scan) textStr() string {
 	if wasCDATA {
 		return byteStr(content)
 	}
-	return decodeXMLStr(content)
+	return s.str(content)
 }
 
 // --- Top-level decoders ---
 
 // DecodeVmapScan decodes a VMAP document using direct byte scanning.
 // String fields in the returned struct may reference the input slice;
-// the input must not be modified while the result is in use.
+// the input must not be modified while the result is in use, unless it is
+// decoded with DecodeOptions.CopyStrings or the result is cloned.
+//
+// Malformed values are skipped over; use DecodeVmapScanWithOptions to
+// inspect them or to fail on them.
 func DecodeVmapScan(input []byte) (VMAP, error) {
-	var vmap VMAP
-	s := scan{data: input}
+	vmap, _, err := DecodeVmapScanWithOptions(input, DecodeOptions{})
+	return vmap, err
+}
+
+// DecodeVmapScanWithOptions is like DecodeVmapScan but lets the caller choose
+// strict decoding. In lenient mode the problems that were skipped over are
+// returned as warnings; in strict mode the first one is returned as err.
+func DecodeVmapScanWithOptions(input []byte, opts DecodeOptions) (vmap VMAP, warnings []error, err error) {
+	if opts.Lazy && opts.CopyStrings {
+		// The breaks keep referencing the input until decoded.
+		input = bytes.Clone(input)
+		opts.CopyStrings = false
+	}
+	if opts.Workers > 1 && !opts.Lazy {
+		warnings, err = decodeVmapParallel(&vmap, input, opts)
+	} else {
+		warnings, err = decodeVmapScan(&vmap, input, opts)
+	}
+	if opts.CopyStrings {
+		copyStrings(vmap.eachString)
+	}
+	return vmap, warnings, err
+}
+
+// DecodeVmapScanInto is like DecodeVmapScan but decodes into dst, which is
+// reset first. The slices and structs dst holds from an earlier decode are
+// reused, so that once dst has grown to the size of the documents decoding
+// allocates only for values with character references, which are unescaped
+// into new strings. Values from the earlier decode must not be in use any
+// more. Slices that DecodeVmapScan leaves nil may be left empty instead.
+func DecodeVmapScanInto(dst *VMAP, input []byte) error {
+	dst.Reset()
+	_, err := decodeVmapScan(dst, input, DecodeOptions{})
+	return err
+}
+
+func decodeVmapScan(vmap *VMAP, input []byte, opts DecodeOptions) (warnings []error, err error) {
+	if err := opts.Limits.checkBytes(input); err != nil {
+		return nil, err
+	}
+	s := scan{data: input, strict: opts.Strict, lossless: opts.Lossless, lazy: opts.Lazy || opts.Workers > 1}
+	s.parallel = s.lazy && !opts.Lazy
+	s.limit = newLimiter(&opts.Limits)
 	found := false
+	closed := false
+	vmapStart := 0
+	prolog, epilog := 0, len(input) // of a lossless decode
+	var t *tree
 
 	for {
-		name, isEnd, _ := s.next()
+		name, isEnd, selfClose := s.next()
 		if name == nil {
 			break
 		}
 		if isEnd {
+			if !closed {
+				t.end(name)
+			}
+			if string(name) == "VMAP" && !closed {
+				closed = true
+				epilog = s.pos
+			}
 			continue
 		}
 
 		switch string(name) {
 		case "VMAP":
 			found = true
+			closed = selfClose
+			vmapStart = s.pos
 			if v := s.attr("version"); v != nil {
-				vmap.Version = byteStr(v)
+				vmap.Version = s.str(v)
 			}
 			if v := s.attr("vmap"); v != nil {
-				vmap.Vmap = byteStr(v)
-				vmap.XMLName.Space = byteStr(v)
+				vmap.Vmap = s.str(v)
+				vmap.XMLName.Space = vmap.Vmap
 			}
 			vmap.XMLName.Local = "VMAP"
+			if !selfClose {
+				t = s.newTree("version", "vmap")
+				prolog = s.tagStart
+			}
 			s.endAttrs()
 		case "AdBreak":
-			vmap.AdBreaks = append(vmap.AdBreaks, scanAdBreak(&s))
+			t.child()
+			scanAdBreak(&s, extend(&vmap.AdBreaks), selfClose)
+		default:
+			if !closed {
+				t.unknown(name, selfClose)
+			}
 		}
 	}
+	vmap.Extra = t.extra()
+	if t != nil {
+		vmap.Extra.Prolog, vmap.Extra.Epilog = byteStr(input[:prolog]), byteStr(input[epilog:])
+	}
+	if found && !closed {
+		s.unterminated("VMAP", vmapStart)
+	}
 
+	if s.err != nil {
+		return nil, s.err
+	}
 	if !found {
-		return vmap, errors.New("no VMAP token found in document")
+		return s.warnings, ErrNoVMAP
 	}
-	return vmap, nil
+	return s.warnings, nil
 }
 
-// DecodeVastScan decodes a VAST document using direct byte scanning.
+// DecodeVastScan decodes a VAST document using direct byte scanning. As
+// with DecodeVmapScan, string fields may reference the input slice.
+//
+// Malformed values are skipped over; use DecodeVastScanWithOptions to
+// inspect them or to fail on them.
 func DecodeVastScan(input []byte) (VAST, error) {
-	var vast VAST
-	s := scan{data: input}
+	vast, _, err := DecodeVastScanWithOptions(input, DecodeOptions{})
+	return vast, err
+}
+
+// DecodeVastScanWithOptions is like DecodeVastScan but lets the caller choose
+// strict decoding. In lenient mode the problems that were skipped over are
+// returned as warnings; in strict mode the first one is returned as err.
+func DecodeVastScanWithOptions(input []byte, opts DecodeOptions) (vast VAST, warnings []error, err error) {
+	warnings, err = decodeVastScan(&vast, input, opts)
+	if opts.CopyStrings {
+		copyStrings(vast.eachString)
+	}
+	return vast, warnings, err
+}
+
+// DecodeVastScanInto is like DecodeVastScan but decodes into dst, reusing
+// what it holds from an earlier decode as DecodeVmapScanInto does.
+func DecodeVastScanInto(dst *VAST, input []byte) error {
+	dst.Reset()
+	_, err := decodeVastScan(dst, input, DecodeOptions{})
+	return err
+}
+
+func decodeVastScan(vast *VAST, input []byte, opts DecodeOptions) (warnings []error, err error) {
+	if err := opts.Limits.checkBytes(input); err != nil {
+		return nil, err
+	}
+	s := scan{data: input, strict: opts.Strict, lossless: opts.Lossless, limit: newLimiter(&opts.Limits)}
 	found := false
 
 	for {
@@ -254,183 +555,243 @@ func DecodeVastScan(input []byte) (VAST, error) {
 		}
 		if string(name) == "VAST" {
 			found = true
-			if selfClose {
-				break
+			vast.Reset() // the last VAST element wins
+			prolog := s.tagStart
+			s.gap = nil
+			scanVast(&s, vast, selfClose)
+			if vast.Extra != nil {
+				vast.Extra.Prolog, vast.Extra.Epilog = byteStr(input[:prolog]), byteStr(input[s.pos:])
 			}
-			vast = scanVast(&s)
 		}
 	}
 
+	if s.err != nil {
+		return nil, s.err
+	}
 	if !found {
-		return vast, errors.New("no VAST token found in document")
+		return s.warnings, ErrNoVAST
 	}
-	return vast, nil
+	return s.warnings, nil
 }
 
 // --- Per-element scanners ---
 
-func scanAdBreak(s *scan) AdBreak {
-	var ab AdBreak
-	ab.AdSource = &AdSource{VASTData: &VASTData{}}
+// The scanners below decode into a struct in its reset state (see reset.go),
+// taking the optional structs it points to as spares, to be used again if
+// the element is found. They are called with the start tag of the element
+// just read, and closed if that tag was self-closing.
 
-	if v := s.attr("breakId"); v != nil {
-		ab.Id = byteStr(v)
+func scanAdBreak(s *scan, ab *AdBreak, closed bool) {
+	start := s.pos
+	if ab.AdSource == nil {
+		ab.AdSource = &AdSource{}
 	}
-	if v := s.attr("breakType"); v != nil {
-		ab.BreakType = byteStr(v)
-	}
-	if v := s.attr("timeOffset"); v != nil {
-		_ = ab.TimeOffset.UnmarshalText(v)
+	if ab.AdSource.VASTData == nil {
+		ab.AdSource.VASTData = &VASTData{}
 	}
+	spareVast := ab.AdSource.VASTData.VAST
+	ab.AdSource.VASTData.VAST = nil
+	scanAdBreakAttrs(s, ab)
+	t := s.newTree("breakId", "breakType", "timeOffset")
 	s.endAttrs()
 
-	for {
+	for !closed {
 		name, isEnd, selfClose := s.next()
 		if name == nil {
+			s.unterminated("AdBreak", start)
 			break
 		}
 		if isEnd {
+			t.end(name)
 			if string(name) == "AdBreak" {
 				break
 			}
 			continue
 		}
 		switch string(name) {
+		case "AdSource":
+			t.open("AdSource", &ab.AdSource.Extra, selfClose)
+		case "VASTAdData":
+			t.open("VASTAdData", &ab.AdSource.VASTData.Extra, selfClose)
 		case "VAST":
-			if selfClose {
-				ab.AdSource.VASTData.VAST = &VAST{}
-				continue
+			t.child()
+			if s.lazy {
+				start, warnAt := s.tagStart, len(s.warnings)
+				s.skipElement(name, selfClose)
+				if s.parallel && !isLimitError(s.err) {
+					// Problems within the VAST are reported by its decode.
+					s.warnings, s.err = s.warnings[:warnAt], nil
+				}
+				ab.lazy = &lazyVast{
+					data: s.data[:s.pos], start: start, warnAt: warnAt,
+					strict: s.strict, lossless: s.lossless,
+				}
+				if s.limit != nil {
+					// The tags of the VAST were accounted for as they were skipped.
+					ab.lazy.limits = s.limit.limits.lengths()
+				}
+				break
 			}
-			vast := scanVast(s)
-			ab.AdSource.VASTData.VAST = &vast
+			vast := take(&spareVast)
+			scanVast(s, vast, selfClose)
+			ab.AdSource.VASTData.VAST = vast
+		case "TrackingEvents":
+			t.open("TrackingEvents", nil, selfClose)
 		case "Tracking":
 			if ab.TrackingEvents == nil {
 				ab.TrackingEvents = []TrackingEvent{}
 			}
-			var t TrackingEvent
-			if v := s.attr("event"); v != nil {
-				t.Event = byteStr(v)
-			}
-			s.endAttrs()
-			t.Text = s.textStr()
-			ab.TrackingEvents = append(ab.TrackingEvents, t)
+			ab.TrackingEvents = append(ab.TrackingEvents, scanTracking(s, t))
+		default:
+			t.unknown(name, selfClose)
 		}
 	}
-	return ab
+	ab.Extra = t.extra()
 }
 
-func scanVast(s *scan) VAST {
-	var vast VAST
+func scanVast(s *scan, vast *VAST, closed bool) {
+	start := s.pos
+	if v := s.attr("xsi"); v != nil {
+		vast.Xsi = s.str(v)
+	}
+	if v := s.attr("noNamespaceSchemaLocation"); v != nil {
+		vast.NoNamespaceSchemaLocation = s.str(v)
+	}
 	if v := s.attr("version"); v != nil {
-		vast.Version = byteStr(v)
+		vast.Version = s.str(v)
 	}
+	t := s.newTree("xsi", "noNamespaceSchemaLocation", "version")
 	s.endAttrs()
 
-	for {
-		name, isEnd, _ := s.next()
+	for !closed {
+		name, isEnd, selfClose := s.next()
 		if name == nil {
+			s.unterminated("VAST", start)
 			break
 		}
 		if isEnd {
+			t.end(name)
 			if string(name) == "VAST" {
 				break
 			}
 			continue
 		}
 		if string(name) == "Ad" {
-			vast.Ad = append(vast.Ad, scanAd(s))
+			t.child()
+			scanAd(s, extend(&vast.Ad), selfClose)
+			continue
 		}
+		t.unknown(name, selfClose)
 	}
-	return vast
+	vast.Extra = t.extra()
 }
 
-func scanAd(s *scan) Ad {
-	var ad Ad
-	if v := s.attr("id"); v != nil {
-		ad.Id = byteStr(v)
-	}
-	if v := s.attr("sequence"); v != nil {
-		ad.Sequence, _ = strconv.Atoi(byteStr(v))
-	}
+func scanAd(s *scan, ad *Ad, closed bool) {
+	start := s.pos
+	spareInLine := ad.InLine
+	ad.InLine = nil
+	scanAdAttrs(s, ad)
+	t := s.newTree("id", "sequence")
 	s.endAttrs()
 
-	for {
-		name, isEnd, _ := s.next()
+	for !closed {
+		name, isEnd, selfClose := s.next()
 		if name == nil {
+			s.unterminated("Ad", start)
 			break
 		}
 		if isEnd {
+			t.end(name)
 			if string(name) == "Ad" {
 				break
 			}
 			continue
 		}
 		if string(name) == "InLine" {
-			inline := scanInLine(s)
-			ad.InLine = &inline
+			t.child()
+			ad.InLine = take(&spareInLine)
+			scanInLine(s, ad.InLine, selfClose)
+			continue
 		}
+		t.unknown(name, selfClose)
 	}
-	return ad
+	ad.Extra = t.extra()
 }
 
-func scanInLine(s *scan) InLine {
-	var inline InLine
+func scanInLine(s *scan, inline *InLine, closed bool) {
+	start := s.pos
+	spareError := inline.Error
+	inline.Error = nil
+	t := s.newTree()
 	s.endAttrs()
 
-	for {
-		name, isEnd, _ := s.next()
+	for !closed {
+		name, isEnd, selfClose := s.next()
 		if name == nil {
+			s.unterminated("InLine", start)
 			break
 		}
 		if isEnd {
+			t.end(name)
 			if string(name) == "InLine" {
 				break
 			}
 			continue
 		}
 		switch string(name) {
+		case "Creatives":
+			t.open("Creatives", nil, selfClose)
 		case "Creative":
-			inline.Creatives = append(inline.Creatives, scanCreative(s))
+			t.child()
+			scanCreative(s, extend(&inline.Creatives), selfClose)
 		case "Impression":
-			var imp Impression
-			if v := s.attr("id"); v != nil {
-				imp.Id = byteStr(v)
-			}
-			s.endAttrs()
-			imp.Text = s.textStr()
-			inline.Impression = append(inline.Impression, imp)
+			inline.Impression = append(inline.Impression, scanImpression(s, t))
 		case "AdSystem":
+			t.text("AdSystem")
 			s.endAttrs()
 			inline.AdSystem = s.textStr()
 		case "AdTitle":
+			t.text("AdTitle")
 			s.endAttrs()
 			inline.AdTitle = s.textStr()
+		case "Extensions":
+			t.open("Extensions", nil, selfClose)
 		case "Extension":
-			inline.Extensions = append(inline.Extensions, scanExtension(s))
+			t.child()
+			scanExtension(s, extend(&inline.Extensions), selfClose)
 		case "Error":
+			e := take(&spareError)
+			e.Extra = t.leaf()
 			s.endAttrs()
-			inline.Error = &Error{Value: s.textStr()}
+			e.Value = s.textStr()
+			inline.Error = e
+		default:
+			t.unknown(name, selfClose)
 		}
 	}
-	return inline
+	inline.Extra = t.extra()
 }
 
-func scanCreative(s *scan) Creative {
-	var c Creative
-	if v := s.attr("id"); v != nil {
-		c.Id = byteStr(v)
-	}
-	if v := s.attr("adId"); v != nil {
-		c.AdId = byteStr(v)
+func scanCreative(s *scan, c *Creative, closed bool) {
+	start := s.pos
+	spareUaid, spareLinear := c.UniversalAdId, c.Linear
+	c.UniversalAdId, c.Linear = nil, nil
+	var spareClick *ClickThrough
+	if spareLinear != nil {
+		spareClick, spareLinear.ClickThrough = spareLinear.ClickThrough, nil
 	}
+	scanCreativeAttrs(s, c)
+	t := s.newTree("id", "adId")
 	s.endAttrs()
 
-	for {
-		name, isEnd, _ := s.next()
+	for !closed {
+		name, isEnd, selfClose := s.next()
 		if name == nil {
+			s.unterminated("Creative", start)
 			break
 		}
 		if isEnd {
+			t.end(name)
 			if string(name) == "Creative" {
 				break
 			}
@@ -438,124 +799,220 @@ func scanCreative(s *scan) Creative {
 		}
 		switch string(name) {
 		case "UniversalAdId":
-			var uaid UniversalAdId
+			uaid := take(&spareUaid)
 			if v := s.attr("idRegistry"); v != nil {
-				uaid.IdRegistry = byteStr(v)
+				uaid.IdRegistry = s.str(v)
 			}
+			uaid.Extra = t.leaf("idRegistry")
 			s.endAttrs()
 			uaid.Id = s.textStr()
-			c.UniversalAdId = &uaid
+			c.UniversalAdId = uaid
+		case "Linear":
+			if c.Linear == nil {
+				c.Linear = take(&spareLinear)
+			}
+			t.open("Linear", &c.Linear.Extra, selfClose)
+		case "TrackingEvents":
+			t.open("TrackingEvents", nil, selfClose)
+		case "MediaFiles":
+			t.open("MediaFiles", nil, selfClose)
+		case "VideoClicks":
+			t.open("VideoClicks", nil, selfClose)
 		case "Tracking":
 			if c.Linear == nil {
-				c.Linear = &Linear{}
+				c.Linear = take(&spareLinear)
 			}
-			var t TrackingEvent
-			if v := s.attr("event"); v != nil {
-				t.Event = byteStr(v)
-			}
-			s.endAttrs()
-			t.Text = s.textStr()
-			c.Linear.TrackingEvents = append(c.Linear.TrackingEvents, t)
+			c.Linear.TrackingEvents = append(c.Linear.TrackingEvents, scanTracking(s, t))
 		case "ClickThrough":
 			if c.Linear == nil {
-				c.Linear = &Linear{}
-			}
-			c.Linear.ClickThrough = &ClickThrough{}
-			if v := s.attr("id"); v != nil {
-				c.Linear.ClickThrough.Id = byteStr(v)
+				c.Linear = take(&spareLinear)
 			}
-			s.endAttrs()
-			c.Linear.ClickThrough.Text = s.textStr()
+			ct := take(&spareClick)
+			*ct = ClickThrough(scanClick(s, t))
+			c.Linear.ClickThrough = ct
 		case "ClickTracking":
 			if c.Linear == nil {
-				c.Linear = &Linear{}
+				c.Linear = take(&spareLinear)
 			}
-			var ct ClickTracking
-			if v := s.attr("id"); v != nil {
-				ct.Id = byteStr(v)
+			c.Linear.ClickTracking = append(c.Linear.ClickTracking, scanClick(s, t))
+		case "CustomClick":
+			if c.Linear == nil {
+				c.Linear = take(&spareLinear)
 			}
-			s.endAttrs()
-			ct.Text = s.textStr()
-			c.Linear.ClickTracking = append(c.Linear.ClickTracking, ct)
+			c.Linear.CustomClick = append(c.Linear.CustomClick, CustomClick(scanClick(s, t)))
 		case "Duration":
 			if c.Linear == nil {
-				c.Linear = &Linear{}
+				c.Linear = take(&spareLinear)
 			}
+			t.text("Duration")
 			s.endAttrs()
 			content, wasCDATA := s.text()
+			off := s.offsetOf(content)
+			if !wasCDATA && bytes.IndexByte(content, '&') >= 0 {
+				cp := make([]byte, len(content))
+				copy(cp, content)
+				dec, err := unescapeXML(cp)
+				if err != nil {
+					s.reportAt(off, err)
+					break
+				}
+				content = dec
+			}
 			if content != nil {
-				if wasCDATA || bytes.IndexByte(content, '&') < 0 {
-					_ = c.Linear.Duration.UnmarshalText(content)
-				} else {
-					cp := make([]byte, len(content))
-					copy(cp, content)
-					_ = c.Linear.Duration.UnmarshalText(xmlStringToString(cp))
+				if err := c.Linear.Duration.UnmarshalText(content); err != nil {
+					s.reportAt(off, err)
 				}
 			}
 		case "MediaFile":
 			if c.Linear == nil {
-				c.Linear = &Linear{}
-			}
-			var m MediaFile
-			if v := s.attr("bitrate"); v != nil {
-				m.Bitrate, _ = strconv.Atoi(byteStr(v))
+				c.Linear = take(&spareLinear)
 			}
-			if v := s.attr("height"); v != nil {
-				m.Height, _ = strconv.Atoi(byteStr(v))
-			}
-			if v := s.attr("width"); v != nil {
-				m.Width, _ = strconv.Atoi(byteStr(v))
-			}
-			if v := s.attr("delivery"); v != nil {
-				m.Delivery = byteStr(v)
-			}
-			if v := s.attr("type"); v != nil {
-				m.MediaType = byteStr(v)
-			}
-			if v := s.attr("codec"); v != nil {
-				m.Codec = byteStr(v)
-			}
-			s.endAttrs()
-			m.Text = s.textStr()
-			c.Linear.MediaFiles = append(c.Linear.MediaFiles, m)
+			c.Linear.MediaFiles = append(c.Linear.MediaFiles, scanMediaFile(s, t))
+		default:
+			t.unknown(name, selfClose)
 		}
 	}
-	return c
+	c.Extra = t.extra()
 }
 
-func scanExtension(s *scan) Extension {
-	var ext Extension
+func scanExtension(s *scan, ext *Extension, closed bool) {
+	start := s.pos
 	if v := s.attr("type"); v != nil {
-		ext.ExtensionType = byteStr(v)
+		ext.ExtensionType = s.str(v)
 	}
+	t := s.newTree("type")
 	s.endAttrs()
 
-	for {
-		name, isEnd, _ := s.next()
+	for !closed {
+		name, isEnd, selfClose := s.next()
 		if name == nil {
+			s.unterminated("Extension", start)
 			break
 		}
 		if isEnd {
+			t.end(name)
 			if string(name) == "Extension" {
 				break
 			}
 			continue
 		}
-		if string(name) == "CreativeParameter" {
+		switch string(name) {
+		case "CreativeParameters":
+			t.open("CreativeParameters", nil, selfClose)
+		case "CreativeParameter":
 			var par CreativeParameter
 			if v := s.attr("creativeId"); v != nil {
-				par.CreativeId = byteStr(v)
+				par.CreativeId = s.str(v)
 			}
 			if v := s.attr("name"); v != nil {
-				par.Name = byteStr(v)
+				par.Name = s.str(v)
 			}
 			if v := s.attr("type"); v != nil {
-				par.CreativeParameterType = byteStr(v)
+				par.CreativeParameterType = s.str(v)
 			}
+			par.Extra = t.leaf("creativeId", "name", "type")
 			s.endAttrs()
 			par.Value = s.textStr()
 			ext.CreativeParameters = append(ext.CreativeParameters, par)
+		default:
+			t.unknown(name, selfClose)
 		}
 	}
-	return ext
+	ext.Extra = t.extra()
+}
+
+// The scanners below decode a single element whose start tag was just read,
+// for the decoders above and for ScanVmap and ScanVast.
+
+func scanAdBreakAttrs(s *scan, ab *AdBreak) {
+	if v := s.attr("breakId"); v != nil {
+		ab.Id = s.str(v)
+	}
+	if v := s.attr("breakType"); v != nil {
+		ab.BreakType = s.str(v)
+	}
+	if v := s.attr("timeOffset"); v != nil {
+		if err := ab.TimeOffset.UnmarshalText(v); err != nil {
+			s.reportAt(s.offsetOf(v), err)
+		}
+	}
+}
+
+func scanAdAttrs(s *scan, ad *Ad) {
+	if v := s.attr("id"); v != nil {
+		ad.Id = s.str(v)
+	}
+	if v := s.attr("sequence"); v != nil {
+		ad.Sequence = s.atoi("sequence", v)
+	}
+}
+
+func scanCreativeAttrs(s *scan, c *Creative) {
+	if v := s.attr("id"); v != nil {
+		c.Id = s.str(v)
+	}
+	if v := s.attr("adId"); v != nil {
+		c.AdId = s.str(v)
+	}
+}
+
+func scanTracking(s *scan, t *tree) TrackingEvent {
+	var te TrackingEvent
+	if v := s.attr("event"); v != nil {
+		te.Event = s.str(v)
+	}
+	te.Extra = t.leaf("event")
+	s.endAttrs()
+	te.Text = s.textStr()
+	return te
+}
+
+func scanImpression(s *scan, t *tree) Impression {
+	var imp Impression
+	if v := s.attr("id"); v != nil {
+		imp.Id = s.str(v)
+	}
+	imp.Extra = t.leaf("id")
+	s.endAttrs()
+	imp.Text = s.textStr()
+	return imp
+}
+
+// scanClick decodes a ClickThrough, ClickTracking or CustomClick, which
+// share their fields.
+func scanClick(s *scan, t *tree) ClickTracking {
+	var ct ClickTracking
+	if v := s.attr("id"); v != nil {
+		ct.Id = s.str(v)
+	}
+	ct.Extra = t.leaf("id")
+	s.endAttrs()
+	ct.Text = s.textStr()
+	return ct
+}
+
+func scanMediaFile(s *scan, t *tree) MediaFile {
+	var m MediaFile
+	if v := s.attr("bitrate"); v != nil {
+		m.Bitrate = s.atoi("bitrate", v)
+	}
+	if v := s.attr("height"); v != nil {
+		m.Height = s.atoi("height", v)
+	}
+	if v := s.attr("width"); v != nil {
+		m.Width = s.atoi("width", v)
+	}
+	if v := s.attr("delivery"); v != nil {
+		m.Delivery = s.str(v)
+	}
+	if v := s.attr("type"); v != nil {
+		m.MediaType = s.str(v)
+	}
+	if v := s.attr("codec"); v != nil {
+		m.Codec = s.str(v)
+	}
+	m.Extra = t.leaf("bitrate", "height", "width", "delivery", "type", "codec")
+	s.endAttrs()
+	m.Text = s.textStr()
+	return m
 }
@@ -0,0 +1,131 @@
+package vmap
+
+import (
+	"io"
+	"strconv"
+
+	"github.com/CarlLindqvist/xmltokenizer"
+)
+
+// VmapDecoder reads the AdBreaks of a VMAP document from a stream, one at a
+// time, so that a document with many breaks need not be held in memory
+// whole. Only the current AdBreak and the tokenizer's buffer are kept.
+// Breaks decode as with DecodeVmap.
+type VmapDecoder struct {
+	r      *tokenReader
+	header VMAP
+	found  bool
+	breaks int // AdBreaks read so far
+	err    error
+}
+
+// NewVmapDecoder returns a decoder reading a VMAP document from r.
+func NewVmapDecoder(r io.Reader) *VmapDecoder {
+	tok := xmltokenizer.New(r, xmltokenizer.WithAttrBufferSize(5))
+	return &VmapDecoder{r: &tokenReader{tok: tok}}
+}
+
+// VMAP returns the VMAP element without its AdBreaks. Its attributes are
+// set once Next has returned the first AdBreak or io.EOF.
+func (d *VmapDecoder) VMAP() VMAP {
+	return d.header
+}
+
+// Next returns the next AdBreak of the document. At the end of the
+// document it returns io.EOF, or ErrNoVMAP if there was no VMAP element.
+// Errors found within the document are of type *DecodeError; as the input
+// is not kept, they carry the path of the AdBreak but no offset. Once Next
+// has returned an error it keeps returning it.
+func (d *VmapDecoder) Next() (ab AdBreak, err error) {
+	if d.err != nil {
+		return ab, d.err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			err = tokenizerPanic(p)
+		}
+		if err == nil {
+			return
+		}
+		switch err {
+		case io.EOF:
+			if !d.found {
+				err = ErrNoVMAP
+			}
+		default:
+			err = d.errorf(err)
+		}
+		d.err = err
+	}()
+	return d.next()
+}
+
+// errorf wraps err, found after d.breaks AdBreaks, in a DecodeError.
+func (d *VmapDecoder) errorf(err error) error {
+	if verr, ok := err.(*valueError); ok {
+		err = verr.err
+	}
+	derr := newDecodeError(nil, -1, err)
+	if d.found {
+		derr.Path = "VMAP"
+		if d.breaks > 0 {
+			derr.Path += "/AdBreak[" + strconv.Itoa(d.breaks) + "]"
+		}
+	}
+	return derr
+}
+
+// next returns the next AdBreak, or io.EOF at the end of the document.
+// Errors are returned as found, for the caller to position.
+func (d *VmapDecoder) next() (AdBreak, error) {
+	for {
+		token, err := d.r.Token() // Token is only valid until next r.Token() invocation (short-lived object).
+		if err != nil {
+			return AdBreak{}, err
+		}
+		switch string(token.Name.Local) {
+		case "VMAP":
+			if token.IsEndElement {
+				continue
+			}
+			d.found = true
+			if err := d.header.decodeAttrs(&token); err != nil {
+				return AdBreak{}, err
+			}
+
+		case "AdBreak":
+			if token.IsEndElement {
+				continue
+			}
+			var adBreak AdBreak
+			d.breaks++
+			// Reuse Token object in the sync.Pool since we only use it temporarily.
+			se := xmltokenizer.GetToken().Copy(token)
+			err = adBreak.decodeToken(d.r, se)
+			xmltokenizer.PutToken(se) // Put back to sync.Pool.
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return adBreak, err
+		}
+	}
+}
+
+// decodeAttrs sets the attributes of vmap from its start element.
+func (vmap *VMAP) decodeAttrs(token *xmltokenizer.Token) error {
+	if err := unescapeAttrs(token.Attrs); err != nil {
+		return err
+	}
+	for i := range token.Attrs {
+		attr := &token.Attrs[i]
+		switch string(attr.Name.Local) {
+		case "version":
+			vmap.Version = string(attr.Value)
+		case "vmap":
+			vmap.Vmap = string(attr.Value)
+			vmap.XMLName.Space = string(attr.Value)
+		}
+		vmap.XMLName.Local = "VMAP"
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package vmap
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/matryer/is"
+)
+
+// readAll decodes all the AdBreaks of d into a VMAP.
+func readAll(d *VmapDecoder) (VMAP, error) {
+	var breaks []AdBreak
+	for {
+		ab, err := d.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return VMAP{}, err
+		}
+		breaks = append(breaks, ab)
+	}
+	v := d.VMAP()
+	v.AdBreaks = breaks
+	return v, nil
+}
+
+func TestVmapDecoder(t *testing.T) {
+	for _, name := range []string{"testVmap.xml", "testVmap2.xml", "testVmapEmptyVast.xml"} {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			doc, err := os.ReadFile("sample-vmap/" + name)
+			is.NoErr(err)
+			want, err := DecodeVmap(doc)
+			is.NoErr(err)
+
+			// Reading a byte at a time makes every token span reads.
+			got, err := readAll(NewVmapDecoder(iotest.OneByteReader(bytes.NewReader(doc))))
+			is.NoErr(err)
+			is.Equal(got, want)
+		})
+	}
+}
+
+func TestVmapDecoderNoVMAP(t *testing.T) {
+	is := is.New(t)
+	d := NewVmapDecoder(strings.NewReader(`<VAST version="4.0"></VAST>`))
+	_, err := d.Next()
+	is.Equal(err, ErrNoVMAP)
+}
+
+func TestVmapDecoderTruncated(t *testing.T) {
+	is := is.New(t)
+	doc, err := os.ReadFile("sample-vmap/testVmap.xml")
+	is.NoErr(err)
+	doc = doc[:bytes.Index(doc, []byte("</vmap:AdBreak>"))]
+
+	d := NewVmapDecoder(bytes.NewReader(doc))
+	_, err = d.Next()
+	var derr *DecodeError
+	is.True(errors.As(err, &derr))
+	is.True(errors.Is(err, io.ErrUnexpectedEOF))
+	is.Equal(derr.Path, "VMAP/AdBreak[1]")
+	is.Equal(derr.Offset, int64(-1))
+	is.Equal(d.VMAP().Version, "1.0")
+
+	_, again := d.Next()
+	is.Equal(again, err) // sticky
+}
+
+func TestVmapDecoderMalformed(t *testing.T) {
+	is := is.New(t)
+	d := NewVmapDecoder(strings.NewReader(`<VMAP version="1.0"></>0`))
+	_, err := d.Next()
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), "malformed XML document"))
+}
+
+func TestVmapDecoderLarge(t *testing.T) {
+	is := is.New(t)
+	const n = 2000
+	v := bigVmap(t, n)
+
+	// The document is produced as it is read, never held whole.
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(EncodeVmap(pw, v, EncodeOptions{Namespaced: true}))
+	}()
+	d := NewVmapDecoder(pr)
+	count := 0
+	for {
+		ab, err := d.Next()
+		if err == io.EOF {
+			break
+		}
+		is.NoErr(err)
+		is.Equal(ab.Id, v.AdBreaks[0].Id)
+		count++
+	}
+	is.Equal(count, n)
+	is.Equal(d.VMAP().Version, v.Version)
+}
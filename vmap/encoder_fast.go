@@ -1,33 +1,146 @@
 package vmap
 
 import (
+	"bytes"
+	"io"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// VMAPNamespace is the namespace of the VMAP 1.0 elements.
+const VMAPNamespace = "http://www.iab.net/videosuite/vmap"
+
+// EncodeOptions controls the output of the fast encoder. The zero value
+// produces output identical to encoding/xml.Marshal.
+type EncodeOptions struct {
+	// Namespaced writes VMAP the way the VMAP 1.0 specification describes
+	// it: with an XML declaration, xmlns:vmap on the root element and the
+	// vmap: prefix on VMAP elements. The namespace is VMAP.Vmap, or
+	// VMAPNamespace when that is empty. VAST documents are not affected.
+	Namespaced bool
+	// OmitEmpty leaves out wrapper elements without children, such as
+	// Creatives and VideoClicks, and optional attributes with zero values,
+	// such as sequence="0" and adId="". Required attributes and elements
+	// are always written. VAST.Xsi and VAST.NoNamespaceSchemaLocation are
+	// written as xmlns:xsi and xsi:noNamespaceSchemaLocation, as the VAST
+	// schema expects.
+	OmitEmpty bool
+	// Prefix and Indent, when either is set, put each element on a new
+	// line as encoding/xml.MarshalIndent does: starting with Prefix and
+	// one copy of Indent per level of nesting.
+	Prefix string
+	Indent string
+	// CDATA writes the text of the elements that hold URLs, Impression,
+	// Tracking, MediaFile, ClickThrough, ClickTracking, CustomClick and
+	// Error, as CDATA sections instead of escaped text. Text containing
+	// "]]>" is still escaped.
+	CDATA bool
+}
+
+// xsiNamespace is the XML Schema instance namespace, declared on VAST
+// documents that name their schema.
+const xsiNamespace = "http://www.w3.org/2001/XMLSchema-instance"
+
 // MarshalVmap marshals a VMAP to XML, producing output identical to encoding/xml.Marshal.
 func MarshalVmap(v *VMAP) ([]byte, error) {
-	buf := make([]byte, 0, 256*1024)
-	buf = appendVMAP(buf, v)
-	return buf, nil
+	return MarshalVmapWithOptions(v, EncodeOptions{})
+}
+
+// MarshalVmapWithOptions marshals a VMAP to XML as controlled by opts.
+func MarshalVmapWithOptions(v *VMAP, opts EncodeOptions) ([]byte, error) {
+	bufp := encodeBufPool.Get().(*[]byte)
+	e := encoder{buf: (*bufp)[:0], opts: opts}
+	e.vmap(v)
+	return marshalled(bufp, &e)
+}
+
+// EncodeVmap writes the XML encoding of a VMAP to w as controlled by opts.
+// The document is written in chunks from a pooled buffer, so memory use
+// does not grow with the size of the document. Values that cannot be
+// written, such as negative durations, are an error, by which time part
+// of the document may have been written.
+func EncodeVmap(w io.Writer, v *VMAP, opts EncodeOptions) error {
+	return encodeTo(w, opts, func(e *encoder) { e.vmap(v) })
+}
+
+// EstimateVmapSize returns the length in bytes of the XML encoding of a VMAP
+// with the given options, for sizing the buffer given to
+// MarshalVmapAppendWithOptions. It walks the VMAP without encoding it,
+// which is not free: the Marshal functions encode into a pooled buffer
+// instead. It does not check that the VMAP can be encoded.
+func EstimateVmapSize(v *VMAP, opts EncodeOptions) int {
+	e := encoder{opts: opts, sizing: true}
+	e.vmap(v)
+	return e.size
 }
 
 // MarshalVmapAppend appends the XML encoding of a VMAP to buf and returns the extended buffer.
 // This allows callers to manage buffer lifecycle (e.g. via sync.Pool) for reduced allocations.
 func MarshalVmapAppend(buf []byte, v *VMAP) ([]byte, error) {
-	return appendVMAP(buf, v), nil
+	return MarshalVmapAppendWithOptions(buf, v, EncodeOptions{})
+}
+
+// MarshalVmapAppendWithOptions is like MarshalVmapAppend but encodes as
+// controlled by opts.
+func MarshalVmapAppendWithOptions(buf []byte, v *VMAP, opts EncodeOptions) ([]byte, error) {
+	e := encoder{buf: buf, opts: opts}
+	e.vmap(v)
+	if e.err != nil {
+		return buf, e.err
+	}
+	return e.buf, nil
 }
 
 // MarshalVast marshals a VAST to XML, producing output identical to encoding/xml.Marshal.
 func MarshalVast(v *VAST) ([]byte, error) {
-	buf := make([]byte, 0, 128*1024)
-	buf = appendVAST(buf, v)
-	return buf, nil
+	return MarshalVastWithOptions(v, EncodeOptions{})
+}
+
+// MarshalVastWithOptions marshals a VAST to XML as controlled by opts.
+func MarshalVastWithOptions(v *VAST, opts EncodeOptions) ([]byte, error) {
+	bufp := encodeBufPool.Get().(*[]byte)
+	e := encoder{buf: (*bufp)[:0], opts: opts}
+	e.vast(v)
+	return marshalled(bufp, &e)
+}
+
+// EncodeVast writes the XML encoding of a VAST to w as controlled by opts.
+// The document is written in chunks from a pooled buffer, so memory use
+// does not grow with the size of the document. Values that cannot be
+// written, such as negative durations, are an error, by which time part
+// of the document may have been written.
+func EncodeVast(w io.Writer, v *VAST, opts EncodeOptions) error {
+	return encodeTo(w, opts, func(e *encoder) { e.vast(v) })
+}
+
+// EstimateVastSize returns the length in bytes of the XML encoding of a VAST
+// with the given options, for sizing the buffer given to
+// MarshalVastAppendWithOptions. It walks the VAST without encoding it,
+// which is not free: the Marshal functions encode into a pooled buffer
+// instead. It does not check that the VAST can be encoded.
+func EstimateVastSize(v *VAST, opts EncodeOptions) int {
+	e := encoder{opts: opts, sizing: true}
+	e.vast(v)
+	return e.size
 }
 
 // MarshalVastAppend appends the XML encoding of a VAST to buf and returns the extended buffer.
 // This allows callers to manage buffer lifecycle (e.g. via sync.Pool) for reduced allocations.
 func MarshalVastAppend(buf []byte, v *VAST) ([]byte, error) {
-	return appendVAST(buf, v), nil
+	return MarshalVastAppendWithOptions(buf, v, EncodeOptions{})
+}
+
+// MarshalVastAppendWithOptions is like MarshalVastAppend but encodes as
+// controlled by opts.
+func MarshalVastAppendWithOptions(buf []byte, v *VAST, opts EncodeOptions) ([]byte, error) {
+	e := encoder{buf: buf, opts: opts}
+	e.vast(v)
+	if e.err != nil {
+		return buf, e.err
+	}
+	return e.buf, nil
 }
 
 // --- escape helpers ---
@@ -92,319 +205,848 @@ func escAttr(buf []byte, s string) []byte {
 	return append(buf, s[last:]...)
 }
 
-// --- duration / time offset helpers (allocation-free) ---
+// escExtra holds how many bytes escText and escAttr add for each byte.
+var escExtra = [256]uint8{'&': 4, '"': 4, '\t': 4, '\n': 4, '\r': 4, '<': 3, '>': 3}
 
-func append2dig(buf []byte, n int) []byte {
-	return append(buf, byte('0'+n/10), byte('0'+n%10))
+// escLen returns the length of s once escaped by escText or escAttr.
+func escLen(s string) int {
+	n := len(s)
+	for i := 0; i < len(s); i++ {
+		n += int(escExtra[s[i]])
+	}
+	return n
 }
 
-func append3dig(buf []byte, n int) []byte {
-	return append(buf, byte('0'+n/100), byte('0'+(n/10)%10), byte('0'+n%10))
+// --- duration / time offset helpers (allocation-free) ---
+
+func append2dig(buf []byte, n int64) []byte {
+	return append(buf, byte('0'+n/10), byte('0'+n%10))
 }
 
+// appendDuration appends d in the format described at Duration.MarshalText.
+// Negative durations, which only TimeOffset.String writes, get a leading
+// minus sign.
 func appendDuration(buf []byte, d Duration) []byte {
 	dur := d.Duration
-	if dur == 0 {
-		return append(buf, "00:00:00"...)
-	}
-	h := int(dur.Hours())
-	m := int(dur.Minutes()) % 60
-	s := int(dur.Seconds()) % 60
-	ms := int(dur.Milliseconds()) % 1000
-	buf = append2dig(buf, h)
+	if dur < 0 {
+		buf = append(buf, '-')
+		dur = -dur
+	}
+	h := int64(dur / time.Hour)
+	m := int64(dur/time.Minute) % 60
+	s := int64(dur/time.Second) % 60
+	ns := int64(dur % time.Second)
+	if h < 10 {
+		buf = append(buf, '0')
+	}
+	buf = strconv.AppendInt(buf, h, 10)
 	buf = append(buf, ':')
 	buf = append2dig(buf, m)
 	buf = append(buf, ':')
 	buf = append2dig(buf, s)
-	if ms > 0 {
-		buf = append(buf, '.')
-		buf = append3dig(buf, ms)
+	if ns == 0 {
+		return buf
 	}
-	return buf
+
+	var frac [9]byte
+	for i := len(frac) - 1; i >= 0; i-- {
+		frac[i] = byte('0' + ns%10)
+		ns /= 10
+	}
+	n := len(frac)
+	for n > 3 && frac[n-1] == '0' {
+		n--
+	}
+	buf = append(buf, '.')
+	return append(buf, frac[:n]...)
 }
 
+// appendTimeOffset appends to in the format described at TimeOffset.MarshalText.
 func appendTimeOffset(buf []byte, to TimeOffset) []byte {
-	if to.Duration != nil {
-		return appendDuration(buf, *to.Duration)
-	}
-	if to.Position != 0 {
+	switch to.Kind {
+	case OffsetStart:
+		return append(buf, "start"...)
+	case OffsetEnd:
+		return append(buf, "end"...)
+	case OffsetDuration:
+		return appendDuration(buf, Duration{to.Duration})
+	case OffsetPercent:
+		buf = strconv.AppendFloat(buf, to.Percent, 'f', -1, 64)
+		return append(buf, '%')
+	case OffsetPosition:
 		buf = append(buf, '#')
 		return strconv.AppendInt(buf, int64(to.Position), 10)
 	}
-	if to.Percent != 0 {
-		buf = strconv.AppendFloat(buf, float64(to.Percent*100), 'f', 6, 32)
-		return append(buf, '%')
-	}
 	return buf
 }
 
 // --- struct encoders ---
 // Field and attribute order matches encoding/xml.Marshal exactly.
 
-func appendVMAP(buf []byte, v *VMAP) []byte {
-	// XMLName tag is xml:"VMAP" (name only) — xml.Marshal does not output xmlns
-	buf = append(buf, `<VMAP vmap="`...)
-	buf = escAttr(buf, v.Vmap)
-	buf = append(buf, `" version="`...)
-	buf = escAttr(buf, v.Version)
-	buf = append(buf, '"', '>')
+// encoder appends the XML encoding of the VMAP and VAST types to buf.
+type encoder struct {
+	buf  []byte
+	opts EncodeOptions
+	// vmapPrefix is prepended to the names of VMAP elements.
+	vmapPrefix string
+
+	// w, when set, receives buf whenever it has grown past flushSize at
+	// the end of an element. err holds the first write error.
+	w   io.Writer
+	err error
+
+	// When sizing, nothing is appended to buf; size counts the bytes
+	// instead. scratch holds formatted numbers while sizing.
+	sizing  bool
+	size    int
+	scratch [40]byte
+
+	// Indentation state, as in encoding/xml's printer.
+	depth      int
+	indentedIn bool
+	putNewline bool
+
+	// Layout kept by lossless decoding (see RawTag). While the start tag of
+	// an element recorded in tagX under tagIn is written, tag is its record
+	// and its known attributes are held in attrs and attrBuf, for startDone
+	// to write in the order found. cdata is set for the text of such an
+	// element found as CDATA. segs are the children written so far of the
+	// elements whose children rest puts in the order found, and tmp the
+	// buffer it moves them with. inDoc is set once the root is started.
+	// level is the nesting of the element being written. closeAt, when
+	// closeLevel is not 0, is where the start tag of the recorded
+	// self-closing element at that level ends, for end to make it
+	// self-closing again if nothing follows it.
+	tag        *RawTag
+	tagX       *Extra
+	tagIn      string
+	attrs      []pendingAttr
+	attrBuf    []byte
+	cdata      bool
+	segs       []segment
+	tmp        []byte
+	inDoc      bool
+	level      int
+	closeAt    int
+	closeLevel int
+}
+
+// flushSize is the size of the chunks written by EncodeVmap and EncodeVast.
+const flushSize = 32 * 1024
+
+// encodeBufPool holds the buffers of the Marshal and Encode functions.
+var encodeBufPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 0, 2*flushSize)
+		return &buf
+	},
+}
+
+func (e *encoder) flush() {
+	if e.err == nil && len(e.buf) > 0 {
+		_, e.err = e.w.Write(e.buf)
+	}
+	e.buf = e.buf[:0]
+}
+
+// maxPooled is the capacity above which a grown buffer is not pooled again.
+const maxPooled = 4 * flushSize
+
+// encodeTo runs enc with an encoder writing to w through a pooled buffer.
+func encodeTo(w io.Writer, opts EncodeOptions, enc func(e *encoder)) error {
+	bufp := encodeBufPool.Get().(*[]byte)
+	e := encoder{buf: (*bufp)[:0], opts: opts, w: w}
+	enc(&e)
+	e.flush()
+	// Elements with very long text can grow the buffer; don't keep those.
+	if cap(e.buf) <= maxPooled {
+		*bufp = e.buf
+		encodeBufPool.Put(bufp)
+	}
+	return e.err
+}
+
+// marshalled returns the output that e encoded into the pooled buffer at
+// bufp, copied into a slice just large enough for it, or e's error, and
+// pools the buffer again. Output too large to pool is returned as is.
+func marshalled(bufp *[]byte, e *encoder) ([]byte, error) {
+	if cap(e.buf) > maxPooled {
+		if e.err != nil {
+			return nil, e.err
+		}
+		return e.buf, nil
+	}
+	var out []byte
+	if e.err == nil {
+		out = bytes.Clone(e.buf)
+	}
+	*bufp = e.buf
+	encodeBufPool.Put(bufp)
+	return out, e.err
+}
+
+// raw appends s as is.
+func (e *encoder) raw(s string) {
+	if e.sizing {
+		e.size += len(s)
+		return
+	}
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) indenting() bool {
+	return e.opts.Prefix != "" || e.opts.Indent != ""
+}
+
+// writeIndent starts a new indented line when indenting. depthDelta is 1
+// before a start tag and -1 before an end tag; an end tag directly after
+// its start tag stays on the same line.
+func (e *encoder) writeIndent(depthDelta int) {
+	if !e.indenting() {
+		return
+	}
+	if depthDelta < 0 {
+		e.depth--
+		if e.indentedIn {
+			e.indentedIn = false
+			return
+		}
+		e.indentedIn = false
+	}
+	if e.putNewline {
+		e.raw("\n")
+	} else {
+		e.putNewline = true
+	}
+	e.raw(e.opts.Prefix)
+	for i := 0; i < e.depth; i++ {
+		e.raw(e.opts.Indent)
+	}
+	if depthDelta > 0 {
+		e.depth++
+		e.indentedIn = true
+	}
+}
+
+// start appends the start of a tag, without the closing '>', and returns
+// the prefix to end it with. The element is written as x records it under
+// in, if it does.
+func (e *encoder) start(x *Extra, in, prefix, name string) string {
+	e.cdata = false
+	e.level++
+	if t := x.tag(in); t != nil {
+		e.tag, e.tagX, e.tagIn = t, x, in
+		e.attrs, e.attrBuf = e.attrs[:0], e.attrBuf[:0]
+		if t.Prefix != "" {
+			prefix = t.Prefix
+		}
+	}
+	e.writeIndent(1)
+	e.raw("<")
+	e.raw(prefix)
+	e.raw(name)
+	return prefix
+}
+
+// attr appends an attribute to the tag started last.
+func (e *encoder) attr(name, value string) {
+	if e.tag != nil {
+		start := len(e.attrBuf)
+		e.attrBuf = escAttr(e.attrBuf, value)
+		e.pend(name, start, value == "")
+		return
+	}
+	if e.sizing {
+		e.size += len(name) + len(` =""`) + escLen(value)
+		return
+	}
+	e.buf = append(e.buf, ' ')
+	e.buf = append(e.buf, name...)
+	e.buf = append(e.buf, '=', '"')
+	e.buf = escAttr(e.buf, value)
+	e.buf = append(e.buf, '"')
+}
+
+// optAttr appends an optional attribute, unless OmitEmpty is set and the
+// value is empty.
+func (e *encoder) optAttr(name, value string) {
+	if e.opts.OmitEmpty && value == "" && e.tag == nil {
+		return
+	}
+	e.attr(name, value)
+}
+
+func (e *encoder) intAttr(name string, value int) {
+	if e.tag != nil {
+		start := len(e.attrBuf)
+		e.attrBuf = strconv.AppendInt(e.attrBuf, int64(value), 10)
+		e.pend(name, start, value == 0)
+		return
+	}
+	e.raw(" ")
+	e.raw(name)
+	e.raw(`="`)
+	if e.sizing {
+		e.size += len(strconv.AppendInt(e.scratch[:0], int64(value), 10))
+	} else {
+		e.buf = strconv.AppendInt(e.buf, int64(value), 10)
+	}
+	e.raw(`"`)
+}
+
+func (e *encoder) optIntAttr(name string, value int) {
+	if e.opts.OmitEmpty && value == 0 && e.tag == nil {
+		return
+	}
+	e.intAttr(name, value)
+}
+
+// timeOffsetAttr appends a timeOffset attribute, unless OmitEmpty is set
+// and it is unset.
+func (e *encoder) timeOffsetAttr(to TimeOffset) {
+	if e.tag != nil {
+		e.checkOffset(to)
+		start := len(e.attrBuf)
+		e.attrBuf = appendTimeOffset(e.attrBuf, to)
+		e.pend("timeOffset", start, to.Kind == OffsetUnset)
+		return
+	}
+	if e.opts.OmitEmpty && to.Kind == OffsetUnset {
+		return
+	}
+	e.raw(` timeOffset="`)
+	e.timeOffset(to)
+	e.raw(`"`)
+}
+
+// omit reports whether a wrapper element with n children is left out. It is
+// kept for the unknown elements x holds for it.
+func (e *encoder) omit(n int, x *Extra, in string) bool {
+	return e.opts.OmitEmpty && bare(n, x, in)
+}
+
+// bare reports whether a wrapper element with n children holds nothing.
+func bare(n int, x *Extra, in string) bool {
+	return n == 0 && !x.hasNodes(in)
+}
+
+// startDone closes the tag started last.
+func (e *encoder) startDone() {
+	if t := e.tag; t != nil {
+		e.tag = nil
+		e.tagAttrs(t)
+		e.cdata = t.CDATA
+		e.raw(">")
+		if t.SelfClosing {
+			e.closeAt, e.closeLevel = e.pos(), e.level
+		}
+		return
+	}
+	e.raw(">")
+}
+
+func (e *encoder) end(prefix, name string) {
+	e.level--
+	if e.closeLevel == e.level+1 && e.closeAt == e.pos() {
+		// Nothing was written since the start tag, which closes itself.
+		e.closeLevel = 0
+		if e.indenting() {
+			e.depth--
+			e.indentedIn = false
+		}
+		if e.sizing {
+			e.size++
+		} else {
+			e.buf = append(e.buf[:len(e.buf)-1], "/>"...)
+		}
+		return
+	}
+	if e.closeLevel > e.level {
+		e.closeLevel = 0
+	}
+	e.writeIndent(-1)
+	e.raw("</")
+	e.raw(prefix)
+	e.raw(name)
+	e.raw(">")
+	if e.w != nil && len(e.buf) >= flushSize && len(e.segs) == 0 {
+		e.flush()
+	}
+}
+
+func (e *encoder) text(s string) {
+	if e.cdata {
+		e.cdata = false
+		if e.cdataText(s) {
+			return
+		}
+	}
+	if e.sizing {
+		e.size += escLen(s)
+		return
+	}
+	e.buf = escText(e.buf, s)
+}
+
+func (e *encoder) duration(d Duration) {
+	e.checkDuration(d.Duration)
+	cdata := e.cdata
+	e.cdata = false
+	if cdata {
+		e.raw("<![CDATA[")
+	}
+	if e.sizing {
+		e.size += len(appendDuration(e.scratch[:0], d))
+	} else {
+		e.buf = appendDuration(e.buf, d)
+	}
+	if cdata {
+		e.raw("]]>")
+	}
+}
+
+func (e *encoder) timeOffset(to TimeOffset) {
+	e.checkOffset(to)
+	if e.sizing {
+		e.size += len(appendTimeOffset(e.scratch[:0], to))
+		return
+	}
+	e.buf = appendTimeOffset(e.buf, to)
+}
+
+// checkDuration records the error of a duration that cannot be written.
+func (e *encoder) checkDuration(d time.Duration) {
+	if d < 0 && e.err == nil {
+		e.err = negativeDuration(d)
+	}
+}
+
+func (e *encoder) checkOffset(to TimeOffset) {
+	if to.Kind == OffsetDuration {
+		e.checkDuration(to.Duration)
+	}
+}
+
+// url appends the text of an element holding a URL, as CDATA when the
+// CDATA option is set.
+func (e *encoder) url(s string) {
+	if e.opts.CDATA {
+		e.cdata = true
+	}
+	e.text(s)
+}
+
+// cdataText appends s as a CDATA section, reporting false if it cannot be.
+func (e *encoder) cdataText(s string) bool {
+	// "]]>" cannot occur in a CDATA section. Splitting it over two sections
+	// would be valid XML, but such text is escaped as the decoders expect a
+	// single section.
+	if s == "" || strings.Contains(s, "]]>") {
+		return false
+	}
+	e.raw("<![CDATA[")
+	e.raw(s)
+	e.raw("]]>")
+	return true
+}
+
+// textElement appends an element holding text, with the unknown attributes
+// x holds for it.
+func (e *encoder) textElement(name, s string, x *Extra) {
+	p := e.start(x, name, "", name)
+	e.extraAttrs(x, name)
+	e.startDone()
+	e.text(s)
+	e.end(p, name)
+}
+
+func (e *encoder) vmap(v *VMAP) {
+	x := v.Extra
+	root := e.prolog(x, e.opts.Namespaced)
+	var p string
+	if e.opts.Namespaced {
+		e.vmapPrefix = "vmap:"
+		p = e.start(x, "", e.vmapPrefix, "VMAP")
+		ns := v.Vmap
+		if ns == "" {
+			ns = VMAPNamespace
+		}
+		e.attr("xmlns:vmap", ns)
+	} else {
+		// XMLName tag is xml:"VMAP" (name only) — xml.Marshal does not output xmlns
+		p = e.start(x, "", "", "VMAP")
+		e.optAttr("vmap", v.Vmap)
+	}
+	e.attr("version", v.Version)
+	e.extraAttrs(x, "")
+	e.startDone()
 
 	// chardata (Text field, before child elements, matching xml.Marshal field order)
-	buf = escText(buf, v.Text)
+	e.text(v.Text)
 
+	k := 0
 	for i := range v.AdBreaks {
-		buf = appendAdBreak(buf, &v.AdBreaks[i])
+		k = e.child(x, "", k, "AdBreak", false)
+		e.adBreak(&v.AdBreaks[i])
+	}
+	e.rest(x, "", k)
+	e.end(p, "VMAP")
+	if root {
+		e.epilog(x)
 	}
-	buf = append(buf, "</VMAP>"...)
-	return buf
 }
 
-func appendAdBreak(buf []byte, ab *AdBreak) []byte {
+// xmlDeclaration starts namespaced VMAP documents.
+const xmlDeclaration = `<?xml version="1.0" encoding="UTF-8"?>` + "\n"
+
+func (e *encoder) adBreak(ab *AdBreak) {
 	// attrs: breakId, breakType, timeOffset
-	buf = append(buf, `<AdBreak breakId="`...)
-	buf = escAttr(buf, ab.Id)
-	buf = append(buf, `" breakType="`...)
-	buf = escAttr(buf, ab.BreakType)
-	buf = append(buf, `" timeOffset="`...)
-	buf = appendTimeOffset(buf, ab.TimeOffset)
-	buf = append(buf, '"', '>')
+	x := ab.Extra
+	p := e.start(x, "", e.vmapPrefix, "AdBreak")
+	e.optAttr("breakId", ab.Id)
+	e.attr("breakType", ab.BreakType)
+	e.timeOffsetAttr(ab.TimeOffset)
+	e.extraAttrs(x, "")
+	e.startDone()
 
 	// child elements in field order: AdSource, TrackingEvents
-	if ab.AdSource != nil {
-		buf = appendAdSource(buf, ab.AdSource)
+	k := 0
+	ab.vast() // decodes the VAST of a lazily decoded break
+	if as := ab.AdSource; as != nil {
+		empty := as.Extra == nil && (as.VASTData == nil || as.VASTData.VAST == nil && as.VASTData.Extra == nil)
+		k = e.child(x, "", k, "AdSource", empty)
+		e.adSource(as)
 	}
-	// Wrapper always emitted for nested path xml:"TrackingEvents>Tracking"
-	buf = append(buf, "<TrackingEvents>"...)
-	for i := range ab.TrackingEvents {
-		buf = appendTracking(buf, &ab.TrackingEvents[i])
+	// Wrapper for nested path xml:"TrackingEvents>Tracking", always emitted by xml.Marshal
+	if !e.omit(len(ab.TrackingEvents), x, "TrackingEvents") {
+		k = e.child(x, "", k, "TrackingEvents", bare(len(ab.TrackingEvents), x, "TrackingEvents"))
+		wp := e.start(x, "TrackingEvents", e.vmapPrefix, "TrackingEvents")
+		e.extraAttrs(x, "TrackingEvents")
+		e.startDone()
+		j := 0
+		for i := range ab.TrackingEvents {
+			j = e.child(x, "TrackingEvents", j, "Tracking", false)
+			e.tracking(e.vmapPrefix, &ab.TrackingEvents[i])
+		}
+		e.rest(x, "TrackingEvents", j)
+		e.end(wp, "TrackingEvents")
 	}
-	buf = append(buf, "</TrackingEvents>"...)
-	buf = append(buf, "</AdBreak>"...)
-	return buf
+	e.rest(x, "", k)
+	e.end(p, "AdBreak")
 }
 
-func appendAdSource(buf []byte, as *AdSource) []byte {
-	buf = append(buf, "<AdSource>"...)
-	if as.VASTData != nil {
-		buf = append(buf, "<VASTAdData>"...)
-		if as.VASTData.VAST != nil {
-			buf = appendVAST(buf, as.VASTData.VAST)
+func (e *encoder) adSource(as *AdSource) {
+	p := e.start(as.Extra, "", e.vmapPrefix, "AdSource")
+	e.extraAttrs(as.Extra, "")
+	e.startDone()
+	k := 0
+	if vd := as.VASTData; vd != nil {
+		k = e.child(as.Extra, "", k, "VASTAdData", vd.VAST == nil && vd.Extra == nil)
+		dp := e.start(vd.Extra, "", e.vmapPrefix, "VASTAdData")
+		e.extraAttrs(vd.Extra, "")
+		e.startDone()
+		j := 0
+		if vd.VAST != nil {
+			j = e.child(vd.Extra, "", j, "VAST", false)
+			e.vast(vd.VAST)
 		}
-		buf = append(buf, "</VASTAdData>"...)
+		e.rest(vd.Extra, "", j)
+		e.end(dp, "VASTAdData")
 	}
-	buf = append(buf, "</AdSource>"...)
-	return buf
+	e.rest(as.Extra, "", k)
+	e.end(p, "AdSource")
 }
 
-func appendVAST(buf []byte, v *VAST) []byte {
+func (e *encoder) vast(v *VAST) {
 	// attrs: xsi, noNamespaceSchemaLocation, version
-	buf = append(buf, `<VAST xsi="`...)
-	buf = escAttr(buf, v.Xsi)
-	buf = append(buf, `" noNamespaceSchemaLocation="`...)
-	buf = escAttr(buf, v.NoNamespaceSchemaLocation)
-	buf = append(buf, `" version="`...)
-	buf = escAttr(buf, v.Version)
-	buf = append(buf, '"', '>')
+	x := v.Extra
+	root := e.prolog(x, false)
+	p := e.start(x, "", "", "VAST")
+	if e.opts.OmitEmpty {
+		xsi := v.Xsi
+		if xsi == "" && v.NoNamespaceSchemaLocation != "" {
+			xsi = xsiNamespace
+		}
+		e.optAttr("xmlns:xsi", xsi)
+		e.optAttr("xsi:noNamespaceSchemaLocation", v.NoNamespaceSchemaLocation)
+	} else {
+		e.attr("xsi", v.Xsi)
+		e.attr("noNamespaceSchemaLocation", v.NoNamespaceSchemaLocation)
+	}
+	e.attr("version", v.Version)
+	e.extraAttrs(x, "")
+	e.startDone()
 
 	// chardata
-	buf = escText(buf, v.Text)
+	e.text(v.Text)
 
+	k := 0
 	for i := range v.Ad {
-		buf = appendAd(buf, &v.Ad[i])
+		k = e.child(x, "", k, "Ad", false)
+		e.ad(&v.Ad[i])
+	}
+	e.rest(x, "", k)
+	e.end(p, "VAST")
+	if root {
+		e.epilog(x)
 	}
-	buf = append(buf, "</VAST>"...)
-	return buf
 }
 
-func appendAd(buf []byte, ad *Ad) []byte {
-	buf = append(buf, `<Ad id="`...)
-	buf = escAttr(buf, ad.Id)
-	buf = append(buf, `" sequence="`...)
-	buf = strconv.AppendInt(buf, int64(ad.Sequence), 10)
-	buf = append(buf, '"', '>')
+func (e *encoder) ad(ad *Ad) {
+	p := e.start(ad.Extra, "", "", "Ad")
+	e.optAttr("id", ad.Id)
+	e.optIntAttr("sequence", ad.Sequence)
+	e.extraAttrs(ad.Extra, "")
+	e.startDone()
 
+	k := 0
 	if ad.InLine != nil {
-		buf = appendInLine(buf, ad.InLine)
+		k = e.child(ad.Extra, "", k, "InLine", false)
+		e.inLine(ad.InLine)
 	}
-	buf = append(buf, "</Ad>"...)
-	return buf
+	e.rest(ad.Extra, "", k)
+	e.end(p, "Ad")
 }
 
-func appendInLine(buf []byte, il *InLine) []byte {
-	buf = append(buf, "<InLine>"...)
+func (e *encoder) inLine(il *InLine) {
+	x := il.Extra
+	p := e.start(x, "", "", "InLine")
+	e.extraAttrs(x, "")
+	e.startDone()
 
 	// field order: AdSystem, AdTitle, Impression, Creatives, Extensions, Error
-	buf = append(buf, "<AdSystem>"...)
-	buf = escText(buf, il.AdSystem)
-	buf = append(buf, "</AdSystem>"...)
-
-	buf = append(buf, "<AdTitle>"...)
-	buf = escText(buf, il.AdTitle)
-	buf = append(buf, "</AdTitle>"...)
+	k := e.child(x, "", 0, "AdSystem", il.AdSystem == "")
+	e.textElement("AdSystem", il.AdSystem, x)
+	k = e.child(x, "", k, "AdTitle", il.AdTitle == "")
+	e.textElement("AdTitle", il.AdTitle, x)
 
 	for i := range il.Impression {
-		buf = appendImpression(buf, &il.Impression[i])
+		k = e.child(x, "", k, "Impression", false)
+		e.impression(&il.Impression[i])
 	}
 
-	// Wrappers always emitted for nested paths
-	buf = append(buf, "<Creatives>"...)
-	for i := range il.Creatives {
-		buf = appendCreative(buf, &il.Creatives[i])
+	// Wrappers for nested paths, always emitted by xml.Marshal
+	if !e.omit(len(il.Creatives), x, "Creatives") {
+		k = e.child(x, "", k, "Creatives", bare(len(il.Creatives), x, "Creatives"))
+		wp := e.start(x, "Creatives", "", "Creatives")
+		e.extraAttrs(x, "Creatives")
+		e.startDone()
+		j := 0
+		for i := range il.Creatives {
+			j = e.child(x, "Creatives", j, "Creative", false)
+			e.creative(&il.Creatives[i])
+		}
+		e.rest(x, "Creatives", j)
+		e.end(wp, "Creatives")
 	}
-	buf = append(buf, "</Creatives>"...)
 
-	buf = append(buf, "<Extensions>"...)
-	for i := range il.Extensions {
-		buf = appendExtension(buf, &il.Extensions[i])
+	if !e.omit(len(il.Extensions), x, "Extensions") {
+		k = e.child(x, "", k, "Extensions", bare(len(il.Extensions), x, "Extensions"))
+		wp := e.start(x, "Extensions", "", "Extensions")
+		e.extraAttrs(x, "Extensions")
+		e.startDone()
+		j := 0
+		for i := range il.Extensions {
+			j = e.child(x, "Extensions", j, "Extension", false)
+			e.extension(&il.Extensions[i])
+		}
+		e.rest(x, "Extensions", j)
+		e.end(wp, "Extensions")
 	}
-	buf = append(buf, "</Extensions>"...)
 
 	if il.Error != nil {
-		buf = append(buf, "<Error>"...)
-		buf = escText(buf, il.Error.Value)
-		buf = append(buf, "</Error>"...)
+		k = e.child(x, "", k, "Error", false)
+		ep := e.start(il.Error.Extra, "", "", "Error")
+		e.extraAttrs(il.Error.Extra, "")
+		e.startDone()
+		e.url(il.Error.Value)
+		e.end(ep, "Error")
 	}
 
-	buf = append(buf, "</InLine>"...)
-	return buf
+	e.rest(x, "", k)
+	e.end(p, "InLine")
 }
 
-func appendImpression(buf []byte, imp *Impression) []byte {
-	buf = append(buf, `<Impression id="`...)
-	buf = escAttr(buf, imp.Id)
-	buf = append(buf, '"', '>')
-	buf = escText(buf, imp.Text)
-	buf = append(buf, "</Impression>"...)
-	return buf
+func (e *encoder) impression(imp *Impression) {
+	p := e.start(imp.Extra, "", "", "Impression")
+	e.optAttr("id", imp.Id)
+	e.extraAttrs(imp.Extra, "")
+	e.startDone()
+	e.url(imp.Text)
+	e.end(p, "Impression")
 }
 
-func appendCreative(buf []byte, c *Creative) []byte {
-	buf = append(buf, `<Creative id="`...)
-	buf = escAttr(buf, c.Id)
-	buf = append(buf, `" adId="`...)
-	buf = escAttr(buf, c.AdId)
-	buf = append(buf, '"', '>')
+func (e *encoder) creative(c *Creative) {
+	p := e.start(c.Extra, "", "", "Creative")
+	e.optAttr("id", c.Id)
+	e.optAttr("adId", c.AdId)
+	e.extraAttrs(c.Extra, "")
+	e.startDone()
 
-	if c.UniversalAdId != nil {
-		buf = append(buf, `<UniversalAdId idRegistry="`...)
-		buf = escAttr(buf, c.UniversalAdId.IdRegistry)
-		buf = append(buf, '"', '>')
-		buf = escText(buf, c.UniversalAdId.Id)
-		buf = append(buf, "</UniversalAdId>"...)
+	k := 0
+	if u := c.UniversalAdId; u != nil {
+		k = e.child(c.Extra, "", k, "UniversalAdId", false)
+		up := e.start(u.Extra, "", "", "UniversalAdId")
+		e.attr("idRegistry", u.IdRegistry)
+		e.extraAttrs(u.Extra, "")
+		e.startDone()
+		e.text(u.Id)
+		e.end(up, "UniversalAdId")
 	}
 
 	if c.Linear != nil {
-		buf = appendLinear(buf, c.Linear)
+		k = e.child(c.Extra, "", k, "Linear", false)
+		e.linear(c.Linear)
 	}
 
-	buf = append(buf, "</Creative>"...)
-	return buf
+	e.rest(c.Extra, "", k)
+	e.end(p, "Creative")
 }
 
-func appendLinear(buf []byte, l *Linear) []byte {
-	buf = append(buf, "<Linear>"...)
+func (e *encoder) linear(l *Linear) {
+	x := l.Extra
+	p := e.start(x, "", "", "Linear")
+	e.extraAttrs(x, "")
+	e.startDone()
 
-	// Duration
-	buf = append(buf, "<Duration>"...)
-	buf = appendDuration(buf, l.Duration)
-	buf = append(buf, "</Duration>"...)
+	k := e.child(x, "", 0, "Duration", l.Duration.Duration == 0)
+	dp := e.start(x, "Duration", "", "Duration")
+	e.extraAttrs(x, "Duration")
+	e.startDone()
+	e.duration(l.Duration)
+	e.end(dp, "Duration")
 
-	// Wrappers always emitted for nested paths
-	buf = append(buf, "<TrackingEvents>"...)
-	for i := range l.TrackingEvents {
-		buf = appendTracking(buf, &l.TrackingEvents[i])
+	// Wrappers for nested paths, always emitted by xml.Marshal
+	if !e.omit(len(l.TrackingEvents), x, "TrackingEvents") {
+		k = e.child(x, "", k, "TrackingEvents", bare(len(l.TrackingEvents), x, "TrackingEvents"))
+		wp := e.start(x, "TrackingEvents", "", "TrackingEvents")
+		e.extraAttrs(x, "TrackingEvents")
+		e.startDone()
+		j := 0
+		for i := range l.TrackingEvents {
+			j = e.child(x, "TrackingEvents", j, "Tracking", false)
+			e.tracking("", &l.TrackingEvents[i])
+		}
+		e.rest(x, "TrackingEvents", j)
+		e.end(wp, "TrackingEvents")
 	}
-	buf = append(buf, "</TrackingEvents>"...)
 
-	buf = append(buf, "<MediaFiles>"...)
-	for i := range l.MediaFiles {
-		buf = appendMediaFile(buf, &l.MediaFiles[i])
+	if !e.omit(len(l.MediaFiles), x, "MediaFiles") {
+		k = e.child(x, "", k, "MediaFiles", bare(len(l.MediaFiles), x, "MediaFiles"))
+		wp := e.start(x, "MediaFiles", "", "MediaFiles")
+		e.extraAttrs(x, "MediaFiles")
+		e.startDone()
+		j := 0
+		for i := range l.MediaFiles {
+			j = e.child(x, "MediaFiles", j, "MediaFile", false)
+			e.mediaFile(&l.MediaFiles[i])
+		}
+		e.rest(x, "MediaFiles", j)
+		e.end(wp, "MediaFiles")
 	}
-	buf = append(buf, "</MediaFiles>"...)
 
 	// VideoClicks (shared wrapper for ClickThrough, ClickTracking, CustomClick)
-	buf = append(buf, "<VideoClicks>"...)
+	clicks := len(l.ClickTracking) + len(l.CustomClick)
 	if l.ClickThrough != nil {
-		buf = append(buf, `<ClickThrough id="`...)
-		buf = escAttr(buf, l.ClickThrough.Id)
-		buf = append(buf, '"', '>')
-		buf = escText(buf, l.ClickThrough.Text)
-		buf = append(buf, "</ClickThrough>"...)
-	}
-	for i := range l.ClickTracking {
-		buf = append(buf, `<ClickTracking id="`...)
-		buf = escAttr(buf, l.ClickTracking[i].Id)
-		buf = append(buf, '"', '>')
-		buf = escText(buf, l.ClickTracking[i].Text)
-		buf = append(buf, "</ClickTracking>"...)
-	}
-	for i := range l.CustomClick {
-		buf = append(buf, `<CustomClick id="`...)
-		buf = escAttr(buf, l.CustomClick[i].Id)
-		buf = append(buf, '"', '>')
-		buf = escText(buf, l.CustomClick[i].Text)
-		buf = append(buf, "</CustomClick>"...)
-	}
-	buf = append(buf, "</VideoClicks>"...)
-
-	buf = append(buf, "</Linear>"...)
-	return buf
+		clicks++
+	}
+	if !e.omit(clicks, x, "VideoClicks") {
+		k = e.child(x, "", k, "VideoClicks", bare(clicks, x, "VideoClicks"))
+		wp := e.start(x, "VideoClicks", "", "VideoClicks")
+		e.extraAttrs(x, "VideoClicks")
+		e.startDone()
+		j := 0
+		if ct := l.ClickThrough; ct != nil {
+			j = e.child(x, "VideoClicks", j, "ClickThrough", false)
+			e.click("ClickThrough", ct.Id, ct.Text, ct.Extra)
+		}
+		for i := range l.ClickTracking {
+			ct := &l.ClickTracking[i]
+			j = e.child(x, "VideoClicks", j, "ClickTracking", false)
+			e.click("ClickTracking", ct.Id, ct.Text, ct.Extra)
+		}
+		for i := range l.CustomClick {
+			cc := &l.CustomClick[i]
+			j = e.child(x, "VideoClicks", j, "CustomClick", false)
+			e.click("CustomClick", cc.Id, cc.Text, cc.Extra)
+		}
+		e.rest(x, "VideoClicks", j)
+		e.end(wp, "VideoClicks")
+	}
+
+	e.rest(x, "", k)
+	e.end(p, "Linear")
 }
 
-func appendTracking(buf []byte, t *TrackingEvent) []byte {
-	buf = append(buf, `<Tracking event="`...)
-	buf = escAttr(buf, t.Event)
-	buf = append(buf, '"', '>')
-	buf = escText(buf, t.Text)
-	buf = append(buf, "</Tracking>"...)
-	return buf
+func (e *encoder) click(name, id, url string, x *Extra) {
+	p := e.start(x, "", "", name)
+	e.optAttr("id", id)
+	e.extraAttrs(x, "")
+	e.startDone()
+	e.url(url)
+	e.end(p, name)
+}
+
+// tracking appends a Tracking element. prefix is that of VMAP elements for
+// the tracking events of an AdBreak, and empty for those of VAST.
+func (e *encoder) tracking(prefix string, t *TrackingEvent) {
+	p := e.start(t.Extra, "", prefix, "Tracking")
+	e.attr("event", t.Event)
+	e.extraAttrs(t.Extra, "")
+	e.startDone()
+	e.url(t.Text)
+	e.end(p, "Tracking")
 }
 
-func appendMediaFile(buf []byte, m *MediaFile) []byte {
+func (e *encoder) mediaFile(m *MediaFile) {
 	// attr order: bitrate, width, height, delivery, type, codec
-	buf = append(buf, `<MediaFile bitrate="`...)
-	buf = strconv.AppendInt(buf, int64(m.Bitrate), 10)
-	buf = append(buf, `" width="`...)
-	buf = strconv.AppendInt(buf, int64(m.Width), 10)
-	buf = append(buf, `" height="`...)
-	buf = strconv.AppendInt(buf, int64(m.Height), 10)
-	buf = append(buf, `" delivery="`...)
-	buf = escAttr(buf, m.Delivery)
-	buf = append(buf, `" type="`...)
-	buf = escAttr(buf, m.MediaType)
-	buf = append(buf, `" codec="`...)
-	buf = escAttr(buf, m.Codec)
-	buf = append(buf, '"', '>')
-	buf = escText(buf, m.Text)
-	buf = append(buf, "</MediaFile>"...)
-	return buf
+	p := e.start(m.Extra, "", "", "MediaFile")
+	e.optIntAttr("bitrate", m.Bitrate)
+	e.intAttr("width", m.Width)
+	e.intAttr("height", m.Height)
+	e.attr("delivery", m.Delivery)
+	e.attr("type", m.MediaType)
+	e.optAttr("codec", m.Codec)
+	e.extraAttrs(m.Extra, "")
+	e.startDone()
+	e.url(m.Text)
+	e.end(p, "MediaFile")
 }
 
-func appendExtension(buf []byte, ext *Extension) []byte {
-	buf = append(buf, `<Extension type="`...)
-	buf = escAttr(buf, ext.ExtensionType)
-	buf = append(buf, '"', '>')
+func (e *encoder) extension(ext *Extension) {
+	x := ext.Extra
+	p := e.start(x, "", "", "Extension")
+	e.optAttr("type", ext.ExtensionType)
+	e.extraAttrs(x, "")
+	e.startDone()
 
-	buf = append(buf, "<CreativeParameters>"...)
-	for i := range ext.CreativeParameters {
-		buf = appendCreativeParameter(buf, &ext.CreativeParameters[i])
+	k := 0
+	if !e.omit(len(ext.CreativeParameters), x, "CreativeParameters") {
+		k = e.child(x, "", k, "CreativeParameters", bare(len(ext.CreativeParameters), x, "CreativeParameters"))
+		wp := e.start(x, "CreativeParameters", "", "CreativeParameters")
+		e.extraAttrs(x, "CreativeParameters")
+		e.startDone()
+		j := 0
+		for i := range ext.CreativeParameters {
+			j = e.child(x, "CreativeParameters", j, "CreativeParameter", false)
+			e.creativeParameter(&ext.CreativeParameters[i])
+		}
+		e.rest(x, "CreativeParameters", j)
+		e.end(wp, "CreativeParameters")
 	}
-	buf = append(buf, "</CreativeParameters>"...)
 
-	buf = append(buf, "</Extension>"...)
-	return buf
+	e.rest(x, "", k)
+	e.end(p, "Extension")
 }
 
-func appendCreativeParameter(buf []byte, cp *CreativeParameter) []byte {
+func (e *encoder) creativeParameter(cp *CreativeParameter) {
 	// attr order: creativeId, name, type (Value is chardata)
-	buf = append(buf, `<CreativeParameter creativeId="`...)
-	buf = escAttr(buf, cp.CreativeId)
-	buf = append(buf, `" name="`...)
-	buf = escAttr(buf, cp.Name)
-	buf = append(buf, `" type="`...)
-	buf = escAttr(buf, cp.CreativeParameterType)
-	buf = append(buf, '"', '>')
-	buf = escText(buf, cp.Value)
-	buf = append(buf, "</CreativeParameter>"...)
-	return buf
+	p := e.start(cp.Extra, "", "", "CreativeParameter")
+	e.optAttr("creativeId", cp.CreativeId)
+	e.attr("name", cp.Name)
+	e.attr("type", cp.CreativeParameterType)
+	e.extraAttrs(cp.Extra, "")
+	e.startDone()
+	e.text(cp.Value)
+	e.end(p, "CreativeParameter")
 }
@@ -0,0 +1,366 @@
+package vmap
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func readSampleVmap(t *testing.T, name string) VMAP {
+	t.Helper()
+	doc, err := os.ReadFile("sample-vmap/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v VMAP
+	if err := xml.Unmarshal(doc, &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestMarshalVmapDefaultOptions(t *testing.T) {
+	is := is.New(t)
+	v := readSampleVmap(t, "testVmap.xml")
+
+	expected, err := xml.Marshal(v)
+	is.NoErr(err)
+	got, err := MarshalVmapWithOptions(&v, EncodeOptions{})
+	is.NoErr(err)
+	is.Equal(string(expected), string(got))
+}
+
+func TestMarshalVmapNamespaced(t *testing.T) {
+	is := is.New(t)
+	v := readSampleVmap(t, "testVmap.xml")
+
+	got, err := MarshalVmapWithOptions(&v, EncodeOptions{Namespaced: true})
+	is.NoErr(err)
+	out := string(got)
+	is.True(strings.HasPrefix(out,
+		`<?xml version="1.0" encoding="UTF-8"?>`+"\n"+
+			`<vmap:VMAP xmlns:vmap="http://www.iab.net/vmap-1.0" version="1.0">`))
+	is.True(strings.HasSuffix(out, "</vmap:VMAP>"))
+	for _, name := range []string{"AdBreak", "AdSource", "VASTAdData", "TrackingEvents", "Tracking"} {
+		is.True(strings.Contains(out, "<vmap:"+name)) // VMAP element prefixed
+	}
+	is.True(strings.Contains(out, "<VAST "))                     // VAST left unprefixed
+	is.True(strings.Contains(out, "<TrackingEvents><Tracking ")) // also inside VAST
+	is.True(!strings.Contains(out, " vmap=\""))
+
+	// The namespaced document decodes to the same VMAP with every decoder.
+	var unmarshalled VMAP
+	is.NoErr(xml.Unmarshal(got, &unmarshalled))
+	is.Equal(unmarshalled, v)
+
+	decoded, err := DecodeVmap(got)
+	is.NoErr(err)
+	is.Equal(len(decoded.AdBreaks), len(v.AdBreaks))
+	is.Equal(decoded.Vmap, v.Vmap)
+
+	scanned, err := DecodeVmapScan(got)
+	is.NoErr(err)
+	is.Equal(len(scanned.AdBreaks), len(v.AdBreaks))
+	is.Equal(scanned.Vmap, v.Vmap)
+}
+
+func TestMarshalVmapNamespacedDefaultNamespace(t *testing.T) {
+	is := is.New(t)
+	v := VMAP{Version: "1.0", AdBreaks: []AdBreak{{Id: "pre", BreakType: "linear", TimeOffset: StartOffset()}}}
+
+	got, err := MarshalVmapWithOptions(&v, EncodeOptions{Namespaced: true})
+	is.NoErr(err)
+	is.Equal(string(got), `<?xml version="1.0" encoding="UTF-8"?>`+"\n"+
+		`<vmap:VMAP xmlns:vmap="http://www.iab.net/videosuite/vmap" version="1.0">`+
+		`<vmap:AdBreak breakId="pre" breakType="linear" timeOffset="start">`+
+		`<vmap:TrackingEvents></vmap:TrackingEvents></vmap:AdBreak></vmap:VMAP>`)
+}
+
+func TestMarshalVastOmitEmpty(t *testing.T) {
+	is := is.New(t)
+	v := VAST{
+		Version: "4.1",
+		Ad: []Ad{{InLine: &InLine{
+			AdSystem:   "sys",
+			AdTitle:    "title",
+			Impression: []Impression{{Text: "http://imp"}},
+			Creatives: []Creative{{Linear: &Linear{
+				Duration:   Duration{5e9},
+				MediaFiles: []MediaFile{{Width: 640, Height: 360, Delivery: "progressive", MediaType: "video/mp4"}},
+			}}},
+			Extensions: []Extension{{}},
+		}}},
+	}
+
+	got, err := MarshalVastWithOptions(&v, EncodeOptions{OmitEmpty: true})
+	is.NoErr(err)
+	is.Equal(string(got), `<VAST version="4.1"><Ad><InLine><AdSystem>sys</AdSystem><AdTitle>title</AdTitle>`+
+		`<Impression>http://imp</Impression><Creatives><Creative><Linear><Duration>00:00:05</Duration>`+
+		`<MediaFiles><MediaFile width="640" height="360" delivery="progressive" type="video/mp4"></MediaFile>`+
+		`</MediaFiles></Linear></Creative></Creatives><Extensions><Extension></Extension></Extensions>`+
+		`</InLine></Ad></VAST>`)
+
+	// Without the option every element and attribute is written.
+	got, err = MarshalVastWithOptions(&v, EncodeOptions{})
+	is.NoErr(err)
+	is.True(strings.Contains(string(got), `<VAST xsi="" noNamespaceSchemaLocation="" version="4.1">`))
+	is.True(strings.Contains(string(got), `<VideoClicks></VideoClicks>`))
+}
+
+func TestMarshalVastOmitEmptyXsi(t *testing.T) {
+	tests := []struct {
+		name, xsi, schema, want string
+	}{
+		{name: "none", want: `<VAST version="4.0">`},
+		{
+			name:   "schema location only",
+			schema: "vast.xsd",
+			want: `<VAST xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance"` +
+				` xsi:noNamespaceSchemaLocation="vast.xsd" version="4.0">`,
+		},
+		{
+			name: "both",
+			xsi:  "http://www.w3.org/2001/XMLSchema-instance", schema: "vast.xsd",
+			want: `<VAST xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance"` +
+				` xsi:noNamespaceSchemaLocation="vast.xsd" version="4.0">`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+			v := VAST{Version: "4.0", Xsi: tc.xsi, NoNamespaceSchemaLocation: tc.schema}
+			got, err := MarshalVastWithOptions(&v, EncodeOptions{OmitEmpty: true})
+			is.NoErr(err)
+			is.Equal(string(got), tc.want+"</VAST>")
+
+			// The attributes read back into the same fields.
+			var back VAST
+			is.NoErr(xml.Unmarshal(got, &back))
+			is.Equal(back.NoNamespaceSchemaLocation, tc.schema)
+		})
+	}
+}
+
+func TestMarshalVmapOmitEmptyRoundTrip(t *testing.T) {
+	for _, name := range []string{"testVmap.xml", "testVmap2.xml", "testVmapEmptyVast.xml"} {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			v := readSampleVmap(t, name)
+			for _, opts := range []EncodeOptions{{OmitEmpty: true}, {OmitEmpty: true, Namespaced: true}} {
+				got, err := MarshalVmapWithOptions(&v, opts)
+				is.NoErr(err)
+				is.True(!strings.Contains(string(got), `=""`))
+				is.True(!strings.Contains(string(got), `sequence="0"`))
+
+				var back VMAP
+				is.NoErr(xml.Unmarshal(got, &back))
+				back.XMLName.Space = v.XMLName.Space // only carried by the namespaced form
+				is.Equal(back, v)
+			}
+		})
+	}
+}
+
+// allEncodeOptions lists option combinations the encoder tests run with.
+var allEncodeOptions = []EncodeOptions{
+	{},
+	{Namespaced: true},
+	{OmitEmpty: true},
+	{Namespaced: true, OmitEmpty: true},
+	{Indent: "  "},
+	{CDATA: true},
+	{Namespaced: true, OmitEmpty: true, Prefix: "\t", Indent: " ", CDATA: true},
+}
+
+func TestEstimateSize(t *testing.T) {
+	for _, name := range []string{"testVmap.xml", "testVmap2.xml", "testVmapEmptyVast.xml"} {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			v := readSampleVmap(t, name)
+			for _, opts := range allEncodeOptions {
+				got, err := MarshalVmapWithOptions(&v, opts)
+				is.NoErr(err)
+				is.Equal(EstimateVmapSize(&v, opts), len(got))
+				buf := make([]byte, 0, EstimateVmapSize(&v, opts))
+				appended, err := MarshalVmapAppendWithOptions(buf, &v, opts)
+				is.NoErr(err)
+				is.Equal(cap(appended), len(appended)) // sized exactly
+				is.Equal(string(appended), string(got))
+
+				for _, ab := range v.AdBreaks {
+					if ab.AdSource == nil || ab.AdSource.VASTData == nil || ab.AdSource.VASTData.VAST == nil {
+						continue
+					}
+					vast := ab.AdSource.VASTData.VAST
+					got, err := MarshalVastWithOptions(vast, opts)
+					is.NoErr(err)
+					is.Equal(EstimateVastSize(vast, opts), len(got))
+					buf := make([]byte, 0, EstimateVastSize(vast, opts))
+					appended, err := MarshalVastAppendWithOptions(buf, vast, opts)
+					is.NoErr(err)
+					is.Equal(cap(appended), len(appended))
+					is.Equal(string(appended), string(got))
+				}
+			}
+		})
+	}
+}
+
+func TestEstimateSizeEscapes(t *testing.T) {
+	is := is.New(t)
+	v := VAST{Version: "4.1", Text: "\t\r\n", Ad: []Ad{{Id: `<&">`, InLine: &InLine{AdTitle: "a&b<c>d\"e"}}}}
+	got, err := MarshalVast(&v)
+	is.NoErr(err)
+	is.Equal(EstimateVastSize(&v, EncodeOptions{}), len(got))
+}
+
+// chunkWriter records the size of every write.
+type chunkWriter struct {
+	bytes.Buffer
+	writes []int
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, len(p))
+	return w.Buffer.Write(p)
+}
+
+// bigVmap returns a VMAP with n copies of the first ad break of testVmap.xml.
+func bigVmap(t testing.TB, n int) *VMAP {
+	doc, err := os.ReadFile("sample-vmap/testVmap.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v VMAP
+	if err := xml.Unmarshal(doc, &v); err != nil {
+		t.Fatal(err)
+	}
+	breaks := make([]AdBreak, n)
+	for i := range breaks {
+		breaks[i] = v.AdBreaks[0]
+	}
+	v.AdBreaks = breaks
+	return &v
+}
+
+func TestEncodeVmap(t *testing.T) {
+	is := is.New(t)
+	v := bigVmap(t, 50)
+	for _, opts := range allEncodeOptions {
+		want, err := MarshalVmapWithOptions(v, opts)
+		is.NoErr(err)
+
+		var w chunkWriter
+		is.NoErr(EncodeVmap(&w, v, opts))
+		is.Equal(w.String(), string(want))
+		is.True(len(w.writes) > 1) // written in chunks
+		for _, n := range w.writes {
+			is.True(n < 2*flushSize)
+		}
+	}
+}
+
+func TestEncodeVast(t *testing.T) {
+	is := is.New(t)
+	v := bigVmap(t, 1).AdBreaks[0].AdSource.VASTData.VAST
+	for _, opts := range allEncodeOptions {
+		want, err := MarshalVastWithOptions(v, opts)
+		is.NoErr(err)
+
+		var buf bytes.Buffer
+		is.NoErr(EncodeVast(&buf, v, opts))
+		is.Equal(buf.String(), string(want))
+	}
+}
+
+type failingWriter struct{ writes int }
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return 0, errors.New("disk full")
+}
+
+func TestEncodeVmapWriteError(t *testing.T) {
+	is := is.New(t)
+	w := &failingWriter{}
+	err := EncodeVmap(w, bigVmap(t, 50), EncodeOptions{})
+	is.Equal(err.Error(), "disk full")
+	is.Equal(w.writes, 1) // no writes after the first failure
+}
+
+func TestMarshalIndent(t *testing.T) {
+	indents := []struct{ prefix, indent string }{{"", "  "}, {">", ""}, {"# ", "\t"}}
+	for _, name := range []string{"testVmap.xml", "testVmap2.xml", "testVmapEmptyVast.xml"} {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			v := readSampleVmap(t, name)
+			for _, in := range indents {
+				want, err := xml.MarshalIndent(v, in.prefix, in.indent)
+				is.NoErr(err)
+				got, err := MarshalVmapWithOptions(&v, EncodeOptions{Prefix: in.prefix, Indent: in.indent})
+				is.NoErr(err)
+				is.Equal(string(got), string(want))
+			}
+		})
+	}
+}
+
+func TestMarshalVastIndent(t *testing.T) {
+	is := is.New(t)
+	doc, err := os.ReadFile("sample-vmap/testVast.xml")
+	is.NoErr(err)
+	var v VAST
+	is.NoErr(xml.Unmarshal(doc, &v))
+
+	want, err := xml.MarshalIndent(v, "", "  ")
+	is.NoErr(err)
+	got, err := MarshalVastWithOptions(&v, EncodeOptions{Indent: "  "})
+	is.NoErr(err)
+	is.Equal(string(got), string(want))
+}
+
+func TestMarshalCDATA(t *testing.T) {
+	is := is.New(t)
+	u := "http://t/track?a=1&b=2"
+	v := VAST{Version: "4.1", Ad: []Ad{{InLine: &InLine{
+		AdTitle:    "Fish & Chips",
+		Impression: []Impression{{Text: u}},
+		Creatives: []Creative{{Linear: &Linear{
+			TrackingEvents: []TrackingEvent{{Event: "start", Text: u}},
+			MediaFiles:     []MediaFile{{Text: "http://t/a]]>b.mp4"}},
+			ClickThrough:   &ClickThrough{Text: u},
+			ClickTracking:  []ClickTracking{{Text: u}},
+		}}},
+		Error: &Error{Value: u + "&code=[ERRORCODE]"},
+	}}}}
+
+	got, err := MarshalVastWithOptions(&v, EncodeOptions{CDATA: true, OmitEmpty: true})
+	is.NoErr(err)
+	out := string(got)
+	is.True(strings.Contains(out, "<AdTitle>Fish &amp; Chips</AdTitle>")) // not a URL
+	is.True(strings.Contains(out, "<Impression><![CDATA["+u+"]]></Impression>"))
+	is.True(strings.Contains(out, `<Tracking event="start"><![CDATA[`+u+"]]></Tracking>"))
+	is.True(strings.Contains(out, "<ClickThrough><![CDATA["+u+"]]></ClickThrough>"))
+	is.True(strings.Contains(out, "<ClickTracking><![CDATA["+u+"]]></ClickTracking>"))
+	is.True(strings.Contains(out, "<Error><![CDATA["+u+"&code=[ERRORCODE]]]></Error>"))
+	is.True(strings.Contains(out, ">http://t/a]]&gt;b.mp4</MediaFile>"))
+
+	// Every decoder reads the URLs back unchanged.
+	var unmarshalled VAST
+	is.NoErr(xml.Unmarshal(got, &unmarshalled))
+	is.Equal(unmarshalled.Ad[0].InLine, v.Ad[0].InLine)
+	for _, decode := range []func([]byte) (VAST, error){DecodeVast, DecodeVastScan} {
+		decoded, err := decode(got)
+		is.NoErr(err)
+		il := decoded.Ad[0].InLine
+		is.Equal(il.Impression[0].Text, u)
+		is.Equal(il.Creatives[0].Linear.TrackingEvents[0].Text, u)
+		is.Equal(il.Creatives[0].Linear.MediaFiles[0].Text, "http://t/a]]>b.mp4")
+		is.Equal(il.Error.Value, u+"&code=[ERRORCODE]")
+	}
+}
@@ -0,0 +1,195 @@
+package vmap
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrNoVMAP is returned when a document contains no VMAP element.
+	ErrNoVMAP = errors.New("no VMAP token found in document")
+	// ErrNoVAST is returned when a document contains no VAST element.
+	ErrNoVAST = errors.New("no VAST token found in document")
+)
+
+// DecodeError describes a problem found while decoding a document and
+// where in the input it was found. The underlying error is available
+// through errors.Is and errors.As.
+type DecodeError struct {
+	// Offset is the byte offset in the input, or -1 when unknown. For a
+	// value that does not parse, such as a Duration or a timeOffset, it is
+	// the start of the value, with DecodeVmap as with DecodeVmapScan.
+	Offset int64
+	// Line and Column are 1-based; Column counts bytes. Both are zero
+	// when the offset is unknown.
+	Line   int
+	Column int
+	// Path is the chain of enclosing elements by local name, with 1-based
+	// indices on repeatable elements, e.g.
+	// VMAP/AdBreak[3]/AdSource/VASTAdData/VAST/Ad[2]/InLine/Creatives/Creative[1]/Linear/Duration.
+	Path string
+	Err  error
+}
+
+func (e *DecodeError) Error() string {
+	var sb strings.Builder
+	if e.Path != "" {
+		sb.WriteString(e.Path)
+		sb.WriteByte(' ')
+	}
+	if e.Offset >= 0 {
+		fmt.Fprintf(&sb, "(line %d, column %d, offset %d)", e.Line, e.Column, e.Offset)
+	}
+	if sb.Len() == 0 {
+		return e.Err.Error()
+	}
+	sb.WriteString(": ")
+	sb.WriteString(e.Err.Error())
+	return sb.String()
+}
+
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+// newDecodeError wraps err with the position of offset in input. The
+// element path is that of the innermost element whose tag starts at or
+// before offset and has not been closed.
+func newDecodeError(input []byte, offset int, err error) *DecodeError {
+	if offset < 0 {
+		return &DecodeError{Offset: -1, Err: err}
+	}
+	if offset > len(input) {
+		offset = len(input)
+	}
+	line := 1 + bytes.Count(input[:offset], []byte{'\n'})
+	col := offset - bytes.LastIndexByte(input[:offset], '\n')
+	return &DecodeError{
+		Offset: int64(offset),
+		Line:   line,
+		Column: col,
+		Path:   elementPath(input, offset),
+		Err:    err,
+	}
+}
+
+// repeatable lists the elements that may occur several times under the
+// same parent. They get an index in element paths.
+var repeatable = map[string]bool{
+	"AdBreak":           true,
+	"Tracking":          true,
+	"Ad":                true,
+	"Impression":        true,
+	"Error":             true,
+	"Creative":          true,
+	"MediaFile":         true,
+	"ClickTracking":     true,
+	"CustomClick":       true,
+	"Extension":         true,
+	"CreativeParameter": true,
+}
+
+// elementPath returns the path of the elements open at offset in input.
+// It is only used to describe errors, so it favours simplicity over speed.
+func elementPath(input []byte, offset int) string {
+	type frame struct {
+		name     string
+		children map[string]int
+	}
+	stack := []frame{{children: map[string]int{}}}
+
+	pos := 0
+	for pos <= offset {
+		i := bytes.IndexByte(input[pos:], '<')
+		if i < 0 || pos+i > offset {
+			break
+		}
+		pos += i
+		rest := input[pos:]
+		switch {
+		case bytes.HasPrefix(rest, []byte("<!--")):
+			pos = skipPast(input, pos, "-->")
+			continue
+		case bytes.HasPrefix(rest, []byte("<![CDATA[")):
+			pos = skipPast(input, pos, "]]>")
+			continue
+		case bytes.HasPrefix(rest, []byte("<?")), bytes.HasPrefix(rest, []byte("<!")):
+			pos = skipPast(input, pos, ">")
+			continue
+		}
+
+		end := tagEnd(input, pos)
+		tag := input[pos+1 : end]
+		isEnd := len(tag) > 0 && tag[0] == '/'
+		selfClose := len(tag) > 0 && tag[len(tag)-1] == '/'
+		name := tagName(tag)
+		pos = end + 1
+
+		if isEnd {
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+			continue
+		}
+		parent := &stack[len(stack)-1]
+		parent.children[name]++
+		seg := name
+		if repeatable[name] {
+			seg += "[" + strconv.Itoa(parent.children[name]) + "]"
+		}
+		if !selfClose || pos > offset {
+			stack = append(stack, frame{name: seg, children: map[string]int{}})
+		}
+	}
+
+	names := make([]string, 0, len(stack)-1)
+	for _, f := range stack[1:] {
+		names = append(names, f.name)
+	}
+	return strings.Join(names, "/")
+}
+
+// skipPast returns the offset just past the first occurrence of delim at
+// or after pos, or len(input) when there is none.
+func skipPast(input []byte, pos int, delim string) int {
+	i := bytes.Index(input[pos:], []byte(delim))
+	if i < 0 {
+		return len(input)
+	}
+	return pos + i + len(delim)
+}
+
+// tagEnd returns the offset of the '>' closing the tag that starts at pos,
+// skipping quoted attribute values, or len(input) when there is none.
+func tagEnd(input []byte, pos int) int {
+	var quote byte
+	for i := pos + 1; i < len(input); i++ {
+		c := input[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '>':
+			return i
+		}
+	}
+	return len(input)
+}
+
+// tagName returns the local name of a tag, given its contents without
+// the surrounding '<' and '>'.
+func tagName(tag []byte) string {
+	tag = bytes.TrimPrefix(tag, []byte{'/'})
+	end := bytes.IndexAny(tag, " \t\r\n/")
+	if end >= 0 {
+		tag = tag[:end]
+	}
+	if colon := bytes.IndexByte(tag, ':'); colon >= 0 {
+		tag = tag[colon+1:]
+	}
+	return string(tag)
+}
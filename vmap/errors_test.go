@@ -0,0 +1,122 @@
+package vmap
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+const badDurationVmap = `<vmap:VMAP xmlns:vmap="http://www.iab.net/vmap-1.0" version="1.0">
+<vmap:AdBreak breakId="1" timeOffset="start"></vmap:AdBreak>
+<vmap:AdBreak breakId="2" timeOffset="00:05:00">
+ <vmap:AdSource><vmap:VASTAdData>
+  <VAST version="4.0">
+   <Ad id="a"></Ad>
+   <Ad id="b"><InLine><Creatives><Creative id="c"><Linear>
+    <Duration>5 seconds</Duration>
+   </Linear></Creative></Creatives></InLine></Ad>
+  </VAST>
+ </vmap:VASTAdData></vmap:AdSource>
+</vmap:AdBreak>
+</vmap:VMAP>`
+
+const badDurationPath = "VMAP/AdBreak[2]/AdSource/VASTAdData/VAST/Ad[2]/InLine/Creatives/Creative[1]/Linear/Duration"
+
+func TestDecodeErrorPosition(t *testing.T) {
+	is := is.New(t)
+
+	_, err := DecodeVmap([]byte(badDurationVmap))
+	var derr *DecodeError
+	is.True(errors.As(err, &derr))
+	is.Equal(derr.Path, badDurationPath)
+	is.Equal(derr.Line, 8)
+	is.Equal(derr.Column, 15)
+	is.Equal(badDurationVmap[derr.Offset:derr.Offset+9], "5 seconds")
+
+	_, _, err = DecodeVmapScanWithOptions([]byte(badDurationVmap), DecodeOptions{Strict: true})
+	is.True(errors.As(err, &derr))
+	is.Equal(derr.Path, badDurationPath)
+	is.Equal(derr.Line, 8)
+	is.Equal(derr.Column, 15)
+	is.Equal(badDurationVmap[derr.Offset:derr.Offset+9], "5 seconds")
+}
+
+// TestDecodeErrorValuePosition checks that the tokenizer and scan decoders
+// both report a bad value at its start.
+func TestDecodeErrorValuePosition(t *testing.T) {
+	tests := []struct {
+		name, doc, value string
+	}{
+		{"duration", "<VAST>\n<Ad><InLine><Creatives><Creative><Linear>\n<Duration> 00:00:xx</Duration>", "00:00:xx"},
+		{"cdata duration", "<VAST><Ad><InLine><Creatives><Creative><Linear><Duration><![CDATA[bad]]></Duration>", "bad"},
+		{"time offset", "<VMAP>\n<AdBreak breakId=\"1\"\n timeOffset='soon'></AdBreak></VMAP>", "soon"},
+		{"sequence", "<VAST>\n<Ad id=\"1\" sequence=\"x\"><InLine/></Ad></VAST>", "x\""},
+		{"width", "<VAST><Ad><InLine><Creatives><Creative><Linear><MediaFiles>\n <MediaFile width=\"w\">", "w\""},
+		{"text entity", "<VAST><Ad><InLine>\n<AdTitle>a &bogus; b</AdTitle></InLine></Ad></VAST>", "a &bogus;"},
+		{"attribute entity", "<VAST><Ad><InLine>\n<Impression id=\"&bogus;\">u</Impression></InLine></Ad></VAST>", "&bogus;"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			doc := []byte(tt.doc)
+			var tokErr, scanErr error
+			if bytes.HasPrefix(doc, []byte("<VMAP")) {
+				_, tokErr = DecodeVmap(doc)
+				_, _, scanErr = DecodeVmapScanWithOptions(doc, DecodeOptions{Strict: true})
+			} else {
+				_, tokErr = DecodeVast(doc)
+				_, _, scanErr = DecodeVastScanWithOptions(doc, DecodeOptions{Strict: true})
+			}
+			var tok, scan *DecodeError
+			is.True(errors.As(tokErr, &tok))
+			is.True(errors.As(scanErr, &scan))
+			is.Equal(tok.Line, scan.Line)
+			is.Equal(tok.Column, scan.Column)
+			is.Equal(tok.Offset, scan.Offset)
+			is.True(bytes.HasPrefix(doc[tok.Offset:], []byte(tt.value))) // at the value
+		})
+	}
+}
+
+func TestDecodeErrorWarnings(t *testing.T) {
+	is := is.New(t)
+	_, warnings, err := DecodeVmapScanWithOptions([]byte(badDurationVmap), DecodeOptions{})
+	is.NoErr(err)
+	is.Equal(len(warnings), 1)
+	var derr *DecodeError
+	is.True(errors.As(warnings[0], &derr))
+	is.Equal(derr.Path, badDurationPath)
+}
+
+func TestDecodeErrorUnterminated(t *testing.T) {
+	is := is.New(t)
+	doc := []byte("<VAST version=\"4.0\">\n<Ad id=\"1\">\n<InLine><AdTitle>x</AdTitle>")
+
+	_, err := DecodeVast(doc)
+	is.True(errors.Is(err, io.ErrUnexpectedEOF))
+
+	_, _, err = DecodeVastScanWithOptions(doc, DecodeOptions{Strict: true})
+	var derr *DecodeError
+	is.True(errors.As(err, &derr))
+	is.Equal(derr.Path, "VAST/Ad[1]/InLine")
+	is.Equal(derr.Line, 3)
+}
+
+func TestDecodeErrorSentinels(t *testing.T) {
+	is := is.New(t)
+	doc := []byte(`<VAST version="4.0"></VAST>`)
+
+	_, err := DecodeVmap(doc)
+	is.True(errors.Is(err, ErrNoVMAP))
+	_, err = DecodeVmapScan(doc)
+	is.True(errors.Is(err, ErrNoVMAP))
+
+	doc = []byte(`<VMAP version="1.0"></VMAP>`)
+	_, err = DecodeVast(doc)
+	is.True(errors.Is(err, ErrNoVAST))
+	_, err = DecodeVastScan(doc)
+	is.True(errors.Is(err, ErrNoVAST))
+}
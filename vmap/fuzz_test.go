@@ -0,0 +1,198 @@
+package vmap
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"os"
+	"testing"
+)
+
+// The fuzz targets below mostly assert that decoding arbitrary input never
+// panics; any result, including an error, is acceptable. The round-trip
+// targets also check what is encoded from it.
+//
+// The seeds are kept small, as the fuzzer mutates every byte of them: the
+// larger sample documents would slow it to a crawl.
+
+// seedVmap and seedVast hold one of each element the decoders know.
+const (
+	seedVmap = `<vmap:VMAP xmlns:vmap="http://www.iab.net/videosuite/vmap" version="1.0">` +
+		`<vmap:AdBreak timeOffset="00:00:10.5" breakType="linear" breakId="a">` +
+		`<vmap:AdSource id="s"><vmap:VASTAdData>` + seedVast + `</vmap:VASTAdData></vmap:AdSource>` +
+		`<vmap:TrackingEvents><vmap:Tracking event="breakStart">http://t/b</vmap:Tracking></vmap:TrackingEvents>` +
+		`</vmap:AdBreak><vmap:AdBreak timeOffset="50%" breakId='b'/></vmap:VMAP>`
+	seedVast = `<VAST version="4.0"><Ad id="1" sequence="1"><InLine><AdSystem>s</AdSystem><AdTitle>t</AdTitle>` +
+		`<Impression id="i"><![CDATA[http://t/i]]></Impression><Creatives><Creative id="c" adId="a">` +
+		`<UniversalAdId idRegistry="r">u</UniversalAdId><Linear><Duration>00:00:15</Duration>` +
+		`<TrackingEvents><Tracking event="progress" offset="00:00:05">http://t/p</Tracking></TrackingEvents>` +
+		`<MediaFiles><MediaFile delivery="progressive" type="video/mp4" width="1" height="1">http://m</MediaFile>` +
+		`</MediaFiles><VideoClicks><ClickThrough id="ct">http://c</ClickThrough>` +
+		`<ClickTracking>http://ct</ClickTracking><CustomClick>http://cc</CustomClick></VideoClicks>` +
+		`</Linear></Creative></Creatives><Extensions><Extension type="x"><CreativeParameters>` +
+		`<CreativeParameter creativeId="c" name="n" type="Linear">v</CreativeParameter>` +
+		`</CreativeParameters></Extension></Extensions><Error>http://e</Error></InLine></Ad></VAST>`
+)
+
+func addSeedCorpus(f *testing.F, names ...string) {
+	for _, name := range names {
+		doc, err := os.ReadFile("sample-vmap/" + name)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(doc)
+	}
+	f.Add([]byte(seedVmap))
+	f.Add([]byte(seedVast))
+	f.Add([]byte(""))
+	f.Add([]byte("<"))
+	f.Add([]byte("<VMAP><AdBreak timeOffset=\"x\"><VAST><Ad><InLine><Creatives><Creative><ClickThrough>"))
+	f.Add([]byte("<VAST><Ad><InLine><Creatives><Creative><VideoClicks><ClickThrough>x</ClickThrough>"))
+}
+
+func FuzzDecodeVmap(f *testing.F) {
+	addSeedCorpus(f, "testVmap2.xml", "testVmapEmptyVast.xml")
+	f.Fuzz(func(t *testing.T, doc []byte) {
+		_, _ = DecodeVmap(doc)
+	})
+}
+
+func FuzzDecodeVast(f *testing.F) {
+	addSeedCorpus(f, "testVast3.xml", "testVastSpecialChars.xml")
+	f.Fuzz(func(t *testing.T, doc []byte) {
+		_, _ = DecodeVast(doc)
+	})
+}
+
+func FuzzDecodeVmapScan(f *testing.F) {
+	addSeedCorpus(f, "testVmap2.xml", "testVmapEmptyVast.xml")
+	f.Fuzz(func(t *testing.T, doc []byte) {
+		_, _ = DecodeVmapScan(doc)
+		_, _, _ = DecodeVmapScanWithOptions(doc, DecodeOptions{Strict: true})
+	})
+}
+
+func FuzzDecodeVastScan(f *testing.F) {
+	addSeedCorpus(f, "testVast3.xml", "testVastSpecialChars.xml")
+	f.Fuzz(func(t *testing.T, doc []byte) {
+		_, _ = DecodeVastScan(doc)
+		_, _, _ = DecodeVastScanWithOptions(doc, DecodeOptions{Strict: true})
+	})
+}
+
+// wellFormed reports whether doc is well-formed XML.
+func wellFormed(doc []byte) bool {
+	d := xml.NewDecoder(bytes.NewReader(doc))
+	for {
+		_, err := d.Token()
+		if err == io.EOF {
+			return true
+		}
+		if err != nil {
+			return false
+		}
+	}
+}
+
+func FuzzLosslessRoundTrip(f *testing.F) {
+	addSeedCorpus(f, "testVmapUnknown.xml")
+	f.Fuzz(func(t *testing.T, doc []byte) {
+		if !wellFormed(doc) {
+			return // unknown markup is kept as found, malformed or not
+		}
+		v, _, err := DecodeVmapScanWithOptions(doc, DecodeOptions{Strict: true, Lossless: true})
+		if err != nil {
+			return
+		}
+		out, err := MarshalVmap(&v)
+		if err != nil {
+			return
+		}
+		if n := EstimateVmapSize(&v, EncodeOptions{}); n != len(out) {
+			t.Fatalf("estimated %d bytes, wrote %d", n, len(out))
+		}
+		back, _, err := DecodeVmapScanWithOptions(out, DecodeOptions{Strict: true, Lossless: true})
+		if err != nil {
+			t.Fatalf("%v decoding %q", err, out)
+		}
+		again, err := MarshalVmap(&back)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(again, out) {
+			t.Fatalf("%q encodes again as %q", out, again)
+		}
+	})
+}
+
+func FuzzDecodeVmapLazy(f *testing.F) {
+	addSeedCorpus(f, "testVmap2.xml", "testVmapEmptyVast.xml")
+	f.Fuzz(func(t *testing.T, doc []byte) {
+		for _, strict := range []bool{false, true} {
+			v, _, _ := DecodeVmapScanWithOptions(doc, DecodeOptions{Strict: strict, Lazy: true})
+			for i := range v.AdBreaks {
+				_, _, _ = v.AdBreaks[i].Vast()
+			}
+		}
+	})
+}
+
+func FuzzDecodeVmapWorkers(f *testing.F) {
+	addSeedCorpus(f, "testVmap2.xml", "testVmapEmptyVast.xml")
+	f.Fuzz(func(t *testing.T, doc []byte) {
+		_, _, _ = DecodeVmapScanWithOptions(doc, DecodeOptions{Workers: 4})
+		_, _, _ = DecodeVmapScanWithOptions(doc, DecodeOptions{Strict: true, Workers: 4})
+	})
+}
+
+func FuzzVmapDecoder(f *testing.F) {
+	addSeedCorpus(f, "testVmap2.xml", "testVmapEmptyVast.xml")
+	f.Fuzz(func(t *testing.T, doc []byte) {
+		d := NewVmapDecoder(bytes.NewReader(doc))
+		for {
+			if _, err := d.Next(); err != nil {
+				break
+			}
+		}
+		_ = d.VMAP()
+	})
+}
+
+func FuzzScan(f *testing.F) {
+	addSeedCorpus(f, "testVmap2.xml", "testVmapEmptyVast.xml", "testVast3.xml", "testVastSpecialChars.xml")
+	f.Fuzz(func(t *testing.T, doc []byte) {
+		_ = ScanVmap(doc, BaseHandler{})
+		_ = ScanVast(doc, BaseHandler{})
+	})
+}
+
+func FuzzDecoder(f *testing.F) {
+	addSeedCorpus(f, "testVmap2.xml", "testVmapEmptyVast.xml", "testVast3.xml", "testVastSpecialChars.xml")
+	decoders := newDecoders(f)
+	f.Fuzz(func(t *testing.T, doc []byte) {
+		for _, d := range decoders {
+			_, _ = d.DecodeVmap(doc)
+			_, _ = d.DecodeVast(doc)
+		}
+	})
+}
+
+func FuzzDurationRoundTrip(f *testing.F) {
+	for _, s := range []string{"00:00:05", "00:00:05.5", "100:00:00.123456789", "1:2:3", "00:00:10:500"} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		var d Duration
+		if d.UnmarshalText([]byte(s)) != nil {
+			return
+		}
+		out, err := d.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var back Duration
+		if err := back.UnmarshalText(out); err != nil || back != d {
+			t.Fatalf("%q -> %q -> %v, %v", s, out, back, err)
+		}
+	})
+}
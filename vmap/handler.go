@@ -0,0 +1,239 @@
+package vmap
+
+import "errors"
+
+// ErrStop may be returned by a Handler method to stop ScanVmap or ScanVast
+// early. The scan then returns nil.
+var ErrStop = errors.New("scan stopped by handler")
+
+// Handler receives the elements of a document, in document order, from
+// ScanVmap and ScanVast. Each element is passed as its struct with only its
+// attributes and text set: slices and pointers to child elements are left
+// nil, as the children are passed to their own methods after it. Strings
+// reference the input, as with DecodeVmapScan.
+//
+// A method returning an error stops the scan; see ErrStop. Embed
+// BaseHandler to implement only the methods needed.
+type Handler interface {
+	OnAdBreak(ab AdBreak) error
+	// OnBreakTracking receives the Tracking elements of an AdBreak.
+	OnBreakTracking(t TrackingEvent) error
+	OnAd(ad Ad) error
+	OnImpression(imp Impression) error
+	OnCreative(c Creative) error
+	// OnTracking receives the Tracking elements of a Creative.
+	OnTracking(t TrackingEvent) error
+	OnMediaFile(m MediaFile) error
+	OnClickThrough(ct ClickThrough) error
+	OnClickTracking(ct ClickTracking) error
+	OnCustomClick(cc CustomClick) error
+}
+
+// BaseHandler implements Handler, ignoring every element.
+type BaseHandler struct{}
+
+func (BaseHandler) OnAdBreak(AdBreak) error             { return nil }
+func (BaseHandler) OnBreakTracking(TrackingEvent) error { return nil }
+func (BaseHandler) OnAd(Ad) error                       { return nil }
+func (BaseHandler) OnImpression(Impression) error       { return nil }
+func (BaseHandler) OnCreative(Creative) error           { return nil }
+func (BaseHandler) OnTracking(TrackingEvent) error      { return nil }
+func (BaseHandler) OnMediaFile(MediaFile) error         { return nil }
+func (BaseHandler) OnClickThrough(ClickThrough) error   { return nil }
+func (BaseHandler) OnClickTracking(ClickTracking) error { return nil }
+func (BaseHandler) OnCustomClick(CustomClick) error     { return nil }
+
+// ScanVmap passes the elements of a VMAP document to h, without building a
+// VMAP. It finds the same elements as DecodeVmapScan: the AdBreak elements,
+// their Tracking elements and the elements of the VAST they hold, as nested
+// there. It likewise skips over malformed values. It returns ErrNoVMAP if
+// the document has no VMAP element.
+func ScanVmap(input []byte, h Handler) error {
+	s := scan{data: input}
+	found := false
+	for {
+		name, isEnd, selfClose := s.next()
+		if name == nil {
+			break
+		}
+		if isEnd {
+			continue
+		}
+		switch string(name) {
+		case "VMAP":
+			found = true
+		case "AdBreak":
+			if err := eventsAdBreak(&s, h, selfClose); err != nil {
+				return handlerErr(err)
+			}
+		}
+	}
+	if !found {
+		return ErrNoVMAP
+	}
+	return nil
+}
+
+// ScanVast passes the elements of a VAST document to h, without building a
+// VAST. It finds the same elements as DecodeVastScan, those of the VAST
+// element as nested there, and likewise skips over malformed values. It
+// returns ErrNoVAST if the document has no VAST element.
+func ScanVast(input []byte, h Handler) error {
+	s := scan{data: input}
+	found := false
+	for {
+		name, isEnd, selfClose := s.next()
+		if name == nil {
+			break
+		}
+		if !isEnd && string(name) == "VAST" {
+			found = true
+			if err := eventsVast(&s, h, selfClose); err != nil {
+				return handlerErr(err)
+			}
+		}
+	}
+	if !found {
+		return ErrNoVAST
+	}
+	return nil
+}
+
+// handlerErr returns the error to return for err from a Handler.
+func handlerErr(err error) error {
+	if errors.Is(err, ErrStop) {
+		return nil
+	}
+	return err
+}
+
+// The events functions below mirror the scanners of DecodeVmapScan: each
+// passes the element whose start tag was just read, then the elements the
+// scanner would decode within it, up to its end tag.
+
+func eventsAdBreak(s *scan, h Handler, closed bool) error {
+	var ab AdBreak
+	scanAdBreakAttrs(s, &ab)
+	s.endAttrs()
+	if err := h.OnAdBreak(ab); err != nil {
+		return err
+	}
+	for !closed {
+		name, isEnd, selfClose := s.next()
+		if name == nil || isEnd && string(name) == "AdBreak" {
+			break
+		}
+		if isEnd {
+			continue
+		}
+		var err error
+		switch string(name) {
+		case "VAST":
+			err = eventsVast(s, h, selfClose)
+		case "Tracking":
+			err = h.OnBreakTracking(scanTracking(s, nil))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func eventsVast(s *scan, h Handler, closed bool) error {
+	s.endAttrs()
+	for !closed {
+		name, isEnd, selfClose := s.next()
+		if name == nil || isEnd && string(name) == "VAST" {
+			break
+		}
+		if !isEnd && string(name) == "Ad" {
+			if err := eventsAd(s, h, selfClose); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func eventsAd(s *scan, h Handler, closed bool) error {
+	var ad Ad
+	scanAdAttrs(s, &ad)
+	s.endAttrs()
+	if err := h.OnAd(ad); err != nil {
+		return err
+	}
+	for !closed {
+		name, isEnd, selfClose := s.next()
+		if name == nil || isEnd && string(name) == "Ad" {
+			break
+		}
+		if !isEnd && string(name) == "InLine" {
+			if err := eventsInLine(s, h, selfClose); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func eventsInLine(s *scan, h Handler, closed bool) error {
+	s.endAttrs()
+	for !closed {
+		name, isEnd, selfClose := s.next()
+		if name == nil || isEnd && string(name) == "InLine" {
+			break
+		}
+		if isEnd {
+			continue
+		}
+		var err error
+		switch string(name) {
+		case "Creative":
+			err = eventsCreative(s, h, selfClose)
+		case "Impression":
+			err = h.OnImpression(scanImpression(s, nil))
+		case "Extension":
+			s.skipElement(name, selfClose)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func eventsCreative(s *scan, h Handler, closed bool) error {
+	var c Creative
+	scanCreativeAttrs(s, &c)
+	s.endAttrs()
+	if err := h.OnCreative(c); err != nil {
+		return err
+	}
+	for !closed {
+		name, isEnd, _ := s.next()
+		if name == nil || isEnd && string(name) == "Creative" {
+			break
+		}
+		if isEnd {
+			continue
+		}
+		var err error
+		switch string(name) {
+		case "Tracking":
+			err = h.OnTracking(scanTracking(s, nil))
+		case "MediaFile":
+			err = h.OnMediaFile(scanMediaFile(s, nil))
+		case "ClickThrough":
+			err = h.OnClickThrough(ClickThrough(scanClick(s, nil)))
+		case "ClickTracking":
+			err = h.OnClickTracking(scanClick(s, nil))
+		case "CustomClick":
+			err = h.OnCustomClick(CustomClick(scanClick(s, nil)))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package vmap
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+// collector records the elements passed to it.
+type collector struct {
+	BaseHandler
+	breaks, breakTracking, ads, creatives, tracking, mediaFiles, clicks []string
+	stopAfterAds                                                        int
+}
+
+func (c *collector) OnAdBreak(ab AdBreak) error {
+	c.breaks = append(c.breaks, ab.Id)
+	return nil
+}
+
+func (c *collector) OnBreakTracking(t TrackingEvent) error {
+	c.breakTracking = append(c.breakTracking, t.Text)
+	return nil
+}
+
+func (c *collector) OnAd(ad Ad) error {
+	c.ads = append(c.ads, ad.Id)
+	if len(c.ads) == c.stopAfterAds {
+		return ErrStop
+	}
+	return nil
+}
+
+func (c *collector) OnCreative(cr Creative) error {
+	c.creatives = append(c.creatives, cr.Id)
+	return nil
+}
+
+func (c *collector) OnTracking(t TrackingEvent) error {
+	c.tracking = append(c.tracking, t.Event+" "+t.Text)
+	return nil
+}
+
+func (c *collector) OnMediaFile(m MediaFile) error {
+	c.mediaFiles = append(c.mediaFiles, m.Text)
+	return nil
+}
+
+func (c *collector) OnClickThrough(ct ClickThrough) error {
+	c.clicks = append(c.clicks, ct.Text)
+	return nil
+}
+
+func (c *collector) OnClickTracking(ct ClickTracking) error {
+	c.clicks = append(c.clicks, ct.Text)
+	return nil
+}
+
+func TestScanVmap(t *testing.T) {
+	for _, name := range []string{"testVmap.xml", "testVmap2.xml", "testVmapEmptyVast.xml"} {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			doc, err := os.ReadFile("sample-vmap/" + name)
+			is.NoErr(err)
+			v, err := DecodeVmapScan(doc)
+			is.NoErr(err)
+
+			// The same elements as in the decoded document.
+			var want collector
+			for _, ab := range v.AdBreaks {
+				want.breaks = append(want.breaks, ab.Id)
+				for _, te := range ab.TrackingEvents {
+					want.breakTracking = append(want.breakTracking, te.Text)
+				}
+				if ab.AdSource == nil || ab.AdSource.VASTData == nil || ab.AdSource.VASTData.VAST == nil {
+					continue
+				}
+				for _, ad := range ab.AdSource.VASTData.VAST.Ad {
+					want.ads = append(want.ads, ad.Id)
+					if ad.InLine == nil {
+						continue
+					}
+					for _, c := range ad.InLine.Creatives {
+						want.creatives = append(want.creatives, c.Id)
+						if c.Linear == nil {
+							continue
+						}
+						for _, te := range c.Linear.TrackingEvents {
+							want.tracking = append(want.tracking, te.Event+" "+te.Text)
+						}
+						for _, m := range c.Linear.MediaFiles {
+							want.mediaFiles = append(want.mediaFiles, m.Text)
+						}
+						if c.Linear.ClickThrough != nil {
+							want.clicks = append(want.clicks, c.Linear.ClickThrough.Text)
+						}
+						for _, ct := range c.Linear.ClickTracking {
+							want.clicks = append(want.clicks, ct.Text)
+						}
+					}
+				}
+			}
+
+			var got collector
+			is.NoErr(ScanVmap(doc, &got))
+			is.Equal(got, want)
+		})
+	}
+}
+
+func TestScanVast(t *testing.T) {
+	is := is.New(t)
+	doc, err := os.ReadFile("sample-vmap/testVast.xml")
+	is.NoErr(err)
+	v, err := DecodeVastScan(doc)
+	is.NoErr(err)
+
+	var got collector
+	is.NoErr(ScanVast(doc, &got))
+	is.Equal(len(got.ads), len(v.Ad))
+	is.Equal(got.breakTracking, nil)
+
+	is.Equal(ScanVast([]byte(`<VMAP/>`), &got), ErrNoVAST)
+	is.Equal(ScanVmap([]byte(`<VAST/>`), &got), ErrNoVMAP)
+}
+
+func TestScanVmapContext(t *testing.T) {
+	is := is.New(t)
+
+	// A VAST document holds no VMAP, so none of its elements are passed.
+	doc, err := os.ReadFile("sample-vmap/testVast.xml")
+	is.NoErr(err)
+	var got collector
+	is.Equal(ScanVmap(doc, &got), ErrNoVMAP)
+	is.Equal(got, collector{})
+
+	// Elements are passed only where DecodeVmapScan decodes them: not outside
+	// an AdBreak or InLine, nor after the end tag of a nested VAST.
+	doc = []byte(`<VMAP><Ad id="outside"/><AdBreak breakId="a"/>` +
+		`<AdBreak breakId="b"><AdSource><VASTAdData><VAST><Ad id="1"><Wrapper><Creatives>` +
+		`<Creative id="wrapped"/></Creatives></Wrapper></Ad>` +
+		`<Ad id="2"><InLine><Creatives><Creative id="c"><Linear><MediaFiles><MediaFile>m</MediaFile>` +
+		`</MediaFiles></Linear></Creative></Creatives></InLine></Ad></VAST></VASTAdData></AdSource>` +
+		`<Creative id="after"/></AdBreak></VMAP>`)
+	v, err := DecodeVmapScan(doc)
+	is.NoErr(err)
+	is.Equal(len(v.AdBreaks), 2) // the self-closing AdBreak holds nothing
+	got = collector{}
+	is.NoErr(ScanVmap(doc, &got))
+	is.Equal(got.breaks, []string{"a", "b"})
+	is.Equal(got.ads, []string{"1", "2"})
+	is.Equal(got.creatives, []string{"c"})
+	is.Equal(got.mediaFiles, []string{"m"})
+}
+
+func TestScanVmapStop(t *testing.T) {
+	is := is.New(t)
+	doc, err := os.ReadFile("sample-vmap/testVmap.xml")
+	is.NoErr(err)
+
+	c := collector{stopAfterAds: 1}
+	is.NoErr(ScanVmap(doc, &c))
+	is.Equal(len(c.ads), 1)
+	is.Equal(c.creatives, nil) // stopped before the creatives of the first ad
+
+	errBoom := errors.New("boom")
+	err = ScanVmap(doc, failingHandler{err: errBoom})
+	is.Equal(err, errBoom)
+}
+
+type failingHandler struct {
+	BaseHandler
+	err error
+}
+
+func (h failingHandler) OnCreative(Creative) error { return h.err }
+
+// countingHandler counts elements without keeping them.
+type countingHandler struct {
+	BaseHandler
+	n *int
+}
+
+func (h countingHandler) OnTracking(TrackingEvent) error {
+	*h.n++
+	return nil
+}
+
+func (h countingHandler) OnMediaFile(MediaFile) error {
+	*h.n++
+	return nil
+}
+
+func TestScanVmapAllocs(t *testing.T) {
+	doc, err := os.ReadFile("sample-vmap/testVmap.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	h := countingHandler{n: &n}
+	allocs := testing.AllocsPerRun(10, func() {
+		_ = ScanVmap(doc, h)
+	})
+	if allocs != 0 {
+		t.Errorf("ScanVmap allocated %v times per run", allocs)
+	}
+	if n == 0 {
+		t.Error("no elements scanned")
+	}
+}
+
+func BenchmarkScanVmapHandler(b *testing.B) {
+	doc, err := os.ReadFile("sample-vmap/testVmap.xml")
+	if err != nil {
+		b.Fatal(err)
+	}
+	n := 0
+	h := countingHandler{n: &n}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = ScanVmap(doc, h)
+	}
+}
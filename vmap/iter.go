@@ -0,0 +1,147 @@
+package vmap
+
+import "iter"
+
+// Location is where an element is in a document: the AdBreak, Ad and
+// Creative it belongs to. Those that do not apply are nil: AdBreak in a
+// VAST document, Ad and Creative for the tracking events of an AdBreak.
+type Location struct {
+	AdBreak  *AdBreak
+	Ad       *Ad
+	Creative *Creative
+}
+
+// Ads yields the inline ads of every break, with their break, in document
+// order.
+func (v *VMAP) Ads() iter.Seq2[*AdBreak, *Ad] {
+	return func(yield func(*AdBreak, *Ad) bool) {
+		for i := range v.AdBreaks {
+			ab := &v.AdBreaks[i]
+			vast := ab.vast()
+			if vast == nil {
+				continue
+			}
+			for j := range vast.Ad {
+				if !yield(ab, &vast.Ad[j]) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Creatives yields the creatives of every inline ad of every break, with
+// their ad, in document order.
+func (v *VMAP) Creatives() iter.Seq2[*Ad, *Creative] {
+	return func(yield func(*Ad, *Creative) bool) {
+		for _, ad := range v.Ads() {
+			if !ad.yieldCreatives(yield) {
+				return
+			}
+		}
+	}
+}
+
+// MediaFiles yields the media files of every linear creative in the
+// document, with their creative, in document order.
+func (v *VMAP) MediaFiles() iter.Seq2[*Creative, *MediaFile] {
+	return func(yield func(*Creative, *MediaFile) bool) {
+		for _, c := range v.Creatives() {
+			if !c.yieldMediaFiles(yield) {
+				return
+			}
+		}
+	}
+}
+
+// TrackingEvents yields every tracking event in the document with its
+// location, in document order: those of the creatives of a break before
+// those of the break itself.
+func (v *VMAP) TrackingEvents() iter.Seq2[Location, *TrackingEvent] {
+	return func(yield func(Location, *TrackingEvent) bool) {
+		for i := range v.AdBreaks {
+			ab := &v.AdBreaks[i]
+			if vast := ab.vast(); vast != nil && !vast.yieldTrackingEvents(ab, yield) {
+				return
+			}
+			for j := range ab.TrackingEvents {
+				if !yield(Location{AdBreak: ab}, &ab.TrackingEvents[j]) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Creatives yields the creatives of every inline ad, with their ad, in
+// document order.
+func (v *VAST) Creatives() iter.Seq2[*Ad, *Creative] {
+	return func(yield func(*Ad, *Creative) bool) {
+		for i := range v.Ad {
+			if !v.Ad[i].yieldCreatives(yield) {
+				return
+			}
+		}
+	}
+}
+
+// MediaFiles yields the media files of every linear creative, with their
+// creative, in document order.
+func (v *VAST) MediaFiles() iter.Seq2[*Creative, *MediaFile] {
+	return func(yield func(*Creative, *MediaFile) bool) {
+		for _, c := range v.Creatives() {
+			if !c.yieldMediaFiles(yield) {
+				return
+			}
+		}
+	}
+}
+
+// TrackingEvents yields the tracking events of every linear creative with
+// their location, in document order.
+func (v *VAST) TrackingEvents() iter.Seq2[Location, *TrackingEvent] {
+	return func(yield func(Location, *TrackingEvent) bool) {
+		v.yieldTrackingEvents(nil, yield)
+	}
+}
+
+// The yield helpers below report false once yield has asked to stop.
+
+func (ad *Ad) yieldCreatives(yield func(*Ad, *Creative) bool) bool {
+	if ad.InLine == nil {
+		return true
+	}
+	for i := range ad.InLine.Creatives {
+		if !yield(ad, &ad.InLine.Creatives[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Creative) yieldMediaFiles(yield func(*Creative, *MediaFile) bool) bool {
+	if c.Linear == nil {
+		return true
+	}
+	for i := range c.Linear.MediaFiles {
+		if !yield(c, &c.Linear.MediaFiles[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (v *VAST) yieldTrackingEvents(ab *AdBreak, yield func(Location, *TrackingEvent) bool) bool {
+	for ad, c := range v.Creatives() {
+		if c.Linear == nil {
+			continue
+		}
+		loc := Location{AdBreak: ab, Ad: ad, Creative: c}
+		for i := range c.Linear.TrackingEvents {
+			if !yield(loc, &c.Linear.TrackingEvents[i]) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,152 @@
+package vmap
+
+import (
+	"os"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+// holeyVmap has a nil at every layer between a break and its media files.
+func holeyVmap() *VMAP {
+	linear := func(url string) *Linear {
+		return &Linear{
+			TrackingEvents: []TrackingEvent{{Event: EventStart, Text: url + "/start"}},
+			MediaFiles:     []MediaFile{{Text: url + ".mp4"}},
+		}
+	}
+	return &VMAP{AdBreaks: []AdBreak{
+		{Id: "no-source"},
+		{Id: "no-data", AdSource: &AdSource{}},
+		{Id: "no-vast", AdSource: &AdSource{VASTData: &VASTData{}}},
+		{
+			Id:             "full",
+			TrackingEvents: []TrackingEvent{{Event: EventBreakStart, Text: "http://t/bs"}},
+			AdSource: &AdSource{VASTData: &VASTData{VAST: &VAST{Ad: []Ad{
+				{Id: "wrapper"},
+				{Id: "a1", InLine: &InLine{Creatives: []Creative{
+					{Id: "companion"},
+					{Id: "c1", Linear: linear("http://t/c1")},
+				}}},
+				{Id: "a2", InLine: &InLine{Creatives: []Creative{
+					{Id: "c2", Linear: linear("http://t/c2")},
+				}}},
+			}}}},
+		},
+	}}
+}
+
+func TestVmapIterators(t *testing.T) {
+	is := is.New(t)
+	v := holeyVmap()
+
+	var ads []string
+	for ab, ad := range v.Ads() {
+		ads = append(ads, ab.Id+"/"+ad.Id)
+	}
+	is.Equal(ads, []string{"full/wrapper", "full/a1", "full/a2"})
+
+	var creatives []string
+	for ad, c := range v.Creatives() {
+		creatives = append(creatives, ad.Id+"/"+c.Id)
+	}
+	is.Equal(creatives, []string{"a1/companion", "a1/c1", "a2/c2"})
+
+	var media []string
+	for c, m := range v.MediaFiles() {
+		media = append(media, c.Id+" "+m.Text)
+	}
+	is.Equal(media, []string{"c1 http://t/c1.mp4", "c2 http://t/c2.mp4"})
+
+	type located struct {
+		breakId, ad, creative, url string
+	}
+	var events []located
+	for loc, te := range v.TrackingEvents() {
+		l := located{breakId: loc.AdBreak.Id, url: te.Text}
+		if loc.Ad != nil {
+			l.ad, l.creative = loc.Ad.Id, loc.Creative.Id
+		}
+		events = append(events, l)
+	}
+	is.Equal(events, []located{
+		{"full", "a1", "c1", "http://t/c1/start"},
+		{"full", "a2", "c2", "http://t/c2/start"},
+		{"full", "", "", "http://t/bs"},
+	})
+}
+
+func TestIteratorsStopEarly(t *testing.T) {
+	is := is.New(t)
+	v := holeyVmap()
+	n := 0
+	for range v.Ads() {
+		n++
+		break
+	}
+	for range v.Creatives() {
+		n++
+		break
+	}
+	for range v.MediaFiles() {
+		n++
+		break
+	}
+	for range v.TrackingEvents() {
+		n++
+		break
+	}
+	is.Equal(n, 4)
+}
+
+func TestIteratorsYieldPointers(t *testing.T) {
+	is := is.New(t)
+	v := holeyVmap()
+	for _, m := range v.MediaFiles() {
+		m.Delivery = "progressive"
+	}
+	vast := v.AdBreaks[3].AdSource.VASTData.VAST
+	for _, m := range vast.MediaFiles() {
+		is.Equal(m.Delivery, "progressive")
+	}
+}
+
+func TestVastIterators(t *testing.T) {
+	is := is.New(t)
+	doc, err := os.ReadFile("sample-vmap/testVast.xml")
+	is.NoErr(err)
+	vast, err := DecodeVast(doc)
+	is.NoErr(err)
+
+	var creatives, media, tracking int
+	for _, ad := range vast.Ad {
+		if ad.InLine == nil {
+			continue
+		}
+		for _, c := range ad.InLine.Creatives {
+			creatives++
+			if c.Linear != nil {
+				media += len(c.Linear.MediaFiles)
+				tracking += len(c.Linear.TrackingEvents)
+			}
+		}
+	}
+	is.True(media > 0)
+
+	n := 0
+	for range vast.Creatives() {
+		n++
+	}
+	is.Equal(n, creatives)
+	n = 0
+	for range vast.MediaFiles() {
+		n++
+	}
+	is.Equal(n, media)
+	n = 0
+	for loc := range vast.TrackingEvents() {
+		is.Equal(loc.AdBreak, nil)
+		n++
+	}
+	is.Equal(n, tracking)
+}
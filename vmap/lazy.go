@@ -0,0 +1,110 @@
+package vmap
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"sync"
+)
+
+// lazyVast is the VAST element of an AdBreak decoded with DecodeOptions.Lazy,
+// until AdBreak.Vast decodes it.
+type lazyVast struct {
+	mu       sync.Mutex
+	data     []byte // the input up to the end of the VAST element
+	start    int    // offset of the VAST start tag in data
+	warnAt   int    // number of warnings of the VMAP before the VAST
+	strict   bool
+	lossless bool
+	limits   *Limits // those checked on values, nil without
+	done     bool
+	warnings []error
+	err      error
+}
+
+// Vast returns the inline VAST of the break, or nil if it has none.
+//
+// For a break decoded with DecodeOptions.Lazy, the first call decodes the
+// VAST with the options the VMAP was decoded with and stores it in
+// AdSource.VASTData.VAST; later calls return the same VAST, warnings and
+// error. As with DecodeVmapScanWithOptions, problems found in the VAST are
+// returned as warnings, or in strict mode the first one as err. Vast may be
+// called concurrently, but the field must not be read directly before a
+// call has returned. Otherwise the warnings and error are nil.
+//
+// Everything that reads the VASTs of a VMAP calls Vast for each break it
+// visits, and so stores the decoded VAST: MarshalVmap and the other encoder
+// functions, EstimateVmapSize, the iterators, Walk and RewriteURLs,
+// NewTracker, and xml.Marshal and json.Marshal. Of these, only the
+// marshalers report a VAST that fails to decode; call Vast first to see
+// warnings and errors.
+func (ab *AdBreak) Vast() (*VAST, []error, error) {
+	var warnings []error
+	var err error
+	if l := ab.lazy; l != nil {
+		l.mu.Lock()
+		if !l.done {
+			vast, vastWarnings, decodeErr := l.decode()
+			l.data, l.done, l.warnings, l.err = nil, true, vastWarnings, decodeErr
+			if ab.AdSource == nil {
+				ab.AdSource = &AdSource{}
+			}
+			if ab.AdSource.VASTData == nil {
+				ab.AdSource.VASTData = &VASTData{}
+			}
+			ab.AdSource.VASTData.VAST = vast
+		}
+		warnings, err = l.warnings, l.err
+		l.mu.Unlock()
+	}
+	if ab.AdSource == nil || ab.AdSource.VASTData == nil {
+		return nil, warnings, err
+	}
+	return ab.AdSource.VASTData.VAST, warnings, err
+}
+
+// adBreak has the fields of AdBreak but not its marshalers.
+type adBreak AdBreak
+
+// MarshalXML encodes the break as encoding/xml does by default, once Vast
+// has decoded the VAST of a lazily decoded break, failing if it does not
+// decode.
+func (ab *AdBreak) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if _, _, err := ab.Vast(); err != nil {
+		return err
+	}
+	return e.EncodeElement((*adBreak)(ab), start)
+}
+
+// MarshalJSON encodes the break as encoding/json does by default, once Vast
+// has decoded the VAST of a lazily decoded break, failing if it does not
+// decode.
+func (ab *AdBreak) MarshalJSON() ([]byte, error) {
+	if _, _, err := ab.Vast(); err != nil {
+		return nil, err
+	}
+	return json.Marshal((*adBreak)(ab))
+}
+
+func (l *lazyVast) decode() (*VAST, []error, error) {
+	s := scan{data: l.data, pos: l.start, strict: l.strict, lossless: l.lossless, limit: newLimiter(l.limits)}
+	_, _, selfClose := s.next()
+	vast := &VAST{}
+	scanVast(&s, vast, selfClose)
+	return vast, s.warnings, s.err
+}
+
+// clone copies l. The VAST source of an undecoded break is copied on its
+// own, so problems found in it are located within the VAST element rather
+// than the whole document.
+func (l *lazyVast) clone() *lazyVast {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.done {
+		return &lazyVast{done: true, warnings: l.warnings, err: l.err}
+	}
+	return &lazyVast{data: bytes.Clone(l.data[l.start:]), strict: l.strict, lossless: l.lossless, limits: l.limits}
+}
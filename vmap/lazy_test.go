@@ -0,0 +1,195 @@
+package vmap
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestDecodeVmapLazy(t *testing.T) {
+	is := is.New(t)
+	doc, err := os.ReadFile("sample-vmap/testVmap.xml")
+	is.NoErr(err)
+	want, err := DecodeVmapScan(doc)
+	is.NoErr(err)
+
+	v, warnings, err := DecodeVmapScanWithOptions(doc, DecodeOptions{Lazy: true})
+	is.NoErr(err)
+	is.Equal(len(warnings), 0)
+	is.Equal(len(v.AdBreaks), len(want.AdBreaks))
+	for i := range v.AdBreaks {
+		ab := &v.AdBreaks[i]
+		is.Equal(ab.Id, want.AdBreaks[i].Id)
+		is.Equal(ab.TimeOffset, want.AdBreaks[i].TimeOffset)
+		is.Equal(ab.TrackingEvents, want.AdBreaks[i].TrackingEvents)
+		is.Equal(ab.AdSource.VASTData.VAST, nil) // not decoded yet
+
+		vast, warnings, err := ab.Vast()
+		is.NoErr(err)
+		is.Equal(len(warnings), 0)
+		is.Equal(*vast, *want.AdBreaks[i].AdSource.VASTData.VAST)
+		is.Equal(ab.AdSource.VASTData.VAST, vast)
+		again, _, err := ab.Vast()
+		is.NoErr(err)
+		is.True(again == vast) // cached
+	}
+}
+
+func TestDecodeVmapLazyEncode(t *testing.T) {
+	is := is.New(t)
+	for _, f := range []string{"testVmap.xml", "testVmap2.xml", "testVmapEmptyVast.xml"} {
+		doc, err := os.ReadFile("sample-vmap/" + f)
+		is.NoErr(err)
+		want, err := DecodeVmapScan(doc)
+		is.NoErr(err)
+
+		// The encoder and iterators decode the breaks they need.
+		v, _, err := DecodeVmapScanWithOptions(doc, DecodeOptions{Lazy: true})
+		is.NoErr(err)
+		is.Equal(encodeString(t, v), encodeString(t, want)) // f
+		v, _, err = DecodeVmapScanWithOptions(doc, DecodeOptions{Lazy: true})
+		is.NoErr(err)
+		n := 0
+		for range v.MediaFiles() {
+			n++
+		}
+		m := 0
+		for range want.MediaFiles() {
+			m++
+		}
+		is.Equal(n, m) // f
+	}
+}
+
+func TestDecodeVmapLazyStrict(t *testing.T) {
+	is := is.New(t)
+	doc := []byte(`<VMAP version="1.0"><AdBreak breakId="a" timeOffset="start"><AdSource><VASTAdData>` +
+		`<VAST version="4.0"><Ad><InLine><Creatives><Creative><Linear><Duration>bad</Duration>` +
+		`</Linear></Creative></Creatives></InLine></Ad></VAST></VASTAdData></AdSource></AdBreak></VMAP>`)
+	_, _, wantErr := DecodeVmapScanWithOptions(doc, DecodeOptions{Strict: true})
+	is.True(wantErr != nil)
+
+	v, _, err := DecodeVmapScanWithOptions(doc, DecodeOptions{Strict: true, Lazy: true})
+	is.NoErr(err) // the VAST is not looked at yet
+	_, _, err = v.AdBreaks[0].Vast()
+	is.Equal(err.Error(), wantErr.Error()) // located within the whole document
+	var derr *DecodeError
+	is.True(errors.As(err, &derr))
+	_, _, again := v.AdBreaks[0].Vast()
+	is.Equal(again, err)
+
+	// The std marshalers fail rather than leave the VAST out.
+	v, _, err = DecodeVmapScanWithOptions(doc, DecodeOptions{Strict: true, Lazy: true})
+	is.NoErr(err)
+	_, err = json.Marshal(v)
+	is.True(errors.As(err, &derr))
+	is.Equal(derr.Error(), wantErr.Error())
+	_, err = xml.Marshal(v)
+	is.True(errors.As(err, &derr))
+	is.Equal(derr.Error(), wantErr.Error())
+}
+
+func TestDecodeVmapLazyWarnings(t *testing.T) {
+	is := is.New(t)
+	doc := []byte(`<VMAP version="1.0"><AdBreak breakId="a" timeOffset="start"><AdSource><VASTAdData>` +
+		`<VAST version="4.0"><Ad sequence="x"><InLine><Creatives><Creative><Linear><Duration>bad</Duration>` +
+		`</Linear></Creative></Creatives></InLine></Ad></VAST></VASTAdData></AdSource></AdBreak></VMAP>`)
+	_, want, err := DecodeVmapScanWithOptions(doc, DecodeOptions{})
+	is.NoErr(err)
+	is.Equal(len(want), 2)
+
+	v, warnings, err := DecodeVmapScanWithOptions(doc, DecodeOptions{Lazy: true})
+	is.NoErr(err)
+	is.Equal(len(warnings), 0) // the VAST is not looked at yet
+	vast, warnings, err := v.AdBreaks[0].Vast()
+	is.NoErr(err)
+	is.Equal(vast.Version, "4.0")
+	is.Equal(fmt.Sprint(warnings), fmt.Sprint(want))
+	_, again, _ := v.AdBreaks[0].Vast()
+	is.Equal(fmt.Sprint(again), fmt.Sprint(want))
+}
+
+func TestDecodeVmapLazyMarshal(t *testing.T) {
+	is := is.New(t)
+	doc, err := os.ReadFile("sample-vmap/testVmap.xml")
+	is.NoErr(err)
+	want, err := DecodeVmapScan(doc)
+	is.NoErr(err)
+	wantXML, err := xml.Marshal(want)
+	is.NoErr(err)
+	wantJSON, err := json.Marshal(want)
+	is.NoErr(err)
+
+	v, _, err := DecodeVmapScanWithOptions(doc, DecodeOptions{Lazy: true})
+	is.NoErr(err)
+	got, err := xml.Marshal(v)
+	is.NoErr(err)
+	is.Equal(string(got), string(wantXML))
+	v, _, err = DecodeVmapScanWithOptions(doc, DecodeOptions{Lazy: true})
+	is.NoErr(err)
+	got, err = json.Marshal(v)
+	is.NoErr(err)
+	is.Equal(string(got), string(wantJSON))
+}
+
+func TestDecodeVmapLazyConcurrent(t *testing.T) {
+	is := is.New(t)
+	doc, err := os.ReadFile("sample-vmap/testVmap.xml")
+	is.NoErr(err)
+	v, _, err := DecodeVmapScanWithOptions(doc, DecodeOptions{Lazy: true})
+	is.NoErr(err)
+
+	var wg sync.WaitGroup
+	got := make([]*VAST, 8)
+	for i := range got {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got[i], _, _ = v.AdBreaks[0].Vast()
+		}()
+	}
+	wg.Wait()
+	for i := range got {
+		is.True(got[i] == got[0])
+	}
+}
+
+func TestDecodeVmapLazyDetached(t *testing.T) {
+	is := is.New(t)
+	doc, err := os.ReadFile("sample-vmap/testVmap.xml")
+	is.NoErr(err)
+	want, err := DecodeVmapScan(append([]byte(nil), doc...))
+	is.NoErr(err)
+
+	buf := append([]byte(nil), doc...)
+	copied, _, err := DecodeVmapScanWithOptions(buf, DecodeOptions{Lazy: true, CopyStrings: true})
+	is.NoErr(err)
+	buf = append(buf[:0], doc...)
+	lazy, _, err := DecodeVmapScanWithOptions(buf, DecodeOptions{Lazy: true})
+	is.NoErr(err)
+	_, _, _ = lazy.AdBreaks[1].Vast()
+	cloned := lazy.Clone()
+	clear(buf)
+
+	is.Equal(encodeString(t, copied), encodeString(t, want))
+	is.Equal(encodeString(t, cloned), encodeString(t, want))
+}
+
+func BenchmarkScanDecodeLazy(b *testing.B) {
+	doc, err := os.ReadFile("sample-vmap/testVmap.xml")
+	if err != nil {
+		panic(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _, _ = DecodeVmapScanWithOptions(doc, DecodeOptions{Lazy: true})
+	}
+}
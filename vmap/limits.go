@@ -0,0 +1,206 @@
+package vmap
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+)
+
+// Limits bounds what decoding a document may take, for documents from
+// untrusted sources. A zero field means no limit. Exceeding a limit fails
+// decoding with a *LimitError, also when not decoding strictly.
+type Limits struct {
+	// MaxBytes is the length of the largest input accepted.
+	MaxBytes int
+	// MaxDepth is the deepest nesting of elements accepted, counting the
+	// root element as 1.
+	MaxDepth int
+
+	// The most elements of each kind accepted in a document, counted
+	// wherever they are found: AdBreak, Ad, Creative, MediaFile, Tracking
+	// and Impression elements.
+	MaxAdBreaks       int
+	MaxAds            int
+	MaxCreatives      int
+	MaxMediaFiles     int
+	MaxTrackingEvents int
+	MaxImpressions    int
+
+	// MaxAttrLen and MaxTextLen are the lengths of the longest attribute
+	// value and text accepted, in bytes as found in the input. The scan
+	// decoders only check the values they decode.
+	MaxAttrLen int
+	MaxTextLen int
+}
+
+// DefaultLimits are limits generous enough for real VMAP and VAST
+// documents, for use with documents from untrusted sources.
+var DefaultLimits = Limits{
+	MaxBytes:          16 << 20,
+	MaxDepth:          64,
+	MaxAdBreaks:       2000,
+	MaxAds:            20000,
+	MaxCreatives:      50000,
+	MaxMediaFiles:     200000,
+	MaxTrackingEvents: 500000,
+	MaxImpressions:    100000,
+	MaxAttrLen:        16 << 10,
+	MaxTextLen:        64 << 10,
+}
+
+// LimitError is the error of a document exceeding one of its Limits.
+// Decoders return it wrapped in a *DecodeError locating where the limit was
+// exceeded, except for MaxBytes.
+type LimitError struct {
+	// Limit is the name of the field of Limits that was exceeded.
+	Limit string
+	// Max is its value.
+	Max int
+}
+
+func (e *LimitError) Error() string {
+	return "document exceeds " + e.Limit + " limit of " + strconv.Itoa(e.Max)
+}
+
+func isLimitError(err error) bool {
+	var lerr *LimitError
+	return errors.As(err, &lerr)
+}
+
+// checkBytes returns the error of input exceeding l.MaxBytes, or nil.
+func (l *Limits) checkBytes(input []byte) error {
+	if l.MaxBytes > 0 && len(input) > l.MaxBytes {
+		return &LimitError{Limit: "MaxBytes", Max: l.MaxBytes}
+	}
+	return nil
+}
+
+// lengths returns the limits of l that are checked on values rather than
+// tags, or nil if there are none.
+func (l *Limits) lengths() *Limits {
+	if l == nil || l.MaxAttrLen == 0 && l.MaxTextLen == 0 {
+		return nil
+	}
+	return &Limits{MaxAttrLen: l.MaxAttrLen, MaxTextLen: l.MaxTextLen}
+}
+
+// elementKind is a kind of element counted by Limits.
+type elementKind uint8
+
+const (
+	kindOther elementKind = iota
+	kindAdBreak
+	kindAd
+	kindCreative
+	kindMediaFile
+	kindTracking
+	kindImpression
+	numKinds
+)
+
+var kindLimits = [numKinds]string{
+	kindAdBreak:    "MaxAdBreaks",
+	kindAd:         "MaxAds",
+	kindCreative:   "MaxCreatives",
+	kindMediaFile:  "MaxMediaFiles",
+	kindTracking:   "MaxTrackingEvents",
+	kindImpression: "MaxImpressions",
+}
+
+func kindOf(name []byte) elementKind {
+	switch string(name) {
+	case "AdBreak":
+		return kindAdBreak
+	case "Ad":
+		return kindAd
+	case "Creative":
+		return kindCreative
+	case "MediaFile":
+		return kindMediaFile
+	case "Tracking":
+		return kindTracking
+	case "Impression":
+		return kindImpression
+	}
+	return kindOther
+}
+
+func (l *Limits) maxCount(k elementKind) int {
+	switch k {
+	case kindAdBreak:
+		return l.MaxAdBreaks
+	case kindAd:
+		return l.MaxAds
+	case kindCreative:
+		return l.MaxCreatives
+	case kindMediaFile:
+		return l.MaxMediaFiles
+	case kindTracking:
+		return l.MaxTrackingEvents
+	case kindImpression:
+		return l.MaxImpressions
+	}
+	return 0
+}
+
+// limiter enforces Limits on the tags and values of a document as a
+// decoder reads them. Both the tokenizer and the scan decoders use one.
+type limiter struct {
+	limits Limits
+	depth  int
+	counts [numKinds]int
+}
+
+// newLimiter returns a limiter for l, or nil if l has no limits on tags
+// and values.
+func newLimiter(l *Limits) *limiter {
+	if l == nil {
+		return nil
+	}
+	lim := *l
+	lim.MaxBytes = 0
+	if lim == (Limits{}) {
+		return nil
+	}
+	return &limiter{limits: lim}
+}
+
+// tag accounts for a tag, returning the error of a limit it exceeds.
+func (l *limiter) tag(name []byte, isEnd, selfClose bool) error {
+	if isEnd {
+		l.depth--
+		return nil
+	}
+	if !selfClose {
+		l.depth++
+		if n := l.limits.MaxDepth; n > 0 && l.depth > n {
+			return &LimitError{Limit: "MaxDepth", Max: n}
+		}
+	}
+	k := kindOf(name)
+	if k == kindOther {
+		return nil
+	}
+	l.counts[k]++
+	if n := l.limits.maxCount(k); n > 0 && l.counts[k] > n {
+		return &LimitError{Limit: kindLimits[k], Max: n}
+	}
+	return nil
+}
+
+// attr returns the error of an attribute value exceeding MaxAttrLen.
+func (l *limiter) attr(v []byte) error {
+	if n := l.limits.MaxAttrLen; n > 0 && len(v) > n {
+		return &LimitError{Limit: "MaxAttrLen", Max: n}
+	}
+	return nil
+}
+
+// text returns the error of text exceeding MaxTextLen. Surrounding
+// whitespace is not counted.
+func (l *limiter) text(b []byte) error {
+	if n := l.limits.MaxTextLen; n > 0 && len(b) > n && len(bytes.TrimSpace(b)) > n {
+		return &LimitError{Limit: "MaxTextLen", Max: n}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package vmap
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+// limitDecoders decode a VMAP document with options, in every way that
+// enforces limits.
+var limitDecoders = map[string]func(input []byte, opts DecodeOptions) error{
+	"tokenizer": func(input []byte, opts DecodeOptions) error {
+		_, err := DecodeVmapWithOptions(input, opts)
+		return err
+	},
+	"scan": func(input []byte, opts DecodeOptions) error {
+		_, _, err := DecodeVmapScanWithOptions(input, opts)
+		return err
+	},
+	"lazy": func(input []byte, opts DecodeOptions) error {
+		opts.Lazy = true
+		v, _, err := DecodeVmapScanWithOptions(input, opts)
+		for i := 0; err == nil && i < len(v.AdBreaks); i++ {
+			_, _, err = v.AdBreaks[i].Vast()
+		}
+		return err
+	},
+	"workers": func(input []byte, opts DecodeOptions) error {
+		opts.Workers = 4
+		_, _, err := DecodeVmapScanWithOptions(input, opts)
+		return err
+	},
+}
+
+func TestDecodeLimits(t *testing.T) {
+	doc, err := os.ReadFile("sample-vmap/testVmap.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := `<VMAP><AdBreak breakId="` + strings.Repeat("x", 100) + `"><AdSource><VASTAdData><VAST><Ad><InLine>` +
+		`<AdTitle><![CDATA[` + strings.Repeat("y", 100) + `]]></AdTitle></InLine></Ad></VAST></VASTAdData>` +
+		`</AdSource></AdBreak></VMAP>`
+
+	tests := []struct {
+		name   string
+		doc    string
+		limits Limits
+		want   string // the Limit of the error, or "" for none
+	}{
+		{"default", string(doc), DefaultLimits, ""},
+		{"bytes", string(doc), Limits{MaxBytes: 1000}, "MaxBytes"},
+		{"depth", string(doc), Limits{MaxDepth: 8}, "MaxDepth"},
+		{"deep enough", string(doc), Limits{MaxDepth: 12}, ""},
+		{"breaks", string(doc), Limits{MaxAdBreaks: 2}, "MaxAdBreaks"},
+		{"ads", string(doc), Limits{MaxAds: 10}, "MaxAds"},
+		{"creatives", string(doc), Limits{MaxCreatives: 3}, "MaxCreatives"},
+		{"media files", string(doc), Limits{MaxMediaFiles: 5}, "MaxMediaFiles"},
+		{"tracking", string(doc), Limits{MaxTrackingEvents: 20}, "MaxTrackingEvents"},
+		{"impressions", string(doc), Limits{MaxImpressions: 1}, "MaxImpressions"},
+		{"attr", long, Limits{MaxAttrLen: 50}, "MaxAttrLen"},
+		{"text", long, Limits{MaxTextLen: 50}, "MaxTextLen"},
+		{"long enough", long, Limits{MaxAttrLen: 100, MaxTextLen: 100}, ""},
+	}
+	for _, tt := range tests {
+		scanErr := limitDecoders["scan"]([]byte(tt.doc), DecodeOptions{Limits: tt.limits})
+		for name, decode := range limitDecoders {
+			t.Run(tt.name+"/"+name, func(t *testing.T) {
+				is := is.New(t)
+				err := decode([]byte(tt.doc), DecodeOptions{Limits: tt.limits})
+				if tt.want == "" {
+					is.NoErr(err)
+					return
+				}
+				var lerr *LimitError
+				is.True(errors.As(err, &lerr)) // a LimitError
+				is.Equal(lerr.Limit, tt.want)
+				var derr *DecodeError
+				is.Equal(errors.As(err, &derr), tt.want != "MaxBytes") // located, but for MaxBytes
+				if name != "tokenizer" {
+					is.Equal(err.Error(), scanErr.Error()) // found where the sequential scan finds it
+				}
+			})
+		}
+	}
+}
+
+func TestDecodeLimitsLenient(t *testing.T) {
+	is := is.New(t)
+	doc, err := os.ReadFile("sample-vmap/testVmap.xml")
+	is.NoErr(err)
+
+	// Limits fail decoding, where other problems only give warnings.
+	v, warnings, err := DecodeVmapScanWithOptions(doc, DecodeOptions{Limits: Limits{MaxAdBreaks: 1}})
+	is.True(isLimitError(err))
+	is.Equal(len(warnings), 0)
+	is.Equal(len(v.AdBreaks), 1)
+	is.Equal(err.Error(), `VMAP/AdBreak[2] (line 341, column 3, offset 19313): document exceeds MaxAdBreaks limit of 1`)
+}
+
+func TestDecodeVastLimits(t *testing.T) {
+	is := is.New(t)
+	doc, err := os.ReadFile("sample-vmap/testVast.xml")
+	is.NoErr(err)
+
+	opts := DecodeOptions{Limits: Limits{MaxMediaFiles: 1}}
+	_, err = DecodeVastWithOptions(doc, opts)
+	is.True(isLimitError(err))
+	_, _, err = DecodeVastScanWithOptions(doc, opts)
+	is.True(isLimitError(err))
+
+	opts.Limits = DefaultLimits
+	_, err = DecodeVastWithOptions(doc, opts)
+	is.NoErr(err)
+	_, _, err = DecodeVastScanWithOptions(doc, opts)
+	is.NoErr(err)
+}
+
+func TestDecodeWithOptionsUnsupported(t *testing.T) {
+	doc, err := os.ReadFile("sample-vmap/testVmap.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range []DecodeOptions{
+		{Lossless: true},
+		{CopyStrings: true},
+		{Lazy: true},
+		{Workers: 4},
+	} {
+		is := is.New(t)
+		_, err := DecodeVmapWithOptions(doc, opts)
+		is.True(err != nil)
+		is.True(strings.Contains(err.Error(), "is not supported"))
+		_, err = DecodeVastWithOptions(doc, opts)
+		is.True(err != nil)
+	}
+	_, err = DecodeVmapWithOptions(doc, DecodeOptions{Strict: true, Limits: DefaultLimits})
+	if err != nil {
+		t.Fatal(err) // always strict
+	}
+}
@@ -0,0 +1,685 @@
+package vmap
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+)
+
+// Extra holds the markup of an element that has no field in its struct:
+// unknown attributes and unknown child elements, kept as raw XML, and how
+// the known ones were written. It is only filled by lossless decoding
+// (DecodeOptions.Lossless), and the fast encoder writes it back where it
+// was found.
+//
+// Elements without a struct of their own, such as the TrackingEvents
+// wrapper of a Linear or the AdSystem of an InLine, keep theirs in the
+// Extra of the struct they belong to, under their name.
+type Extra struct {
+	Attrs []RawAttrs
+	Nodes []RawNode
+	// Tags record how the element and the known elements kept under its
+	// name were written, for the fast encoder to write them the same way.
+	Tags []RawTag
+	// Prolog and Epilog are the markup before and after the root element,
+	// such as the XML declaration. They are kept in the Extra of the VMAP
+	// or VAST that is the root of the document.
+	Prolog string
+	Epilog string
+}
+
+// RawAttrs are unknown attributes of an element.
+type RawAttrs struct {
+	// In is the name of the element the attributes belong to, or "" for
+	// the element of the struct holding the Extra.
+	In string
+	// XML is the attributes as found in the input, each preceded by a
+	// space, e.g. ` skipoffset="00:00:05"`.
+	XML string
+}
+
+// RawNode is an unknown child element, or the whitespace, comments and
+// other markup found between child elements.
+type RawNode struct {
+	// In is the name of the element the node was found in, or "" for the
+	// element of the struct holding the Extra.
+	In string
+	// After is the number of known child elements before the node.
+	After int
+	// XML is the node as found in the input.
+	XML string
+}
+
+// RawTag is how a known element was written.
+type RawTag struct {
+	// In is the name of the element, or "" for the element of the struct
+	// holding the Extra.
+	In string
+	// Prefix is the namespace prefix of the name of the element, with its
+	// colon, e.g. "vmap:".
+	Prefix string
+	// Attrs are the names of the attributes of the element, known and
+	// unknown, in the order found, e.g. xmlns:vmap for VMAP.Vmap. Known
+	// attributes that are not named here are left out unless set.
+	Attrs []string
+	// Children are the names of the known child elements, in the order
+	// found; RawNode.After counts them. Known children that are not named
+	// here are written after them, unless empty.
+	Children []string
+	// CDATA reports that the text of the element was a CDATA section.
+	CDATA bool
+	// SelfClosing reports that the element was a self-closing tag, as it
+	// is written again while it has no content.
+	SelfClosing bool
+}
+
+func (x *Extra) hasNodes(in string) bool {
+	if x == nil {
+		return false
+	}
+	for i := range x.Nodes {
+		if x.Nodes[i].In == in {
+			return true
+		}
+	}
+	return false
+}
+
+// tag returns the RawTag x keeps for in, or nil.
+func (x *Extra) tag(in string) *RawTag {
+	if x == nil {
+		return nil
+	}
+	for i := range x.Tags {
+		if x.Tags[i].In == in {
+			return &x.Tags[i]
+		}
+	}
+	return nil
+}
+
+// --- decoding ---
+
+// tree tracks the known elements open inside the element a scan function
+// decodes, so that unknown markup found in lossless mode can be kept in
+// the struct it belongs to. A nil *tree, used when not decoding
+// losslessly, does nothing.
+type tree struct {
+	s      *scan
+	root   *Extra
+	frames []frame
+}
+
+// frame is an open element whose unknown markup goes to extra under in.
+type frame struct {
+	name  string
+	extra **Extra
+	in    string
+	n     int // known children seen so far
+}
+
+// newTree starts tracking the element whose start tag was just read,
+// keeping its attributes not named in known. It returns nil unless
+// decoding losslessly.
+func (s *scan) newTree(known ...string) *tree {
+	if !s.lossless {
+		return nil
+	}
+	s.gap = nil // kept by the parent
+	t := &tree{s: s}
+	t.frames = []frame{{extra: &t.root}}
+	t.record(&t.root, "", known, false)
+	return t
+}
+
+// extra returns the unknown markup of the element itself.
+func (t *tree) extra() *Extra {
+	if t == nil {
+		return nil
+	}
+	return t.root
+}
+
+func (t *tree) top() *frame {
+	return &t.frames[len(t.frames)-1]
+}
+
+// space keeps the markup skipped by the scan before the tag just read.
+func (t *tree) space() {
+	gap := t.s.gap
+	t.s.gap = nil
+	if len(gap) == 0 {
+		return
+	}
+	f := t.top()
+	x := *f.extra
+	x.Nodes = append(x.Nodes, RawNode{In: f.in, After: f.n, XML: byteStr(gap)})
+}
+
+// child counts a known child element decoded elsewhere.
+func (t *tree) child() {
+	if t == nil {
+		return
+	}
+	t.space()
+	f := t.top()
+	_, name := t.s.tagName()
+	if tag := (*f.extra).tag(f.in); tag != nil {
+		tag.Children = append(tag.Children, name)
+	}
+	f.n++
+}
+
+// leaf counts a known child element whose struct has attributes known, and
+// returns the Extra for the others.
+func (t *tree) leaf(known ...string) *Extra {
+	if t == nil {
+		return nil
+	}
+	t.child()
+	var x *Extra
+	t.record(&x, "", known, true)
+	return x
+}
+
+// text counts a known child element held in a plain field, such as
+// AdSystem, keeping its attributes.
+func (t *tree) text(name string) {
+	if t == nil {
+		return
+	}
+	t.child()
+	t.record(t.top().extra, name, nil, true)
+}
+
+// open counts a known child element that contains others. Its unknown
+// markup goes to extra, or, for a wrapper without a struct, when extra is
+// nil, to the Extra of the enclosing element under name.
+func (t *tree) open(name string, extra **Extra, selfClose bool) {
+	if t == nil {
+		return
+	}
+	t.child()
+	f := frame{name: name, extra: extra}
+	if extra == nil {
+		f.extra, f.in = t.top().extra, name
+	}
+	t.record(f.extra, f.in, nil, false)
+	if !selfClose {
+		t.frames = append(t.frames, f)
+	}
+}
+
+// end keeps the markup before the end tag just read, and closes the
+// innermost open element if it is named name.
+func (t *tree) end(name []byte) {
+	if t == nil {
+		return
+	}
+	t.space()
+	if len(t.frames) > 1 && t.top().name == string(name) {
+		t.frames = t.frames[:len(t.frames)-1]
+	}
+}
+
+// unknown keeps the unknown element whose start tag was just read and
+// skips past it. It reports false, doing nothing, unless decoding
+// losslessly.
+func (t *tree) unknown(name []byte, selfClose bool) bool {
+	if t == nil {
+		return false
+	}
+	t.space()
+	f := t.top()
+	raw := t.s.skipElement(name, selfClose)
+	t.s.gap = nil
+	x := *f.extra
+	x.Nodes = append(x.Nodes, RawNode{In: f.in, After: f.n, XML: raw})
+	return true
+}
+
+// record keeps how the start tag just read was written in extra under in,
+// with its attributes not named in known. text is set for elements that
+// hold text, which may be a CDATA section.
+func (t *tree) record(extra **Extra, in string, known []string, text bool) {
+	if *extra == nil {
+		*extra = &Extra{}
+	}
+	x := *extra
+	raw, names := t.s.unknownAttrs(known)
+	if raw != "" {
+		x.Attrs = append(x.Attrs, RawAttrs{In: in, XML: raw})
+	}
+	prefix, _ := t.s.tagName()
+	x.Tags = append(x.Tags, RawTag{
+		In: in, Prefix: prefix, Attrs: names,
+		CDATA: text && t.s.cdataNext(), SelfClosing: t.s.selfClosing(),
+	})
+}
+
+// tagName returns the prefix, with its colon, and the local name of the
+// start tag last read by next.
+func (s *scan) tagName() (prefix, local string) {
+	p := s.tagStart + 1
+	end := p
+	for end < len(s.data) && !isSpace(s.data[end]) && s.data[end] != '>' && s.data[end] != '/' {
+		end++
+	}
+	name := s.data[p:end]
+	colon := bytes.IndexByte(name, ':')
+	return byteStr(name[:colon+1]), byteStr(name[colon+1:])
+}
+
+// selfClosing reports whether the start tag just read is self-closing.
+func (s *scan) selfClosing() bool {
+	j := bytes.IndexByte(s.data[s.pos:], '>')
+	return j > 0 && s.data[s.pos+j-1] == '/'
+}
+
+// cdataNext reports whether the text of the start tag just read starts
+// with a CDATA section.
+func (s *scan) cdataNext() bool {
+	j := bytes.IndexByte(s.data[s.pos:], '>')
+	if j < 0 || s.selfClosing() {
+		return false
+	}
+	p := s.pos + j + 1
+	for p < len(s.data) && isSpace(s.data[p]) {
+		p++
+	}
+	return bytes.HasPrefix(s.data[p:], []byte("<![CDATA["))
+}
+
+// unknownAttrs returns the attributes of the current start tag whose local
+// names are not in known, as raw text, and the names of all of them, in
+// the order found.
+func (s *scan) unknownAttrs(known []string) (raw string, names []string) {
+	var out []byte
+	data := s.data
+	p := s.pos
+	for {
+		for p < len(data) && isSpace(data[p]) {
+			p++
+		}
+		if p >= len(data) || data[p] == '>' || data[p] == '/' {
+			break
+		}
+		nameStart := p
+		for p < len(data) && data[p] != '=' && data[p] != '>' && data[p] != '/' && !isSpace(data[p]) {
+			p++
+		}
+		name := data[nameStart:p]
+		for p < len(data) && isSpace(data[p]) {
+			p++
+		}
+		if len(name) == 0 || p >= len(data) || data[p] != '=' {
+			break
+		}
+		p++
+		for p < len(data) && isSpace(data[p]) {
+			p++
+		}
+		if p >= len(data) || (data[p] != '"' && data[p] != '\'') {
+			break
+		}
+		end := bytes.IndexByte(data[p+1:], data[p])
+		if end < 0 {
+			break
+		}
+		p += end + 2
+
+		_, local, ok := bytes.Cut(name, []byte(":"))
+		if !ok {
+			local = name
+		}
+		names = append(names, byteStr(name))
+		if !slices.Contains(known, string(local)) {
+			out = append(out, ' ')
+			out = append(out, data[nameStart:p]...)
+		}
+	}
+	return string(out), names
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// skipElement skips past the element whose start tag was just read by
+// next, returning its markup.
+func (s *scan) skipElement(name []byte, selfClose bool) string {
+	start := s.tagStart
+	s.endAttrs()
+	for depth := 1; depth > 0 && !selfClose; {
+		n, isEnd, sc := s.next()
+		switch {
+		case n == nil:
+			s.unterminated(string(name), start)
+			depth = 0
+		case isEnd:
+			depth--
+		default:
+			s.endAttrs()
+			if !sc {
+				depth++
+			}
+		}
+	}
+	return byteStr(s.data[start:s.pos])
+}
+
+// --- encoding ---
+
+// pendingAttr is a known attribute of a start tag recorded in a RawTag,
+// held in encoder.attrBuf until the tag is written out.
+type pendingAttr struct {
+	name       string
+	start, end int // of the escaped value in attrBuf
+	zero       bool
+}
+
+// pend holds the known attribute whose value was appended to attrBuf from
+// start on.
+func (e *encoder) pend(name string, start int, zero bool) {
+	e.attrs = append(e.attrs, pendingAttr{name: name, start: start, end: len(e.attrBuf), zero: zero})
+}
+
+// tagAttrs appends the attributes of the start tag recorded in t, in the
+// order t has them: the known ones held by pend, under the names found,
+// and the unknown ones kept in the Extra. Known attributes that were not
+// found are added after them unless zero, as are unknown ones added since.
+func (e *encoder) tagAttrs(t *RawTag) {
+	var done uint64 // of attrs
+	for _, name := range t.Attrs {
+		if i := e.pending(name); i >= 0 {
+			if done&(1<<i) == 0 {
+				done |= 1 << i
+				e.pendingAttr(name, &e.attrs[i])
+			}
+			continue
+		}
+		e.rawAttr(name)
+	}
+	for i := range e.attrs {
+		if a := &e.attrs[i]; done&(1<<i) == 0 && !a.zero {
+			e.pendingAttr(a.name, a)
+		}
+	}
+	for i := range e.tagX.Attrs {
+		if a := &e.tagX.Attrs[i]; a.In == e.tagIn {
+			for raw := a.XML; raw != ""; {
+				var attr, name string
+				attr, name, raw = cutAttr(raw)
+				if !slices.Contains(t.Attrs, name) {
+					e.raw(attr)
+				}
+			}
+		}
+	}
+}
+
+// pending returns the index of the known attribute held for name, matching
+// on the local name, or -1.
+func (e *encoder) pending(name string) int {
+	local := name[strings.IndexByte(name, ':')+1:]
+	for i := range e.attrs {
+		n := e.attrs[i].name
+		if n[strings.IndexByte(n, ':')+1:] == local {
+			return i
+		}
+	}
+	return -1
+}
+
+// pendingAttr appends a known attribute under name. An empty namespace
+// declaration is left out, as xmlns:xsi="" would not be one.
+func (e *encoder) pendingAttr(name string, a *pendingAttr) {
+	if a.zero && strings.HasPrefix(name, "xmlns:") {
+		return
+	}
+	e.raw(" ")
+	e.raw(name)
+	e.raw(`="`)
+	e.raw(byteStr(e.attrBuf[a.start:a.end]))
+	e.raw(`"`)
+}
+
+// rawAttr appends the unknown attribute named name kept for the tag being
+// written.
+func (e *encoder) rawAttr(name string) {
+	for i := range e.tagX.Attrs {
+		if a := &e.tagX.Attrs[i]; a.In == e.tagIn {
+			for raw := a.XML; raw != ""; {
+				var attr, n string
+				attr, n, raw = cutAttr(raw)
+				if n == name {
+					e.raw(attr)
+					return
+				}
+			}
+		}
+	}
+}
+
+// cutAttr returns the first attribute of raw, kept as in RawAttrs, with
+// the space before it, its name and the attributes after it.
+func cutAttr(raw string) (attr, name, rest string) {
+	eq := strings.IndexByte(raw, '=')
+	if eq < 0 {
+		return raw, "", ""
+	}
+	name = strings.TrimSpace(raw[:eq])
+	q := eq + 1
+	for q < len(raw) && isSpace(raw[q]) {
+		q++
+	}
+	if q == len(raw) {
+		return raw, name, ""
+	}
+	end := strings.IndexByte(raw[q+1:], raw[q])
+	if end < 0 {
+		return raw, name, ""
+	}
+	end += q + 2
+	return raw[:end], name, raw[end:]
+}
+
+// extraAttrs appends the unknown attributes kept in x for in, unless the
+// tag being written is recorded, in which case startDone does.
+func (e *encoder) extraAttrs(x *Extra, in string) {
+	if x == nil || e.tag != nil {
+		return
+	}
+	for i := range x.Attrs {
+		if x.Attrs[i].In == in {
+			e.raw(x.Attrs[i].XML)
+		}
+	}
+}
+
+// segment is output of an element whose known children are put back in
+// the order they were found: a known child named name, or, when after is
+// not -1, the unknown node kept after that many known children.
+type segment struct {
+	name       string
+	after      int
+	start, end int
+	empty      bool
+	indentedIn bool // before the segment
+}
+
+// segment values of after besides node positions.
+const (
+	segChild = -1
+	segDone  = -2
+)
+
+// pos returns the length of the output so far.
+func (e *encoder) pos() int {
+	if e.sizing {
+		return e.size
+	}
+	return len(e.buf)
+}
+
+// child appends the unknown nodes kept in x for in that came before known
+// child k, named name, and returns the index of the next known child. If
+// x records the order of the children, the child is instead noted for
+// rest to move into place; empty reports that it holds nothing, for rest
+// to leave it out if it was not found.
+func (e *encoder) child(x *Extra, in string, k int, name string, empty bool) int {
+	if x == nil {
+		return k + 1
+	}
+	if x.tag(in) != nil {
+		pos := e.pos()
+		if k > 0 {
+			e.segs[len(e.segs)-1].end = pos
+		}
+		e.segs = append(e.segs, segment{name: name, after: segChild, start: pos, empty: empty, indentedIn: e.indentedIn})
+		return k + 1
+	}
+	for i := range x.Nodes {
+		if n := &x.Nodes[i]; n.In == in && n.After == k {
+			e.rawNode(n.XML)
+		}
+	}
+	return k + 1
+}
+
+// rest appends the unknown nodes kept in x for in that came after the
+// first k known children. If x records the order of the children, it
+// appends all the nodes and puts them and the k children in that order.
+func (e *encoder) rest(x *Extra, in string, k int) {
+	if x == nil {
+		return
+	}
+	t := x.tag(in)
+	if t == nil {
+		for i := range x.Nodes {
+			if n := &x.Nodes[i]; n.In == in && n.After >= k {
+				e.rawNode(n.XML)
+			}
+		}
+		return
+	}
+	base := len(e.segs) - k
+	if k > 0 {
+		e.segs[len(e.segs)-1].end = e.pos()
+	}
+	for i := range x.Nodes {
+		n := &x.Nodes[i]
+		if n.In != in {
+			continue
+		}
+		start, indentedIn := e.pos(), e.indentedIn
+		e.rawNode(n.XML)
+		e.segs = append(e.segs, segment{after: n.After, start: start, end: e.pos(), indentedIn: indentedIn})
+	}
+	e.reorder(t.Children, e.segs[base:])
+	e.segs = e.segs[:base]
+}
+
+// reorder moves the output of segs, which follow each other at the end of
+// the output, into the order of children.
+func (e *encoder) reorder(children []string, segs []segment) {
+	if len(segs) == 0 {
+		return
+	}
+	from := segs[0].start
+	e.tmp = e.tmp[:0]
+	size := 0
+	put := func(sg *segment) {
+		size += sg.end - sg.start
+		if !e.sizing {
+			e.tmp = append(e.tmp, e.buf[sg.start:sg.end]...)
+		}
+		sg.after = segDone
+	}
+	for i, name := range children {
+		for j := range segs {
+			if segs[j].after == i {
+				put(&segs[j])
+			}
+		}
+		for j := range segs {
+			if segs[j].after == segChild && segs[j].name == name {
+				put(&segs[j])
+				break
+			}
+		}
+	}
+	for j := range segs {
+		if segs[j].after == segChild && !segs[j].empty {
+			put(&segs[j])
+		}
+	}
+	for j := range segs {
+		if segs[j].after >= 0 {
+			put(&segs[j])
+		}
+	}
+	if size == 0 {
+		e.indentedIn = segs[0].indentedIn // for the end tag to follow on
+	}
+	if e.sizing {
+		e.size = from + size
+		return
+	}
+	e.buf = append(e.buf[:from], e.tmp...)
+}
+
+// rawNode appends a node kept as raw XML, indented like a childless element.
+// The whitespace around it gives way to the indentation.
+func (e *encoder) rawNode(xml string) {
+	if e.indenting() {
+		if xml = strings.TrimSpace(xml); xml == "" {
+			return
+		}
+	}
+	e.writeIndent(1)
+	e.raw(xml)
+	if e.indenting() {
+		e.depth--
+		e.indentedIn = false
+	}
+}
+
+// prolog appends the markup x keeps before the root element, if it is the
+// root, and reports whether it is. With declare, an XML declaration is
+// written unless the markup starts with one. When indenting, the
+// whitespace around the markup gives way to the indentation.
+func (e *encoder) prolog(x *Extra, declare bool) bool {
+	if e.inDoc {
+		return false
+	}
+	e.inDoc = true
+	var prolog string
+	if x != nil {
+		prolog = x.Prolog
+	}
+	if e.indenting() {
+		prolog = strings.TrimSpace(prolog)
+	}
+	if declare && !strings.HasPrefix(prolog, "<?xml") {
+		e.raw(xmlDeclaration)
+	}
+	e.raw(prolog)
+	if e.indenting() && prolog != "" {
+		e.raw("\n")
+	}
+	return true
+}
+
+// epilog appends the markup x keeps after the root element.
+func (e *encoder) epilog(x *Extra) {
+	if x == nil {
+		return
+	}
+	if !e.indenting() {
+		e.raw(x.Epilog)
+	} else if epilog := strings.TrimSpace(x.Epilog); epilog != "" {
+		e.raw("\n")
+		e.raw(epilog)
+	}
+}
@@ -0,0 +1,235 @@
+package vmap
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func decodeLossless(t *testing.T, doc []byte) VMAP {
+	t.Helper()
+	v, warnings, err := DecodeVmapScanWithOptions(doc, DecodeOptions{Strict: true, Lossless: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) > 0 {
+		t.Fatal(warnings)
+	}
+	return v
+}
+
+// elements leaves out the whitespace between elements kept in nodes.
+func elements(nodes []RawNode) []RawNode {
+	var out []RawNode
+	for _, n := range nodes {
+		if strings.TrimSpace(n.XML) != "" {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+func TestLosslessDecode(t *testing.T) {
+	is := is.New(t)
+	doc, err := os.ReadFile("sample-vmap/testVmapUnknown.xml")
+	is.NoErr(err)
+
+	v := decodeLossless(t, doc)
+	is.Equal(v.Extra.Attrs, []RawAttrs{{XML: ` xmlns:x="urn:x" x:build="42"`}})
+	is.Equal(v.Extra.Tags, []RawTag{{
+		Prefix:   "vmap:",
+		Attrs:    []string{"xmlns:vmap", "xmlns:x", "version", "x:build"},
+		Children: []string{"AdBreak"},
+	}})
+	is.Equal(v.Extra.Prolog, `<?xml version="1.0" encoding="UTF-8"?>`+"\n")
+	is.Equal(v.Extra.Epilog, "\n")
+	ab := v.AdBreaks[0]
+	is.Equal(ab.Extra.Attrs, []RawAttrs{{XML: ` x:slot="a"`}})
+	is.Equal(ab.Extra.Tags[0].Children, []string{"AdSource", "TrackingEvents"})
+	nodes := elements(ab.Extra.Nodes)
+	is.Equal(len(nodes), 1)
+	is.Equal(nodes[0].After, 2) // after AdSource and TrackingEvents
+	is.True(strings.HasPrefix(nodes[0].XML, "<vmap:Extensions>"))
+	is.Equal(ab.AdSource.Extra.Attrs, []RawAttrs{{XML: ` id="pre-ad-0" allowMultipleAds="false" followRedirects="true"`}})
+
+	vast := ab.AdSource.VASTData.VAST
+	is.Equal(vast.NoNamespaceSchemaLocation, "vast.xsd")
+	is.Equal(vast.Extra.Tags[0].Attrs, []string{"xmlns:xsi", "xsi:noNamespaceSchemaLocation", "version"})
+	is.Equal(len(vast.Ad), 2)
+	is.Equal(vast.Ad[0].Extra.Attrs, []RawAttrs{{XML: ` conditionalAd="false"`}})
+	is.Equal(vast.Ad[1].Extra.Tags[0].Attrs, []string{"id"}) // no sequence to write back
+	is.Equal(elements(vast.Ad[1].Extra.Nodes), []RawNode{{
+		XML: "<Wrapper><VASTAdTagURI><![CDATA[http://t/wrapped]]></VASTAdTagURI></Wrapper>",
+	}})
+
+	il := vast.Ad[0].InLine
+	is.Equal(il.Extra.Attrs, []RawAttrs{{In: "AdSystem", XML: ` version="2.1"`}})
+	is.Equal(il.Extra.Tags[0].Children, []string{"AdSystem", "AdTitle", "Impression", "Creatives", "Extensions", "Error"})
+	nodes = elements(il.Extra.Nodes)
+	is.Equal(len(nodes), 2)
+	is.Equal(nodes[0].After, 2) // Description, after AdSystem and AdTitle
+	is.Equal(nodes[1].After, 3) // Pricing, after the Impression
+	is.True(il.Impression[0].Extra.Tags[0].CDATA)
+
+	linear := il.Creatives[0].Linear
+	is.Equal(linear.Extra.Attrs, []RawAttrs{{XML: ` skipoffset="00:00:05"`}})
+	is.Equal(linear.TrackingEvents[0].Extra.Attrs, []RawAttrs{{XML: ` offset="00:00:03"`}})
+	is.Equal(linear.MediaFiles[0].Extra.Attrs, []RawAttrs{{XML: ` apiFramework="VPAID" scalable='true'`}})
+	is.Equal(len(linear.CustomClick), 1)
+	is.Equal(linear.CustomClick[0].Id, "cc")
+	is.Equal(linear.CustomClick[0].Text, "http://t/cc")
+	var in []string
+	for _, n := range elements(linear.Extra.Nodes) {
+		in = append(in, n.In)
+	}
+	is.Equal(in, []string{"TrackingEvents", "MediaFiles", ""}) // the comment, Mezzanine and Icons
+
+	// Companion tracking is kept with the companion, not taken for Linear's.
+	c2 := il.Creatives[1]
+	is.Equal(c2.Linear, nil)
+	is.Equal(len(elements(c2.Extra.Nodes)), 1)
+
+	is.Equal(elements(il.Extensions[1].Extra.Nodes), []RawNode{{XML: `<Verification vendor="v"/>`}})
+}
+
+func TestLosslessRoundTrip(t *testing.T) {
+	doc, err := os.ReadFile("sample-vmap/testVmapUnknown.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := decodeLossless(t, doc)
+
+	for _, opts := range allEncodeOptions {
+		is := is.New(t)
+		out, err := MarshalVmapWithOptions(&v, opts)
+		is.NoErr(err)
+		is.Equal(EstimateVmapSize(&v, opts), len(out))
+		if opts == (EncodeOptions{}) {
+			is.Equal(string(out), string(doc))
+		}
+		var w bytes.Buffer
+		is.NoErr(EncodeVmap(&w, &v, opts))
+		is.Equal(w.String(), string(out))
+		for _, want := range []string{
+			` xmlns:vmap="http://www.iab.net/videosuite/vmap"`,
+			` xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:noNamespaceSchemaLocation="vast.xsd"`,
+			`<AdSystem version="2.1">Test</AdSystem>`,
+			`<Linear skipoffset="00:00:05">`,
+			`<Wrapper><VASTAdTagURI><![CDATA[http://t/wrapped]]></VASTAdTagURI></Wrapper>`,
+			`<Verification vendor="v"/>`,
+		} {
+			is.True(strings.Contains(string(out), want))
+		}
+		// Unknown elements stay in place.
+		s := string(out)
+		is.True(strings.Index(s, "<AdTitle>") < strings.Index(s, "<Description>"))
+		is.True(strings.Index(s, "<Description>") < strings.Index(s, "<Impression"))
+		is.True(strings.Index(s, "<Impression") < strings.Index(s, "<Pricing"))
+		is.True(strings.Index(s, "<Pricing") < strings.Index(s, "<Creatives>"))
+		is.True(strings.Index(s, "</MediaFile>") < strings.Index(s, "<Mezzanine"))
+		is.True(strings.Index(s, "</VideoClicks>") < strings.Index(s, "<Icons>"))
+
+		for _, unwanted := range []string{` vmap="`, ` xsi="`, ` noNamespaceSchemaLocation="`} {
+			is.True(!strings.Contains(string(out), unwanted)) // namespace attributes keep their prefixes
+		}
+
+		back := decodeLossless(t, out)
+		again, err := MarshalVmapWithOptions(&back, opts)
+		is.NoErr(err)
+		is.Equal(string(again), string(out))
+		if opts.OmitEmpty && opts.Prefix == "" && opts.Indent == "" {
+			is.Equal(back, v)
+		}
+	}
+}
+
+func TestLosslessLayout(t *testing.T) {
+	for _, doc := range []string{
+		// The children of InLine in the order of the VAST schema.
+		`<VAST version="4.0"><Ad id="a"><InLine><AdSystem>s</AdSystem><AdTitle>t</AdTitle>` +
+			`<Error><![CDATA[http://t/e]]></Error><Description>d</Description>` +
+			`<Impression>http://t/i</Impression></InLine></Ad></VAST>`,
+		`<!-- served by x -->` + "\r\n" + `<VAST version="4.0" xmlns:v="urn:v">` + "\r\n" +
+			`  <Ad sequence="2"><InLine/></Ad><?pi x?>` + "\r\n" + `</VAST>`,
+		`<v:VAST version="4.0"><v:Ad><v:InLine><v:Creatives><v:Creative><v:Linear>` +
+			`<v:MediaFiles></v:MediaFiles><v:Duration><![CDATA[00:00:05]]></v:Duration>` +
+			`</v:Linear></v:Creative></v:Creatives></v:InLine></v:Ad></v:VAST>`,
+	} {
+		t.Run(doc, func(t *testing.T) {
+			is := is.New(t)
+			v, _, err := DecodeVastScanWithOptions([]byte(doc), DecodeOptions{Strict: true, Lossless: true})
+			is.NoErr(err)
+			out, err := MarshalVast(&v)
+			is.NoErr(err)
+			is.Equal(string(out), doc)
+			is.Equal(EstimateVastSize(&v, EncodeOptions{}), len(out))
+		})
+	}
+}
+
+func TestLosslessLayoutChanged(t *testing.T) {
+	is := is.New(t)
+	doc := `<VAST version="4.0"><Ad id="a"><InLine><AdTitle>t</AdTitle>` +
+		`<Error>http://t/e</Error></InLine></Ad></VAST>`
+	v, _, err := DecodeVastScanWithOptions([]byte(doc), DecodeOptions{Strict: true, Lossless: true})
+	is.NoErr(err)
+
+	// What the document did not have is written after what it had.
+	il := v.Ad[0].InLine
+	il.AdSystem = "s"
+	il.Impression = append(il.Impression, Impression{Text: "http://t/i"})
+	v.Ad[0].Sequence = 1
+	out, err := MarshalVast(&v)
+	is.NoErr(err)
+	is.Equal(string(out), `<VAST version="4.0"><Ad id="a" sequence="1"><InLine><AdTitle>t</AdTitle>`+
+		`<Error>http://t/e</Error><AdSystem>s</AdSystem><Impression id="">http://t/i</Impression>`+
+		`</InLine></Ad></VAST>`)
+	is.Equal(EstimateVastSize(&v, EncodeOptions{}), len(out))
+}
+
+func TestLosslessOff(t *testing.T) {
+	is := is.New(t)
+	doc, err := os.ReadFile("sample-vmap/testVmapUnknown.xml")
+	is.NoErr(err)
+	v, err := DecodeVmapScan(doc)
+	is.NoErr(err)
+	is.Equal(v.Extra, nil)
+	is.Equal(v.AdBreaks[0].Extra, nil)
+	il := v.AdBreaks[0].AdSource.VASTData.VAST.Ad[0].InLine
+	is.Equal(il.Extra, nil)
+	is.Equal(il.Creatives[0].Linear.MediaFiles[0].Extra, nil)
+}
+
+func TestUnknownAttrs(t *testing.T) {
+	for _, tc := range []struct {
+		tag, want string
+		names     []string
+	}{
+		{`<a id="1" x="2">`, ` x="2"`, []string{"id", "x"}},
+		{`<a  x = '2'  id="1"/>`, ` x = '2'`, []string{"x", "id"}},
+		{`<a id="1">`, ``, []string{"id"}},
+		{`<a p:id="1" q:y="a>b">`, ` q:y="a>b"`, []string{"p:id", "q:y"}},
+		{`<a xmlns:id="1" xsi:id="2" xmlns:x="3">`, ` xmlns:x="3"`, []string{"xmlns:id", "xsi:id", "xmlns:x"}},
+		{`<a x="unterminated>`, ``, nil},
+	} {
+		t.Run(tc.tag, func(t *testing.T) {
+			is := is.New(t)
+			s := scan{data: []byte(tc.tag)}
+			s.next()
+			raw, names := s.unknownAttrs([]string{"id"})
+			is.Equal(raw, tc.want)
+			is.Equal(names, tc.names)
+		})
+	}
+}
+
+func TestLosslessUnterminated(t *testing.T) {
+	is := is.New(t)
+	doc := []byte(`<VAST version="4.0"><Ad><Wrapper><VASTAdTagURI>x</VASTAdTagURI>`)
+	_, _, err := DecodeVastScanWithOptions(doc, DecodeOptions{Strict: true, Lossless: true})
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), "unterminated Wrapper element"))
+}
@@ -0,0 +1,76 @@
+package vmap
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// decodeVmapParallel decodes a VMAP lazily, then decodes the VAST of its
+// breaks on up to opts.Workers goroutines. The warnings of each VAST are
+// put back where the sequential decoder finds them, and the first error in
+// document order is returned.
+func decodeVmapParallel(vmap *VMAP, input []byte, opts DecodeOptions) ([]error, error) {
+	warnings, err := decodeVmapScan(vmap, input, opts)
+	if isLimitError(err) {
+		// Where the sequential decoder stops depends on the VASTs before.
+		*vmap = VMAP{}
+		opts.Workers = 0
+		return decodeVmapScan(vmap, input, opts)
+	}
+
+	var breaks []*AdBreak
+	for i := range vmap.AdBreaks {
+		if vmap.AdBreaks[i].lazy != nil {
+			breaks = append(breaks, &vmap.AdBreaks[i])
+		}
+	}
+	type result struct {
+		vast     *VAST
+		warnings []error
+		err      error
+	}
+	results := make([]result, len(breaks))
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for range min(opts.Workers, len(breaks)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(next.Add(1)) - 1
+				if i >= len(breaks) {
+					return
+				}
+				r := &results[i]
+				r.vast, r.warnings, r.err = breaks[i].lazy.decode()
+			}
+		}()
+	}
+	wg.Wait()
+
+	var merged []error
+	done := 0
+	var vastErr error
+	for i, ab := range breaks {
+		r := &results[i]
+		merged = append(merged, warnings[done:ab.lazy.warnAt]...)
+		merged = append(merged, r.warnings...)
+		done = ab.lazy.warnAt
+		if vastErr == nil {
+			vastErr = r.err
+		}
+		ab.AdSource.VASTData.VAST = r.vast
+		ab.lazy = nil
+	}
+	merged = append(merged, warnings[done:]...)
+	if len(merged) > maxWarnings {
+		merged = merged[:maxWarnings]
+	}
+	if vastErr != nil {
+		return nil, vastErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
@@ -0,0 +1,75 @@
+package vmap
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+// warningsDoc has malformed values within the VAST of several breaks and
+// between them, so that the order of the warnings can be checked.
+const warningsDoc = `<VMAP version="1.0">
+<AdBreak breakId="a" timeOffset="bad"><AdSource><VASTAdData><VAST version="4.0"><Ad sequence="x"><InLine>
+<Creatives><Creative><Linear><Duration>bad</Duration><MediaFiles><MediaFile width="w">u</MediaFile></MediaFiles>
+</Linear></Creative></Creatives></InLine></Ad></VAST></VASTAdData></AdSource>
+<TrackingEvents><Tracking event="breakStart">t&bogus;</Tracking></TrackingEvents></AdBreak>
+<AdBreak breakId="b" timeOffset="end"><AdSource><VASTAdData><VAST version="4.0"><Ad><InLine><AdTitle>&nope;</AdTitle>
+</InLine></Ad></VAST></VASTAdData></AdSource></AdBreak>
+<AdBreak breakId="c" timeOffset="#0"><AdSource><VASTAdData><VAST><Ad><InLine><Creatives><Creative><Linear>`
+
+func TestDecodeVmapParallel(t *testing.T) {
+	is := is.New(t)
+	big, err := MarshalVmap(bigVmap(t, 50))
+	is.NoErr(err)
+	docs := map[string][]byte{"big": big, "warnings": []byte(warningsDoc)}
+	for _, f := range []string{"testVmap.xml", "testVmap2.xml", "testVmapEmptyVast.xml", "testVmapUnknown.xml"} {
+		doc, err := os.ReadFile("sample-vmap/" + f)
+		is.NoErr(err)
+		docs[f] = doc
+	}
+
+	for name, doc := range docs {
+		for _, opts := range []DecodeOptions{{}, {Strict: true}, {Lossless: true}} {
+			want, wantWarnings, wantErr := DecodeVmapScanWithOptions(doc, opts)
+			for _, workers := range []int{2, 3, 16} {
+				t.Run(fmt.Sprintf("%s/%+v/%d", name, opts, workers), func(t *testing.T) {
+					is := is.New(t)
+					popts := opts
+					popts.Workers = workers
+					got, warnings, err := DecodeVmapScanWithOptions(doc, popts)
+					is.Equal(fmt.Sprint(err), fmt.Sprint(wantErr))
+					is.Equal(fmt.Sprint(warnings), fmt.Sprint(wantWarnings))
+					if wantErr == nil {
+						is.Equal(got, want)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestDecodeVmapParallelWarnings(t *testing.T) {
+	is := is.New(t)
+	_, warnings, err := DecodeVmapScanWithOptions([]byte(warningsDoc), DecodeOptions{Workers: 4})
+	is.NoErr(err)
+	is.Equal(len(warnings), 13) // from the breaks and the VAST within them
+}
+
+func BenchmarkScanDecodeBreaks(b *testing.B) {
+	doc, err := MarshalVmap(bigVmap(b, 200))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(doc)))
+			for i := 0; i < b.N; i++ {
+				_, _, _ = DecodeVmapScanWithOptions(doc, DecodeOptions{Workers: workers})
+			}
+		})
+	}
+}
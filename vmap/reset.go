@@ -0,0 +1,127 @@
+package vmap
+
+// Reset empties v for reuse by DecodeVmapScanInto, keeping the slices and
+// structs it holds so that the next decode can fill them in place. A reset
+// VMAP is equal to the zero VMAP but for empty slices in place of nil ones,
+// so VMAPs can be kept in a sync.Pool:
+//
+//	v := pool.Get().(*vmap.VMAP)
+//	defer pool.Put(v)
+//	if err := vmap.DecodeVmapScanInto(v, input); err != nil {
+//		...
+//	}
+func (v *VMAP) Reset() {
+	for i := range v.AdBreaks {
+		v.AdBreaks[i].reset()
+	}
+	*v = VMAP{AdBreaks: v.AdBreaks[:0]}
+}
+
+// Reset empties v for reuse by DecodeVastScanInto, as VMAP.Reset does.
+func (v *VAST) Reset() {
+	for i := range v.Ad {
+		v.Ad[i].reset()
+	}
+	*v = VAST{Ad: v.Ad[:0]}
+}
+
+// The reset methods below keep the optional structs an element points to,
+// reset in turn, for the scanners to take as spares. Elements past the
+// length of a slice are always reset, so that a scanner can extend the
+// slice over them.
+
+func (ab *AdBreak) reset() {
+	src := ab.AdSource
+	if src != nil {
+		src.Extra = nil
+		if data := src.VASTData; data != nil {
+			data.Extra = nil
+			if data.VAST != nil {
+				data.VAST.Reset()
+			}
+		}
+	}
+	clear(ab.TrackingEvents)
+	*ab = AdBreak{AdSource: src, TrackingEvents: ab.TrackingEvents[:0]}
+}
+
+func (ad *Ad) reset() {
+	if ad.InLine != nil {
+		ad.InLine.reset()
+	}
+	*ad = Ad{InLine: ad.InLine}
+}
+
+func (il *InLine) reset() {
+	for i := range il.Creatives {
+		il.Creatives[i].reset()
+	}
+	for i := range il.Extensions {
+		il.Extensions[i].reset()
+	}
+	if il.Error != nil {
+		*il.Error = Error{}
+	}
+	clear(il.Impression)
+	*il = InLine{
+		Impression: il.Impression[:0],
+		Creatives:  il.Creatives[:0],
+		Extensions: il.Extensions[:0],
+		Error:      il.Error,
+	}
+}
+
+func (c *Creative) reset() {
+	if c.UniversalAdId != nil {
+		*c.UniversalAdId = UniversalAdId{}
+	}
+	if c.Linear != nil {
+		c.Linear.reset()
+	}
+	*c = Creative{UniversalAdId: c.UniversalAdId, Linear: c.Linear}
+}
+
+func (l *Linear) reset() {
+	if l.ClickThrough != nil {
+		*l.ClickThrough = ClickThrough{}
+	}
+	clear(l.TrackingEvents)
+	clear(l.MediaFiles)
+	clear(l.ClickTracking)
+	clear(l.CustomClick)
+	*l = Linear{
+		TrackingEvents: l.TrackingEvents[:0],
+		MediaFiles:     l.MediaFiles[:0],
+		ClickThrough:   l.ClickThrough,
+		ClickTracking:  l.ClickTracking[:0],
+		CustomClick:    l.CustomClick[:0],
+	}
+}
+
+func (ext *Extension) reset() {
+	clear(ext.CreativeParameters)
+	*ext = Extension{CreativeParameters: ext.CreativeParameters[:0]}
+}
+
+// extend grows *sl by one element, reusing its capacity, and returns the
+// new element.
+func extend[T any](sl *[]T) *T {
+	if n := len(*sl); n < cap(*sl) {
+		*sl = (*sl)[:n+1]
+	} else {
+		var zero T
+		*sl = append(*sl, zero)
+	}
+	return &(*sl)[len(*sl)-1]
+}
+
+// take returns *spare, or a new T if there is none, leaving nil in its
+// place so that it is used at most once.
+func take[T any](spare **T) *T {
+	p := *spare
+	if p == nil {
+		return new(T)
+	}
+	*spare = nil
+	return p
+}
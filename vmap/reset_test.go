@@ -0,0 +1,111 @@
+package vmap
+
+import (
+	"bytes"
+	"encoding/xml"
+	"os"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestDecodeVmapScanInto(t *testing.T) {
+	is := is.New(t)
+	// Decode documents of different sizes one after the other into the same
+	// VMAP, so that each reuses what the one before left.
+	files := []string{"testVmap.xml", "testVmapEmptyVast.xml", "testVmap2.xml", "testVmap.xml", "testVmapUnknown.xml"}
+
+	var dst VMAP
+	for _, f := range files {
+		doc, err := os.ReadFile("sample-vmap/" + f)
+		is.NoErr(err)
+		want, err := DecodeVmapScan(doc)
+		is.NoErr(err)
+
+		is.NoErr(DecodeVmapScanInto(&dst, doc))
+		is.Equal(marshalXML(t, dst), marshalXML(t, want)) // f
+	}
+}
+
+func TestDecodeVastScanInto(t *testing.T) {
+	is := is.New(t)
+	files := []string{"testVast.xml", "testVast2.xml", "testVastSpecialChars.xml", "testVast3.xml", "testVast.xml"}
+
+	var dst VAST
+	for _, f := range files {
+		doc, err := os.ReadFile("sample-vmap/" + f)
+		is.NoErr(err)
+		want, err := DecodeVastScan(doc)
+		is.NoErr(err)
+
+		is.NoErr(DecodeVastScanInto(&dst, doc))
+		is.Equal(marshalXML(t, dst), marshalXML(t, want)) // f
+	}
+}
+
+func TestDecodeVmapScanIntoErrors(t *testing.T) {
+	is := is.New(t)
+	doc, err := os.ReadFile("sample-vmap/testVmap.xml")
+	is.NoErr(err)
+
+	var dst VMAP
+	is.NoErr(DecodeVmapScanInto(&dst, doc))
+	is.Equal(DecodeVmapScanInto(&dst, []byte("<VAST></VAST>")), ErrNoVMAP)
+	is.Equal(len(dst.AdBreaks), 0)
+	is.Equal(DecodeVastScanInto(&VAST{}, []byte("<VMAP></VMAP>")), ErrNoVAST)
+}
+
+func TestReset(t *testing.T) {
+	is := is.New(t)
+	doc, err := os.ReadFile("sample-vmap/testVmap.xml")
+	is.NoErr(err)
+
+	v, err := DecodeVmapScan(doc)
+	is.NoErr(err)
+	n := len(v.AdBreaks)
+	v.Reset()
+	is.Equal(len(v.AdBreaks), 0)
+	is.Equal(marshalXML(t, v), marshalXML(t, VMAP{}))
+
+	// The breaks past the length are reset too, ready to be decoded into.
+	for _, ab := range v.AdBreaks[:n] {
+		is.Equal(ab.Id, "")
+		is.Equal(len(ab.TrackingEvents), 0)
+		vast := ab.AdSource.VASTData.VAST
+		if vast == nil {
+			continue
+		}
+		is.Equal(len(vast.Ad), 0)
+		for _, ad := range vast.Ad[:cap(vast.Ad)] {
+			is.Equal(ad.Id, "")
+			if ad.InLine != nil {
+				is.Equal(len(ad.InLine.Creatives), 0)
+				is.Equal(len(ad.InLine.Impression), 0)
+			}
+		}
+	}
+}
+
+func TestDecodeVmapScanIntoAllocs(t *testing.T) {
+	is := is.New(t)
+	doc, err := os.ReadFile("sample-vmap/testVmap.xml")
+	is.NoErr(err)
+
+	// Values with character references are unescaped into new strings.
+	doc = bytes.ReplaceAll(doc, []byte("&#xA;"), nil)
+	doc = bytes.ReplaceAll(doc, []byte("&"), []byte("_"))
+
+	var dst VMAP
+	is.NoErr(DecodeVmapScanInto(&dst, doc))
+	allocs := testing.AllocsPerRun(10, func() { _ = DecodeVmapScanInto(&dst, doc) })
+	is.True(allocs <= 1) // only the scanner
+}
+
+func marshalXML(t *testing.T, v any) string {
+	t.Helper()
+	b, err := xml.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
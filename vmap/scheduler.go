@@ -0,0 +1,214 @@
+package vmap
+
+import "time"
+
+// SeekPolicy decides which ad breaks play when the viewer seeks forward
+// past one or more of them.
+type SeekPolicy uint8
+
+const (
+	// SeekPlayAll plays every unplayed break that was seeked over, in
+	// timeline order.
+	SeekPlayAll SeekPolicy = iota
+	// SeekPlayLast snaps back to the last unplayed break that was seeked
+	// over and plays only that one.
+	SeekPlayLast
+	// SeekPlayNone plays none of the breaks that were seeked over. They
+	// stay unplayed, so they play if the viewer later plays through them.
+	SeekPlayNone
+)
+
+// Scheduler tells a player which ad breaks of a VMAP to play as the
+// playhead moves. Breaks are resolved with VMAP.Timeline; breaks that
+// cannot be placed never play. Each break is returned at most once.
+//
+// A Scheduler is not safe for concurrent use.
+type Scheduler struct {
+	timeline Timeline
+	policy   SeekPolicy
+	keys     map[*AdBreak]breakKey
+	played   map[breakKey]bool
+	position time.Duration
+	started  bool
+}
+
+// breakKey identifies an ad break across sessions: by its breakId, or by
+// its document index when its breakId is missing or not unique.
+type breakKey struct {
+	id    string
+	index int // -1 for breaks keyed by id
+}
+
+// SchedulerState is the part of a Scheduler that must survive a session
+// being resumed. It can be marshalled to JSON.
+type SchedulerState struct {
+	// Position is the last known playhead position.
+	Position time.Duration `json:"position"`
+	// Started is false until the first playhead or seek event.
+	Started bool `json:"started"`
+	// Played holds the breakIds of the breaks that have been played.
+	Played []string `json:"played"`
+	// PlayedIndexes holds the 0-based document indexes of the breaks
+	// without a unique breakId that have been played.
+	PlayedIndexes []int `json:"playedIndexes,omitempty"`
+}
+
+// NewScheduler creates a Scheduler for the ad breaks of v in content of the
+// given duration and cue points. See VMAP.Timeline for how breaks are placed.
+func NewScheduler(v *VMAP, contentDuration time.Duration, cuePoints []time.Duration, policy SeekPolicy) *Scheduler {
+	s := &Scheduler{
+		timeline: v.Timeline(contentDuration, cuePoints),
+		policy:   policy,
+		keys:     make(map[*AdBreak]breakKey, len(v.AdBreaks)),
+		played:   make(map[breakKey]bool),
+	}
+	ids := make(map[string]int, len(v.AdBreaks))
+	for i := range v.AdBreaks {
+		ids[v.AdBreaks[i].Id]++
+	}
+	for i := range v.AdBreaks {
+		ab := &v.AdBreaks[i]
+		if ab.Id != "" && ids[ab.Id] == 1 {
+			s.keys[ab] = breakKey{id: ab.Id, index: -1}
+		} else {
+			s.keys[ab] = breakKey{index: i}
+		}
+	}
+	return s
+}
+
+// Timeline returns the timeline the scheduler works from.
+func (s *Scheduler) Timeline() Timeline {
+	return s.timeline
+}
+
+// Position returns the last playhead position the scheduler was given.
+func (s *Scheduler) Position() time.Duration {
+	return s.position
+}
+
+// Played reports whether ab has been played.
+func (s *Scheduler) Played(ab *AdBreak) bool {
+	return s.played[s.keys[ab]]
+}
+
+// Advance reports that playback has progressed normally to pos and returns
+// the unplayed breaks that are now due, in timeline order. The first call
+// also returns the breaks at offset zero. A pos before the current position
+// only moves the playhead back; use Seek for viewer seeks.
+func (s *Scheduler) Advance(pos time.Duration) []*AdBreak {
+	from, ok := s.moveTo(pos)
+	if !ok {
+		return nil
+	}
+	var due []*AdBreak
+	for i := range s.timeline.Slots {
+		slot := &s.timeline.Slots[i]
+		if slot.Offset > from && slot.Offset <= pos {
+			due = s.take(due, slot)
+		}
+	}
+	return due
+}
+
+// Seek reports that the viewer jumped to pos and returns the breaks to
+// play before playback resumes, as decided by the seek policy. Seeking
+// backwards returns nothing; breaks already played are not played again
+// when the viewer plays through them a second time.
+func (s *Scheduler) Seek(pos time.Duration) []*AdBreak {
+	from, ok := s.moveTo(pos)
+	if !ok {
+		return nil
+	}
+	var due []*AdBreak
+	switch s.policy {
+	case SeekPlayAll:
+		for i := range s.timeline.Slots {
+			slot := &s.timeline.Slots[i]
+			if slot.Offset > from && slot.Offset <= pos {
+				due = s.take(due, slot)
+			}
+		}
+	case SeekPlayLast:
+		for i := len(s.timeline.Slots) - 1; i >= 0; i-- {
+			slot := &s.timeline.Slots[i]
+			if slot.Offset <= from {
+				break
+			}
+			if slot.Offset <= pos && s.hasUnplayed(slot) {
+				due = s.take(due, slot)
+				break
+			}
+		}
+	}
+	return due
+}
+
+// moveTo sets the playhead to pos. It returns the exclusive lower bound of
+// the range of offsets passed on the way there, and false when the playhead
+// did not move forward.
+func (s *Scheduler) moveTo(pos time.Duration) (from time.Duration, forward bool) {
+	from = s.position
+	if !s.started {
+		// Offsets are never negative, so this takes in breaks at zero.
+		from = -1
+		s.started = true
+	}
+	s.position = pos
+	return from, pos > from
+}
+
+// take appends the unplayed breaks of slot to due and marks them played.
+func (s *Scheduler) take(due []*AdBreak, slot *TimelineSlot) []*AdBreak {
+	for _, ab := range slot.Breaks {
+		key := s.keys[ab]
+		if s.played[key] {
+			continue
+		}
+		s.played[key] = true
+		due = append(due, ab)
+	}
+	return due
+}
+
+func (s *Scheduler) hasUnplayed(slot *TimelineSlot) bool {
+	for _, ab := range slot.Breaks {
+		if !s.played[s.keys[ab]] {
+			return true
+		}
+	}
+	return false
+}
+
+// State returns the scheduler state for saving with the session.
+func (s *Scheduler) State() SchedulerState {
+	st := SchedulerState{Position: s.position, Started: s.started}
+	for i := range s.timeline.Slots {
+		for _, ab := range s.timeline.Slots[i].Breaks {
+			key := s.keys[ab]
+			switch {
+			case !s.played[key]:
+			case key.index < 0:
+				st.Played = append(st.Played, key.id)
+			default:
+				st.PlayedIndexes = append(st.PlayedIndexes, key.index)
+			}
+		}
+	}
+	return st
+}
+
+// SetState restores a state returned by State, typically from a scheduler
+// for an earlier session on the same VMAP. Played breaks that do not exist
+// in this scheduler's VMAP are ignored.
+func (s *Scheduler) SetState(st SchedulerState) {
+	s.position = st.Position
+	s.started = st.Started
+	clear(s.played)
+	for _, id := range st.Played {
+		s.played[breakKey{id: id, index: -1}] = true
+	}
+	for _, i := range st.PlayedIndexes {
+		s.played[breakKey{index: i}] = true
+	}
+}
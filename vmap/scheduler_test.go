@@ -0,0 +1,128 @@
+package vmap
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func schedulerTestVmap() *VMAP {
+	return &VMAP{AdBreaks: []AdBreak{
+		{Id: "pre", TimeOffset: StartOffset()},
+		{Id: "mid-10", TimeOffset: DurationOffset(10 * time.Minute)},
+		{Id: "mid-20", TimeOffset: DurationOffset(20 * time.Minute)},
+		{Id: "mid-30", TimeOffset: DurationOffset(30 * time.Minute)},
+		{Id: "post", TimeOffset: EndOffset()},
+	}}
+}
+
+func breakIds(breaks []*AdBreak) []string {
+	ids := []string{}
+	for _, ab := range breaks {
+		ids = append(ids, ab.Id)
+	}
+	return ids
+}
+
+func TestSchedulerAdvance(t *testing.T) {
+	is := is.New(t)
+	s := NewScheduler(schedulerTestVmap(), time.Hour, nil, SeekPlayAll)
+
+	is.Equal(breakIds(s.Advance(0)), []string{"pre"})
+	is.Equal(breakIds(s.Advance(5*time.Minute)), []string{})
+	is.Equal(breakIds(s.Advance(10*time.Minute)), []string{"mid-10"})
+	is.Equal(breakIds(s.Advance(10*time.Minute+time.Second)), []string{})
+	is.Equal(breakIds(s.Advance(25*time.Minute)), []string{"mid-20"})
+	is.Equal(breakIds(s.Advance(time.Hour)), []string{"mid-30", "post"})
+	is.Equal(breakIds(s.Advance(time.Hour)), []string{})
+}
+
+func TestSchedulerSeekPolicies(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy SeekPolicy
+		want   []string
+		after  []string // due when playing on from 20 to 35 minutes after seeking back
+	}{
+		{name: "all", policy: SeekPlayAll, want: []string{"mid-10", "mid-20", "mid-30"}, after: []string{}},
+		{name: "last", policy: SeekPlayLast, want: []string{"mid-30"}, after: []string{"mid-20"}},
+		{name: "none", policy: SeekPlayNone, want: []string{}, after: []string{"mid-20", "mid-30"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+			s := NewScheduler(schedulerTestVmap(), time.Hour, nil, tc.policy)
+			is.Equal(breakIds(s.Advance(0)), []string{"pre"})
+			is.Equal(breakIds(s.Seek(40*time.Minute)), tc.want)
+
+			// Seeking back never plays anything, and playing through again
+			// only plays what is still unplayed.
+			is.Equal(breakIds(s.Seek(19*time.Minute)), []string{})
+			is.Equal(breakIds(s.Advance(35*time.Minute)), tc.after)
+		})
+	}
+}
+
+func TestSchedulerSeekBeforeStart(t *testing.T) {
+	is := is.New(t)
+	s := NewScheduler(schedulerTestVmap(), time.Hour, nil, SeekPlayLast)
+	is.Equal(breakIds(s.Seek(25*time.Minute)), []string{"mid-20"})
+	is.True(!s.Played(s.Timeline().Slots[0].Breaks[0]))
+}
+
+func TestSchedulerState(t *testing.T) {
+	is := is.New(t)
+	v := schedulerTestVmap()
+	s := NewScheduler(v, time.Hour, nil, SeekPlayAll)
+	s.Advance(0)
+	s.Advance(15 * time.Minute)
+
+	js, err := json.Marshal(s.State())
+	is.NoErr(err)
+
+	var st SchedulerState
+	is.NoErr(json.Unmarshal(js, &st))
+	is.Equal(st.Played, []string{"pre", "mid-10"})
+
+	// A resumed session on a freshly decoded copy of the same VMAP.
+	resumed := NewScheduler(schedulerTestVmap(), time.Hour, nil, SeekPlayAll)
+	resumed.SetState(st)
+	is.Equal(resumed.Position(), 15*time.Minute)
+	is.Equal(breakIds(resumed.Advance(15*time.Minute)), []string{})
+	is.Equal(breakIds(resumed.Seek(0)), []string{})
+	is.Equal(breakIds(resumed.Advance(25*time.Minute)), []string{"mid-20"})
+}
+
+func TestSchedulerStateKeysWithoutIds(t *testing.T) {
+	is := is.New(t)
+	v := &VMAP{AdBreaks: []AdBreak{
+		{TimeOffset: StartOffset()},
+		{Id: "dup", TimeOffset: DurationOffset(time.Minute)},
+		{Id: "dup", TimeOffset: DurationOffset(2 * time.Minute)},
+	}}
+	s := NewScheduler(v, time.Hour, nil, SeekPlayAll)
+	s.Advance(0)
+	s.Seek(90 * time.Second)
+	is.Equal(s.State().Played, []string(nil))
+	is.Equal(s.State().PlayedIndexes, []int{0, 1})
+}
+
+func TestSchedulerStateIdLikeIndex(t *testing.T) {
+	is := is.New(t)
+	v := &VMAP{AdBreaks: []AdBreak{
+		{Id: "#1", TimeOffset: DurationOffset(time.Minute)},
+		{TimeOffset: StartOffset()},
+	}}
+	s := NewScheduler(v, time.Hour, nil, SeekPlayAll)
+	is.Equal(breakIds(s.Advance(0)), []string{""})
+	st := s.State()
+	is.Equal(st.Played, []string(nil))
+	is.Equal(st.PlayedIndexes, []int{1})
+
+	resumed := NewScheduler(v, time.Hour, nil, SeekPlayAll)
+	resumed.SetState(st)
+	is.True(!resumed.Played(&v.AdBreaks[0]))
+	is.Equal(breakIds(resumed.Advance(time.Minute)), []string{"#1"})
+}
@@ -1,10 +1,11 @@
 package vmap
 
 import (
+	"bytes"
 	"encoding/xml"
 	"fmt"
+	"math"
 	"strconv"
-	"strings"
 	"time"
 )
 
@@ -14,6 +15,7 @@ type VMAP struct {
 	Vmap     string    `xml:"vmap,attr" json:"vmap"`
 	Version  string    `xml:"version,attr" json:"version"`
 	AdBreaks []AdBreak `xml:"AdBreak" json:"adBreaks"`
+	Extra    *Extra    `xml:"-" json:"-"`
 }
 
 type AdBreak struct {
@@ -22,19 +24,25 @@ type AdBreak struct {
 	Id             string          `xml:"breakId,attr" json:"id"`
 	BreakType      string          `xml:"breakType,attr" json:"breakType"`
 	TimeOffset     TimeOffset      `xml:"timeOffset,attr" json:"timeOffset"`
+	Extra          *Extra          `xml:"-" json:"-"`
+
+	lazy *lazyVast // the undecoded VAST, see DecodeOptions.Lazy
 }
 
 type AdSource struct {
 	VASTData *VASTData `xml:"VASTAdData"`
+	Extra    *Extra    `xml:"-" json:"-"`
 }
 
 type TrackingEvent struct {
 	Event string `xml:"event,attr" json:"event"`
 	Text  string `xml:",chardata" json:"url"`
+	Extra *Extra `xml:"-" json:"-"`
 }
 
 type VASTData struct {
-	VAST *VAST `xml:"VAST" json:"vast"`
+	VAST  *VAST  `xml:"VAST" json:"vast"`
+	Extra *Extra `xml:"-" json:"-"`
 }
 
 type VAST struct {
@@ -43,12 +51,14 @@ type VAST struct {
 	NoNamespaceSchemaLocation string `xml:"noNamespaceSchemaLocation,attr" json:"noNamespaceSchemaLocation"`
 	Version                   string `xml:"version,attr" json:"version"`
 	Ad                        []Ad   `xml:"Ad" json:"ad"`
+	Extra                     *Extra `xml:"-" json:"-"`
 }
 
 type Ad struct {
 	Id       string  `xml:"id,attr" json:"id"`
 	Sequence int     `xml:"sequence,attr" json:"sequence"`
 	InLine   *InLine `xml:"InLine" json:"inLine"`
+	Extra    *Extra  `xml:"-" json:"-"`
 }
 
 type AdTagURI struct{}
@@ -60,15 +70,18 @@ type InLine struct {
 	Creatives  []Creative   `xml:"Creatives>Creative" json:"creatives"`
 	Extensions []Extension  `xml:"Extensions>Extension" json:"extensions"`
 	Error      *Error       `xml:"Error" json:"error"`
+	Extra      *Extra       `xml:"-" json:"-"`
 }
 
 type Error struct {
 	Value string `xml:",chardata" json:"value"`
+	Extra *Extra `xml:"-" json:"-"`
 }
 
 type Impression struct {
-	Id   string `xml:"id,attr" json:"id"`
-	Text string `xml:",chardata" json:"url"`
+	Id    string `xml:"id,attr" json:"id"`
+	Text  string `xml:",chardata" json:"url"`
+	Extra *Extra `xml:"-" json:"-"`
 }
 
 type Creative struct {
@@ -76,11 +89,13 @@ type Creative struct {
 	AdId          string         `xml:"adId,attr" json:"adId"`
 	UniversalAdId *UniversalAdId `xml:"UniversalAdId" json:"universalAdId"`
 	Linear        *Linear        `xml:"Linear" json:"linear"`
+	Extra         *Extra         `xml:"-" json:"-"`
 }
 
 type UniversalAdId struct {
 	IdRegistry string `xml:"idRegistry,attr" json:"idRegistry"`
 	Id         string `xml:",chardata" json:"id"`
+	Extra      *Extra `xml:"-" json:"-"`
 }
 
 type Linear struct {
@@ -90,21 +105,25 @@ type Linear struct {
 	ClickThrough   *ClickThrough   `xml:"VideoClicks>ClickThrough" json:"clickThrough"`
 	ClickTracking  []ClickTracking `xml:"VideoClicks>ClickTracking" json:"clickTracking"`
 	CustomClick    []CustomClick   `xml:"VideoClicks>CustomClick" json:"customClick"`
+	Extra          *Extra          `xml:"-" json:"-"`
 }
 
 type ClickThrough struct {
-	Id   string `xml:"id,attr" json:"id"`
-	Text string `xml:",chardata" json:"url"`
+	Id    string `xml:"id,attr" json:"id"`
+	Text  string `xml:",chardata" json:"url"`
+	Extra *Extra `xml:"-" json:"-"`
 }
 
 type ClickTracking struct {
-	Id   string `xml:"id,attr" json:"id"`
-	Text string `xml:",chardata" json:"url"`
+	Id    string `xml:"id,attr" json:"id"`
+	Text  string `xml:",chardata" json:"url"`
+	Extra *Extra `xml:"-" json:"-"`
 }
 
 type CustomClick struct {
-	Id   string `xml:"id,attr" json:"id"`
-	Text string `xml:",chardata" json:"url"`
+	Id    string `xml:"id,attr" json:"id"`
+	Text  string `xml:",chardata" json:"url"`
+	Extra *Extra `xml:"-" json:"-"`
 }
 
 type MediaFile struct {
@@ -115,12 +134,14 @@ type MediaFile struct {
 	Delivery  string `xml:"delivery,attr" json:"delivery"`
 	MediaType string `xml:"type,attr" json:"mediaType"`
 	Codec     string `xml:"codec,attr" json:"codec"`
+	Extra     *Extra `xml:"-" json:"-"`
 }
 
 // NOTE: Specifically built for FreeWheel's CreativeParamer extension at the moment.
 type Extension struct {
 	ExtensionType      string              `xml:"type,attr" json:"type"`
 	CreativeParameters []CreativeParameter `xml:"CreativeParameters>CreativeParameter" json:"creativeParameters"`
+	Extra              *Extra              `xml:"-" json:"-"`
 }
 
 type CreativeParameter struct {
@@ -128,112 +149,221 @@ type CreativeParameter struct {
 	Name                  string `xml:"name,attr" json:"name"`
 	Value                 string `xml:",chardata" json:"value"`
 	CreativeParameterType string `xml:"type,attr" json:"creativeParameterType"`
+	Extra                 *Extra `xml:"-" json:"-"`
 }
 
 type Duration struct{ time.Duration }
 
-func (d *Duration) UnmarshalText(data []byte) error {
-	var parts [4]int
-	currentPart := 0
+// maxDurationHours is the largest hour count a time.Duration can hold.
+const maxDurationHours = math.MaxInt64 / int64(time.Hour)
 
-	for i := 0; i < len(data); i++ {
-		b := data[i]
-		switch {
-		case b >= '0' && b <= '9':
-			parts[currentPart] = parts[currentPart]*10 + int(b-'0')
-		case b == ':' || b == '.':
-			currentPart++
-			if currentPart > 3 {
+// UnmarshalText parses a duration of the form HH:MM:SS or HH:MM:SS.mmm.
+// Hours may have more than two digits. The fraction may have any number of
+// digits and is read as a decimal fraction of a second; digits beyond
+// nanosecond precision are dropped. Surrounding whitespace is ignored.
+func (d *Duration) UnmarshalText(data []byte) error {
+	s := bytes.Trim(data, " \t\r\n")
+	var parts [3]int64 // hours, minutes, seconds
+	i := 0
+	for p := range parts {
+		if p > 0 {
+			if i >= len(s) || s[i] != ':' {
 				return fmt.Errorf("invalid duration format: %s", string(data))
 			}
+			i++
+		}
+		start := i
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			parts[p] = parts[p]*10 + int64(s[i]-'0')
+			if parts[p] > maxDurationHours {
+				return fmt.Errorf("duration out of range: %s", string(data))
+			}
+			i++
 		}
+		if n := i - start; n == 0 || p > 0 && n > 2 {
+			return fmt.Errorf("invalid duration format: %s", string(data))
+		}
+	}
+	if parts[1] > 59 || parts[2] > 59 {
+		return fmt.Errorf("invalid duration format: %s", string(data))
 	}
 
-	if currentPart < 2 {
+	var frac time.Duration
+	if i < len(s) && s[i] == '.' {
+		i++
+		start := i
+		scale := 100 * time.Millisecond
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			frac += time.Duration(s[i]-'0') * scale
+			scale /= 10
+			i++
+		}
+		if i == start {
+			return fmt.Errorf("invalid duration format: %s", string(data))
+		}
+	}
+	if i != len(s) {
 		return fmt.Errorf("invalid duration format: %s", string(data))
 	}
 
-	d.Duration = time.Duration(parts[0])*time.Hour +
+	dur := time.Duration(parts[0])*time.Hour +
 		time.Duration(parts[1])*time.Minute +
 		time.Duration(parts[2])*time.Second +
-		time.Duration(parts[3])*time.Millisecond
+		frac
+	if dur < 0 {
+		return fmt.Errorf("duration out of range: %s", string(data))
+	}
+	d.Duration = dur
 	return nil
 }
 
+// MarshalText formats the duration as HH:MM:SS, followed by a fraction
+// when there is one. Whole milliseconds are written with three digits, as
+// HH:MM:SS.mmm; finer durations get as many digits as needed to round-trip
+// through UnmarshalText exactly. Negative durations, which UnmarshalText
+// rejects, are an error.
 func (d Duration) MarshalText() ([]byte, error) {
-	if d.Duration == 0 {
-		return []byte("00:00:00"), nil
-	}
-	hours := int(d.Duration.Hours())
-	minutes := int(d.Duration.Minutes()) % 60
-	seconds := int(d.Duration.Seconds()) % 60
-	milliseconds := int(d.Duration.Milliseconds()) % 1000
-
-	var sb strings.Builder
-	sb.WriteString(fmt.Sprintf("%02d:%02d:%02d", hours, minutes, seconds))
-	if milliseconds > 0 {
-		sb.WriteString(fmt.Sprintf(".%03d", milliseconds))
+	if d.Duration < 0 {
+		return nil, negativeDuration(d.Duration)
 	}
-	return []byte(sb.String()), nil
+	return appendDuration(nil, d), nil
+}
+
+func negativeDuration(d time.Duration) error {
+	return fmt.Errorf("negative duration: %v", d)
 }
 
+// OffsetKind identifies which form of the VMAP timeOffset attribute a
+// TimeOffset holds.
+type OffsetKind uint8
+
+const (
+	// OffsetUnset is the kind of the zero TimeOffset, used when the
+	// timeOffset attribute is missing or empty.
+	OffsetUnset OffsetKind = iota
+	// OffsetStart is "start": the break plays before the content.
+	OffsetStart
+	// OffsetEnd is "end": the break plays after the content.
+	OffsetEnd
+	// OffsetDuration is "HH:MM:SS[.mmm]": a time into the content.
+	OffsetDuration
+	// OffsetPercent is "n%": a percentage of the content duration.
+	OffsetPercent
+	// OffsetPosition is "#n": the n-th cue point of the content.
+	OffsetPosition
+)
+
 // TimeOffset represents the time offset for an ad break in the VMAP document.
+// Kind tells which of the other fields is meaningful.
 type TimeOffset struct {
-	// If this is not nil, we're dealing with a duration offset.
-	Duration *Duration
+	Kind OffsetKind
+
+	// Duration is the time into the content, for OffsetDuration.
+	Duration time.Duration
 
-	//If not zero and duration is nil, it's a position number.
-	// -1 is reserved for start, -2 for end.
+	// Percent is the percentage of the content duration, from 0 to 100,
+	// for OffsetPercent.
+	Percent float64
+
+	// Position is the 1-based cue point number, for OffsetPosition.
 	Position int
+}
+
+// StartOffset returns the "start" offset.
+func StartOffset() TimeOffset { return TimeOffset{Kind: OffsetStart} }
+
+// EndOffset returns the "end" offset.
+func EndOffset() TimeOffset { return TimeOffset{Kind: OffsetEnd} }
 
-	// If duration is nil and position is zero, this is a percentage offset.
-	Percent float32
+// DurationOffset returns an offset d into the content.
+func DurationOffset(d time.Duration) TimeOffset {
+	return TimeOffset{Kind: OffsetDuration, Duration: d}
 }
 
-const (
-	OffsetStart = -1
-	OffsetEnd   = -2
-)
+// PercentOffset returns an offset of p percent of the content duration.
+func PercentOffset(p float64) TimeOffset {
+	return TimeOffset{Kind: OffsetPercent, Percent: p}
+}
 
+// PositionOffset returns an offset at the n-th cue point of the content.
+func PositionOffset(n int) TimeOffset {
+	return TimeOffset{Kind: OffsetPosition, Position: n}
+}
+
+// UnmarshalText parses any of the timeOffset forms of VMAP 1.0: "start",
+// "end", a duration, a percentage such as "25%" or "12.5%", or a position
+// such as "#3". Empty input gives the unset offset.
 func (to *TimeOffset) UnmarshalText(data []byte) error {
-	switch string(data) {
-	case "start":
-		to.Position = OffsetStart
+	s := bytes.Trim(data, " \t\r\n")
+	*to = TimeOffset{}
+	switch {
+	case len(s) == 0:
 		return nil
-	case "end":
-		to.Position = OffsetEnd
+	case string(s) == "start":
+		to.Kind = OffsetStart
 		return nil
-	}
-	if strings.HasSuffix(string(data), "%") {
-		p, err := strconv.ParseInt(strings.TrimSuffix(string(data), "%"), 10, 8)
-		if err != nil {
-			return fmt.Errorf("error parsing percentage offset: %w", err)
+	case string(s) == "end":
+		to.Kind = OffsetEnd
+		return nil
+	case s[len(s)-1] == '%':
+		num := s[:len(s)-1]
+		if !isDecimal(num) {
+			return fmt.Errorf("error parsing percentage offset: %s", string(data))
+		}
+		p, err := strconv.ParseFloat(string(num), 64)
+		if err != nil || p > 100 {
+			return fmt.Errorf("error parsing percentage offset: %s", string(data))
 		}
-		to.Percent = float32(p) / 100
+		to.Kind, to.Percent = OffsetPercent, p
 		return nil
-	}
-	if strings.HasPrefix(string(data), "#") {
-		p, err := strconv.ParseInt(strings.TrimPrefix(string(data), "#"), 10, 8)
-		if err != nil {
-			return fmt.Errorf("error parsing position offset: %w", err)
+	case s[0] == '#':
+		if len(s) < 2 || s[1] < '0' || s[1] > '9' {
+			return fmt.Errorf("error parsing position offset: %s", string(data))
 		}
-		to.Position = int(p)
+		n, err := strconv.Atoi(string(s[1:]))
+		if err != nil || n < 1 {
+			return fmt.Errorf("error parsing position offset: %s", string(data))
+		}
+		to.Kind, to.Position = OffsetPosition, n
 		return nil
 	}
 	var d Duration
-	to.Duration = &d
-	return to.Duration.UnmarshalText(data)
+	if err := d.UnmarshalText(s); err != nil {
+		return err
+	}
+	to.Kind, to.Duration = OffsetDuration, d.Duration
+	return nil
 }
 
-func (to TimeOffset) MarshalText() ([]byte, error) {
-	if to.Duration != nil {
-		return to.Duration.MarshalText()
-	}
-	if to.Position != 0 {
-		return []byte(fmt.Sprintf("#%d", to.Position)), nil
+// isDecimal reports whether b is an unsigned decimal number with an
+// optional fraction, such as "25" or "12.5".
+func isDecimal(b []byte) bool {
+	digits, dot := 0, false
+	for i, c := range b {
+		switch {
+		case c >= '0' && c <= '9':
+			digits++
+		case c == '.' && !dot && i > 0 && i < len(b)-1:
+			dot = true
+		default:
+			return false
+		}
 	}
-	if to.Percent != 0 {
-		return []byte(fmt.Sprintf("%f%%", to.Percent*100)), nil
+	return digits > 0
+}
+
+// MarshalText formats the offset in the same form UnmarshalText accepts.
+// Percentages are written with the fewest digits that represent them
+// exactly, so "12.5%" stays "12.5%". The unset offset formats as "", and
+// negative durations are an error.
+func (to TimeOffset) MarshalText() ([]byte, error) {
+	if to.Kind == OffsetDuration && to.Duration < 0 {
+		return nil, negativeDuration(to.Duration)
 	}
-	return []byte(""), nil
+	return appendTimeOffset(nil, to), nil
+}
+
+// String returns the offset as written in a timeOffset attribute.
+func (to TimeOffset) String() string {
+	return string(appendTimeOffset(nil, to))
 }
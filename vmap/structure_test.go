@@ -31,22 +31,21 @@ func TestUnmarshalVMAP(t *testing.T) {
 	firstBreak := vmap.AdBreaks[0]
 	is.Equal(firstBreak.Id, "midroll.ad-1")
 	is.Equal(firstBreak.BreakType, "linear")
-	is.True(firstBreak.TimeOffset.Duration == nil)
-	is.Equal(firstBreak.TimeOffset.Position, OffsetStart)
+	is.Equal(firstBreak.TimeOffset.Kind, OffsetStart)
 	is.True(firstBreak.AdSource.VASTData.VAST != nil)
 	is.Equal(len(firstBreak.TrackingEvents), 1)
 
 	secondBreak := vmap.AdBreaks[1]
 	is.Equal(secondBreak.Id, "midroll.ad-2")
 	is.Equal(secondBreak.BreakType, "linear")
-	is.Equal(*secondBreak.TimeOffset.Duration, Duration{5 * time.Minute})
+	is.Equal(secondBreak.TimeOffset, DurationOffset(5*time.Minute))
 	is.True(firstBreak.AdSource.VASTData.VAST != nil)
 	is.Equal(len(secondBreak.TrackingEvents), 1)
 
 	thirdBreak := vmap.AdBreaks[2]
 	is.Equal(thirdBreak.Id, "midroll.ad-3")
 	is.Equal(thirdBreak.BreakType, "linear")
-	is.Equal(*thirdBreak.TimeOffset.Duration, Duration{7 * time.Minute})
+	is.Equal(thirdBreak.TimeOffset, DurationOffset(7*time.Minute))
 	is.True(thirdBreak.AdSource.VASTData.VAST != nil)
 	is.Equal(len(thirdBreak.TrackingEvents), 1)
 }
@@ -72,6 +71,12 @@ func TestDecodeVmapEmptyVast(t *testing.T) {
 
 	is.Equal(len(vmap.AdBreaks), 1)
 	is.Equal(len(vmap.AdBreaks[0].AdSource.VASTData.VAST.Ad), 0)
+	is.Equal(vmap.AdBreaks[0].AdSource.VASTData.VAST.Version, "4.1")
+
+	vmap, err = DecodeVmapScan(doc)
+	is.NoErr(err)
+	is.Equal(len(vmap.AdBreaks[0].AdSource.VASTData.VAST.Ad), 0)
+	is.Equal(vmap.AdBreaks[0].AdSource.VASTData.VAST.Version, "4.1")
 }
 
 func TestDecodeEmptyVast(t *testing.T) {
@@ -83,6 +88,70 @@ func TestDecodeEmptyVast(t *testing.T) {
 	is.NoErr(err)
 
 	is.Equal(len(vast.Ad), 0)
+	is.Equal(vast.Version, "4.1")
+
+	vast, err = DecodeVastScan(doc)
+	is.NoErr(err)
+	is.Equal(len(vast.Ad), 0)
+	is.Equal(vast.Version, "4.1")
+}
+
+func TestDecodeSingleQuotedAttrs(t *testing.T) {
+	doc, err := os.ReadFile("sample-vmap/testVast.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, decode := range map[string]func([]byte) (VAST, error){
+		"tokenizer": DecodeVast,
+		"scan":      DecodeVastScan,
+	} {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			vast, err := decode(doc)
+			is.NoErr(err)
+			ext := vast.Ad[0].InLine.Extensions[0]
+			is.Equal(ext.ExtensionType, "FreeWheel")                    // type='FreeWheel'
+			is.Equal(ext.CreativeParameters[0].CreativeId, "132285420") // creativeId='132285420'
+		})
+	}
+}
+
+func TestDecodeAttrInValue(t *testing.T) {
+	doc := []byte(`<VAST x=" version='1.0' id=" version="4.0"><Ad data-x='id="b"' id="a"></Ad></VAST>`)
+	for name, decode := range map[string]func([]byte) (VAST, error){
+		"tokenizer": DecodeVast,
+		"scan":      DecodeVastScan,
+	} {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			vast, err := decode(doc)
+			is.NoErr(err)
+			is.Equal(vast.Version, "4.0")
+			is.Equal(vast.Ad[0].Id, "a")
+		})
+	}
+}
+
+func TestDecodeCustomClickAndSchema(t *testing.T) {
+	doc := []byte(`<VAST xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" ` +
+		`xsi:noNamespaceSchemaLocation="vast.xsd" version="4.0"><Ad><InLine><Creatives><Creative><Linear>` +
+		`<VideoClicks><CustomClick id="cc">http://c/1</CustomClick></VideoClicks>` +
+		`</Linear></Creative></Creatives></InLine></Ad></VAST>`)
+
+	for name, decode := range map[string]func([]byte) (VAST, error){
+		"tokenizer": DecodeVast,
+		"scan":      DecodeVastScan,
+	} {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			vast, err := decode(doc)
+			is.NoErr(err)
+			is.Equal(vast.Xsi, "http://www.w3.org/2001/XMLSchema-instance")
+			is.Equal(vast.NoNamespaceSchemaLocation, "vast.xsd")
+			is.Equal(vast.Ad[0].InLine.Creatives[0].Linear.CustomClick, []CustomClick{{Id: "cc", Text: "http://c/1"}})
+		})
+	}
 }
 
 func TestDecodeVmap(t *testing.T) {
@@ -102,22 +171,21 @@ func TestDecodeVmap(t *testing.T) {
 	firstBreak := vmap.AdBreaks[0]
 	is.Equal(firstBreak.Id, "midroll.ad-1")
 	is.Equal(firstBreak.BreakType, "linear")
-	is.True(firstBreak.TimeOffset.Duration == nil)
-	is.Equal(firstBreak.TimeOffset.Position, OffsetStart)
+	is.Equal(firstBreak.TimeOffset.Kind, OffsetStart)
 	is.True(firstBreak.AdSource.VASTData.VAST != nil)
 	is.Equal(len(firstBreak.TrackingEvents), 1)
 
 	secondBreak := vmap.AdBreaks[1]
 	is.Equal(secondBreak.Id, "midroll.ad-2")
 	is.Equal(secondBreak.BreakType, "linear")
-	is.Equal(*secondBreak.TimeOffset.Duration, Duration{5 * time.Minute})
+	is.Equal(secondBreak.TimeOffset, DurationOffset(5*time.Minute))
 	is.True(firstBreak.AdSource.VASTData.VAST != nil)
 	is.Equal(len(secondBreak.TrackingEvents), 1)
 
 	thirdBreak := vmap.AdBreaks[2]
 	is.Equal(thirdBreak.Id, "midroll.ad-3")
 	is.Equal(thirdBreak.BreakType, "linear")
-	is.Equal(*thirdBreak.TimeOffset.Duration, Duration{7 * time.Minute})
+	is.Equal(thirdBreak.TimeOffset, DurationOffset(7*time.Minute))
 	is.True(thirdBreak.AdSource.VASTData.VAST != nil)
 	is.Equal(len(thirdBreak.TrackingEvents), 1)
 }
@@ -323,6 +391,38 @@ func BenchmarkScanDecode(b *testing.B) {
 	}
 }
 
+func BenchmarkScanDecodeInto(b *testing.B) {
+	doc, err := os.ReadFile("sample-vmap/testVmap.xml")
+	if err != nil {
+		panic(err)
+	}
+
+	var vmap VMAP
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = DecodeVmapScanInto(&vmap, doc)
+	}
+}
+
+func BenchmarkScanDecodeIntoPool(b *testing.B) {
+	doc, err := os.ReadFile("sample-vmap/testVmap.xml")
+	if err != nil {
+		panic(err)
+	}
+
+	pool := sync.Pool{New: func() any { return new(VMAP) }}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			vmap := pool.Get().(*VMAP)
+			_ = DecodeVmapScanInto(vmap, doc)
+			pool.Put(vmap)
+		}
+	})
+}
+
 func TestDecodeVmapScan(t *testing.T) {
 	is := is.New(t)
 	doc, err := os.ReadFile("sample-vmap/testVmap.xml")
@@ -693,6 +793,27 @@ func BenchmarkFastMarshalVast(b *testing.B) {
 	}
 }
 
+func BenchmarkEncodeVmap(b *testing.B) {
+	v := bigVmap(b, 20)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := EncodeVmap(io.Discard, v, EncodeOptions{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarshalVmapAppendEstimated(b *testing.B) {
+	v := bigVmap(b, 20)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf := make([]byte, 0, EstimateVmapSize(v, EncodeOptions{}))
+		_, _ = MarshalVmapAppend(buf, v)
+	}
+}
+
 func TestDecodeCompliance(t *testing.T) {
 	wg := sync.WaitGroup{}
 	//Check for race conditions
@@ -784,3 +905,398 @@ func TestDecodeCompliance(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestUnescapeXML(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "plain", want: "plain"},
+		{in: "a&amp;b&lt;c&gt;d&apos;e&quot;f", want: "a&b<c>d'e\"f"},
+		{in: "line&#10;break", want: "line\nbreak"},
+		{in: "line&#xA;break", want: "line\nbreak"},
+		{in: "&#xF6;&#246;&#x1F600;", want: "öö😀"},
+		{in: "&#65;&#x41;&#x00041;", want: "AAA"},
+		{in: "&xml;", wantErr: true},
+		{in: "&nbsp;", wantErr: true},
+		{in: "&#;", wantErr: true},
+		{in: "&#x;", wantErr: true},
+		{in: "&#12a;", wantErr: true},
+		{in: "&#X41;", wantErr: true},
+		{in: "&#0;", wantErr: true},
+		{in: "&#xD800;", wantErr: true},
+		{in: "&#x110000;", wantErr: true},
+		{in: "a & b", wantErr: true},
+		{in: "trailing&amp", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.in, func(t *testing.T) {
+			is := is.New(t)
+			got, err := unescapeXML([]byte(tc.in))
+			if tc.wantErr {
+				is.True(err != nil)
+				return
+			}
+			is.NoErr(err)
+			is.Equal(string(got), tc.want)
+		})
+	}
+}
+
+func TestDecodeCharacterReferences(t *testing.T) {
+	is := is.New(t)
+	doc := []byte(`<VAST version="4.0"><Ad id="a&amp;b" sequence="1"><InLine>` +
+		`<AdTitle>one&#10;two&#xA;three&#x9;</AdTitle></InLine></Ad></VAST>`)
+
+	var vastUnmarshal VAST
+	is.NoErr(xml.Unmarshal(doc, &vastUnmarshal))
+	vastDecoded, err := DecodeVast(doc)
+	is.NoErr(err)
+	vastScanned, err := DecodeVastScan(doc)
+	is.NoErr(err)
+
+	is.Equal(vastDecoded.Ad[0].InLine.AdTitle, "one\ntwo\nthree\t")
+	is.Equal(vastDecoded.Ad[0].InLine.AdTitle, vastUnmarshal.Ad[0].InLine.AdTitle)
+	is.Equal(vastScanned.Ad[0].InLine.AdTitle, vastUnmarshal.Ad[0].InLine.AdTitle)
+	is.Equal(vastDecoded.Ad[0].Id, "a&b")
+	is.Equal(vastScanned.Ad[0].Id, "a&b")
+}
+
+func TestDecodeUnknownEntity(t *testing.T) {
+	is := is.New(t)
+	doc := []byte(`<VAST version="4.0"><Ad id="1" sequence="1"><InLine>` +
+		`<AdTitle>caf&eacute;</AdTitle></InLine></Ad></VAST>`)
+
+	_, err := DecodeVast(doc)
+	is.True(err != nil)
+
+	// The scan decoder is lenient and keeps the text undecoded.
+	vast, err := DecodeVastScan(doc)
+	is.NoErr(err)
+	is.Equal(vast.Ad[0].InLine.AdTitle, "caf&eacute;")
+}
+
+func TestDecodeMalformedNoPanic(t *testing.T) {
+	docs := []string{
+		"</>",
+		"<VAST><Ad><InLine><Creatives><Creative><VideoClicks><ClickThrough>x</ClickThrough>",
+		"<VMAP><AdBreak><VAST><Ad><InLine><Creatives><Creative><ClickThrough>x</ClickThrough>",
+	}
+	for _, doc := range docs {
+		t.Run(doc, func(t *testing.T) {
+			_, _ = DecodeVast([]byte(doc))
+			_, _ = DecodeVmap([]byte(doc))
+			_, _ = DecodeVastScan([]byte(doc))
+			_, _ = DecodeVmapScan([]byte(doc))
+		})
+	}
+}
+
+func TestDecodeTruncatedTagReturnsError(t *testing.T) {
+	is := is.New(t)
+	_, err := DecodeVast([]byte("</>"))
+	is.True(err != nil)
+	_, err = DecodeVmap([]byte("</>"))
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), "malformed XML document"))
+}
+
+// indexPanicReader panics as the tokenizer does on some truncated tags, but
+// from outside it.
+type indexPanicReader struct{}
+
+func (indexPanicReader) Read(p []byte) (int, error) {
+	var none []byte
+	return int(none[len(p)]), nil
+}
+
+func TestDecodeOtherPanics(t *testing.T) {
+	is := is.New(t)
+	defer func() {
+		p := recover()
+		is.True(p != nil) // not taken for malformed input
+	}()
+	_, _ = NewVmapDecoder(indexPanicReader{}).Next()
+}
+
+func TestDecodeVmapScanStrict(t *testing.T) {
+	doc := []byte(`<VMAP version="1.0"><AdBreak breakId="1" timeOffset="#first"></AdBreak>` +
+		`<AdBreak breakId="2" timeOffset="#2"></AdBreak></VMAP>`)
+
+	t.Run("lenient", func(t *testing.T) {
+		is := is.New(t)
+		vmap, warnings, err := DecodeVmapScanWithOptions(doc, DecodeOptions{})
+		is.NoErr(err)
+		is.Equal(len(vmap.AdBreaks), 2)
+		is.Equal(len(warnings), 1)
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		is := is.New(t)
+		_, warnings, err := DecodeVmapScanWithOptions(doc, DecodeOptions{Strict: true})
+		is.True(err != nil)
+		is.Equal(len(warnings), 0)
+	})
+
+	t.Run("well-formed", func(t *testing.T) {
+		is := is.New(t)
+		doc, err := os.ReadFile("sample-vmap/testVmap.xml")
+		is.NoErr(err)
+		vmap1, err := DecodeVmapScan(doc)
+		is.NoErr(err)
+		vmap2, warnings, err := DecodeVmapScanWithOptions(doc, DecodeOptions{Strict: true})
+		is.NoErr(err)
+		is.Equal(len(warnings), 0)
+		is.Equal(len(vmap1.AdBreaks), len(vmap2.AdBreaks))
+	})
+}
+
+func TestDecodeVastScanStrict(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+	}{
+		{name: "unterminated", doc: `<VAST version="4.0"><Ad id="1"><InLine><AdTitle>x</AdTitle>`},
+		{name: "sequence", doc: `<VAST version="4.0"><Ad id="1" sequence="first"></Ad></VAST>`},
+		{name: "bitrate", doc: `<VAST><Ad><InLine><Creatives><Creative><Linear>` +
+			`<MediaFiles><MediaFile bitrate="high">x</MediaFile></MediaFiles>` +
+			`</Linear></Creative></Creatives></InLine></Ad></VAST>`},
+		{name: "duration", doc: `<VAST><Ad><InLine><Creatives><Creative><Linear>` +
+			`<Duration>5 seconds</Duration></Linear></Creative></Creatives></InLine></Ad></VAST>`},
+		{name: "entity", doc: `<VAST><Ad><InLine><AdTitle>&bogus;</AdTitle></InLine></Ad></VAST>`},
+		{name: "cdata", doc: `<VAST><Ad><InLine><AdTitle><![CDATA[x</AdTitle></InLine></Ad></VAST>`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+			_, warnings, err := DecodeVastScanWithOptions([]byte(tc.doc), DecodeOptions{})
+			is.NoErr(err)
+			is.True(len(warnings) > 0)
+
+			_, _, err = DecodeVastScanWithOptions([]byte(tc.doc), DecodeOptions{Strict: true})
+			is.True(err != nil)
+		})
+	}
+}
+
+func TestDurationConformance(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		out     string // canonical MarshalText output; defaults to in
+		wantErr bool
+	}{
+		{in: "00:00:00", want: 0},
+		{in: "00:00:10", want: 10 * time.Second},
+		{in: "01:02:03", want: time.Hour + 2*time.Minute + 3*time.Second},
+		{in: "00:00:05.5", want: 5500 * time.Millisecond, out: "00:00:05.500"},
+		{in: "00:00:05.50", want: 5500 * time.Millisecond, out: "00:00:05.500"},
+		{in: "00:00:05.500", want: 5500 * time.Millisecond},
+		{in: "00:00:05.005", want: 5005 * time.Millisecond},
+		{in: "00:00:05.1234", want: 5*time.Second + 123400*time.Microsecond},
+		{in: "00:00:05.123456789", want: 5*time.Second + 123456789},
+		{in: "00:00:05.1234567891", want: 5*time.Second + 123456789, out: "00:00:05.123456789"},
+		{in: "00:00:00.000001", want: time.Microsecond},
+		{in: "100:00:00", want: 100 * time.Hour},
+		{in: "2562047:00:00", want: 2562047 * time.Hour},
+		{in: "1:02:03", want: time.Hour + 2*time.Minute + 3*time.Second, out: "01:02:03"},
+		{in: "\n 00:00:30 \t", want: 30 * time.Second, out: "00:00:30"},
+		{in: "", wantErr: true},
+		{in: "00:00", wantErr: true},
+		{in: "01:04:01:12.345", wantErr: true},
+		{in: "00:00:10:500", wantErr: true},
+		{in: "00:60:00", wantErr: true},
+		{in: "00:00:60", wantErr: true},
+		{in: "00:000:10", wantErr: true},
+		{in: "00:00:10.", wantErr: true},
+		{in: "00:00:1x", wantErr: true},
+		{in: "00:xx:10", wantErr: true},
+		{in: "-00:00:10", wantErr: true},
+		{in: "00:00:10 seconds", wantErr: true},
+		{in: "99999999:00:00", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.in, func(t *testing.T) {
+			is := is.New(t)
+			var d Duration
+			err := d.UnmarshalText([]byte(tc.in))
+			if tc.wantErr {
+				is.True(err != nil)
+				return
+			}
+			is.NoErr(err)
+			is.Equal(d.Duration, tc.want)
+
+			want := tc.out
+			if want == "" {
+				want = tc.in
+			}
+			out, err := d.MarshalText()
+			is.NoErr(err)
+			is.Equal(string(out), want)
+			is.Equal(string(appendDuration(nil, d)), want)
+
+			var back Duration
+			is.NoErr(back.UnmarshalText(out))
+			is.Equal(back, d)
+		})
+	}
+}
+
+func TestDurationRoundTripMarshalVast(t *testing.T) {
+	is := is.New(t)
+	durations := []time.Duration{
+		5500 * time.Millisecond,
+		5*time.Second + 123456789,
+		101*time.Hour + 59*time.Minute + 59*time.Second + time.Microsecond,
+	}
+	for _, dur := range durations {
+		in := VAST{Version: "4.0", Ad: []Ad{{Id: "1", InLine: &InLine{
+			Creatives: []Creative{{Linear: &Linear{Duration: Duration{dur}}}},
+		}}}}
+		doc, err := MarshalVast(&in)
+		is.NoErr(err)
+
+		var std VAST
+		is.NoErr(xml.Unmarshal(doc, &std))
+		decoded, err := DecodeVast(doc)
+		is.NoErr(err)
+		scanned, err := DecodeVastScan(doc)
+		is.NoErr(err)
+
+		is.Equal(std.Ad[0].InLine.Creatives[0].Linear.Duration.Duration, dur)
+		is.Equal(decoded.Ad[0].InLine.Creatives[0].Linear.Duration.Duration, dur)
+		is.Equal(scanned.Ad[0].InLine.Creatives[0].Linear.Duration.Duration, dur)
+	}
+}
+
+func TestDurationNegative(t *testing.T) {
+	is := is.New(t)
+	_, err := Duration{-5 * time.Second}.MarshalText()
+	is.True(err != nil) // negative durations do not parse
+	_, err = DurationOffset(-time.Millisecond).MarshalText()
+	is.True(err != nil)
+	is.Equal(DurationOffset(-time.Millisecond).String(), "-00:00:00.001")
+
+	vast := func(d time.Duration) *AdSource {
+		return &AdSource{VASTData: &VASTData{VAST: &VAST{Ad: []Ad{{InLine: &InLine{
+			Creatives: []Creative{{Linear: &Linear{Duration: Duration{d}}}},
+		}}}}}}
+	}
+	lossless := decodeLossless(t, []byte(`<vmap:VMAP version="1.0"><vmap:AdBreak timeOffset="start">`+
+		`</vmap:AdBreak></vmap:VMAP>`))
+	lossless.AdBreaks[0].TimeOffset = DurationOffset(-time.Second)
+	for _, v := range []VMAP{
+		{Version: "1.0", AdBreaks: []AdBreak{{TimeOffset: DurationOffset(-time.Second), AdSource: vast(0)}}},
+		{Version: "1.0", AdBreaks: []AdBreak{{TimeOffset: StartOffset(), AdSource: vast(-time.Hour)}}},
+		lossless,
+	} {
+		for _, opts := range allEncodeOptions {
+			doc, err := MarshalVmapWithOptions(&v, opts)
+			is.True(err != nil)
+			is.Equal(doc, nil)
+			buf := []byte("x")
+			doc, err = MarshalVmapAppendWithOptions(buf, &v, opts)
+			is.True(err != nil)
+			is.Equal(string(doc), "x")
+			is.True(EncodeVmap(io.Discard, &v, opts) != nil)
+		}
+		_, err = xml.Marshal(v)
+		is.True(err != nil)
+	}
+	_, err = MarshalVast(vast(-time.Hour).VASTData.VAST)
+	is.True(err != nil)
+}
+
+func TestTimeOffsetConformance(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    TimeOffset
+		out     string // canonical MarshalText output; defaults to in
+		wantErr bool
+	}{
+		{in: "", want: TimeOffset{}},
+		{in: "start", want: StartOffset()},
+		{in: "end", want: EndOffset()},
+		{in: "00:10:00", want: DurationOffset(10 * time.Minute)},
+		{in: "00:00:05.250", want: DurationOffset(5250 * time.Millisecond)},
+		{in: "120:00:00", want: DurationOffset(120 * time.Hour)},
+		{in: "0%", want: PercentOffset(0)},
+		{in: "25%", want: PercentOffset(25)},
+		{in: "12.5%", want: PercentOffset(12.5)},
+		{in: "33.333%", want: PercentOffset(33.333)},
+		{in: "100%", want: PercentOffset(100)},
+		{in: "25.0%", want: PercentOffset(25), out: "25%"},
+		{in: "#1", want: PositionOffset(1)},
+		{in: "#3", want: PositionOffset(3)},
+		{in: "#128", want: PositionOffset(128)},
+		{in: "#1000", want: PositionOffset(1000)},
+		{in: "Start", wantErr: true},
+		{in: "150%", wantErr: true},
+		{in: "-5%", wantErr: true},
+		{in: "1e2%", wantErr: true},
+		{in: ".5%", wantErr: true},
+		{in: "%", wantErr: true},
+		{in: "#", wantErr: true},
+		{in: "#0", wantErr: true},
+		{in: "#-1", wantErr: true},
+		{in: "#+2", wantErr: true},
+		{in: "#x", wantErr: true},
+		{in: "10 minutes", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.in, func(t *testing.T) {
+			is := is.New(t)
+			var to TimeOffset
+			err := to.UnmarshalText([]byte(tc.in))
+			if tc.wantErr {
+				is.True(err != nil)
+				return
+			}
+			is.NoErr(err)
+			is.Equal(to, tc.want)
+
+			want := tc.out
+			if want == "" {
+				want = tc.in
+			}
+			out, err := to.MarshalText()
+			is.NoErr(err)
+			is.Equal(string(out), want)
+			is.Equal(to.String(), want)
+			is.Equal(string(appendTimeOffset(nil, to)), want)
+
+			js, err := json.Marshal(to)
+			is.NoErr(err)
+			is.Equal(string(js), `"`+want+`"`)
+			var back TimeOffset
+			is.NoErr(json.Unmarshal(js, &back))
+			is.Equal(back, to)
+		})
+	}
+}
+
+func TestTimeOffsetMarshalVmap(t *testing.T) {
+	is := is.New(t)
+	v := VMAP{Version: "1.0", AdBreaks: []AdBreak{
+		{Id: "pre", TimeOffset: StartOffset()},
+		{Id: "mid", TimeOffset: PercentOffset(12.5)},
+		{Id: "cue", TimeOffset: PositionOffset(200)},
+		{Id: "post", TimeOffset: EndOffset()},
+	}}
+	got, err := MarshalVmap(&v)
+	is.NoErr(err)
+	expected, err := xml.Marshal(v)
+	is.NoErr(err)
+	is.Equal(string(got), string(expected))
+
+	decoded, err := DecodeVmap(got)
+	is.NoErr(err)
+	scanned, err := DecodeVmapScan(got)
+	is.NoErr(err)
+	for i := range v.AdBreaks {
+		is.Equal(decoded.AdBreaks[i].TimeOffset, v.AdBreaks[i].TimeOffset)
+		is.Equal(scanned.AdBreaks[i].TimeOffset, v.AdBreaks[i].TimeOffset)
+	}
+}
@@ -0,0 +1,112 @@
+package vmap
+
+import (
+	"cmp"
+	"errors"
+	"math"
+	"slices"
+	"time"
+)
+
+var (
+	// ErrOffsetUnset is reported for an ad break without a timeOffset.
+	ErrOffsetUnset = errors.New("ad break has no time offset")
+	// ErrOutsideContent is reported for an ad break whose offset lies past
+	// the end of the content.
+	ErrOutsideContent = errors.New("ad break offset is outside the content")
+	// ErrNoCuePoint is reported for a position offset ("#n") when the
+	// content has fewer than n cue points.
+	ErrNoCuePoint = errors.New("ad break refers to a missing cue point")
+)
+
+// Timeline is the result of resolving the ad breaks of a VMAP against a
+// piece of content.
+type Timeline struct {
+	// Slots holds the resolved ad breaks grouped by offset, in increasing
+	// offset order.
+	Slots []TimelineSlot
+	// Unplaced holds the ad breaks that could not be placed on the content
+	// timeline, in document order.
+	Unplaced []UnplacedBreak
+}
+
+// TimelineSlot is a position on the content timeline with the ad breaks
+// scheduled there.
+type TimelineSlot struct {
+	// Offset is the position in the content. Pre-rolls are at zero and
+	// post-rolls at the content duration.
+	Offset time.Duration
+	// Breaks are the ad breaks at Offset, in document order. They point
+	// into the AdBreaks of the VMAP the timeline was built from.
+	Breaks []*AdBreak
+}
+
+// UnplacedBreak is an ad break that could not be placed on the timeline.
+type UnplacedBreak struct {
+	Break *AdBreak
+	// Err tells why: ErrOffsetUnset, ErrOutsideContent or ErrNoCuePoint.
+	Err error
+}
+
+// Timeline resolves the offset of every ad break to an absolute position in
+// content of the given duration. Percentages are taken of contentDuration
+// and "#n" offsets refer to the n-th of cuePoints in time order. Breaks that
+// share a position are grouped in one slot.
+func (v *VMAP) Timeline(contentDuration time.Duration, cuePoints []time.Duration) Timeline {
+	cues := slices.Clone(cuePoints)
+	slices.Sort(cues)
+
+	var tl Timeline
+	type placed struct {
+		offset time.Duration
+		ab     *AdBreak
+	}
+	var all []placed
+	for i := range v.AdBreaks {
+		ab := &v.AdBreaks[i]
+		offset, err := resolveOffset(ab.TimeOffset, contentDuration, cues)
+		if err != nil {
+			tl.Unplaced = append(tl.Unplaced, UnplacedBreak{Break: ab, Err: err})
+			continue
+		}
+		all = append(all, placed{offset: offset, ab: ab})
+	}
+
+	// A stable sort keeps breaks with equal offsets in document order.
+	slices.SortStableFunc(all, func(a, b placed) int { return cmp.Compare(a.offset, b.offset) })
+	for _, p := range all {
+		if n := len(tl.Slots); n > 0 && tl.Slots[n-1].Offset == p.offset {
+			tl.Slots[n-1].Breaks = append(tl.Slots[n-1].Breaks, p.ab)
+			continue
+		}
+		tl.Slots = append(tl.Slots, TimelineSlot{Offset: p.offset, Breaks: []*AdBreak{p.ab}})
+	}
+	return tl
+}
+
+// resolveOffset returns the absolute position of to in the content. cues
+// must be sorted.
+func resolveOffset(to TimeOffset, contentDuration time.Duration, cues []time.Duration) (time.Duration, error) {
+	var offset time.Duration
+	switch to.Kind {
+	case OffsetStart:
+		return 0, nil
+	case OffsetEnd:
+		return contentDuration, nil
+	case OffsetDuration:
+		offset = to.Duration
+	case OffsetPercent:
+		offset = time.Duration(math.Round(float64(contentDuration) * to.Percent / 100))
+	case OffsetPosition:
+		if to.Position < 1 || to.Position > len(cues) {
+			return 0, ErrNoCuePoint
+		}
+		offset = cues[to.Position-1]
+	default:
+		return 0, ErrOffsetUnset
+	}
+	if offset < 0 || offset > contentDuration {
+		return 0, ErrOutsideContent
+	}
+	return offset, nil
+}
@@ -0,0 +1,76 @@
+package vmap
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestTimeline(t *testing.T) {
+	is := is.New(t)
+	v := VMAP{AdBreaks: []AdBreak{
+		{Id: "post", TimeOffset: EndOffset()},
+		{Id: "quarter", TimeOffset: PercentOffset(25)},
+		{Id: "pre-1", TimeOffset: StartOffset()},
+		{Id: "cue-2", TimeOffset: PositionOffset(2)},
+		{Id: "ten", TimeOffset: DurationOffset(10 * time.Minute)},
+		{Id: "pre-2", TimeOffset: DurationOffset(0)},
+		{Id: "late", TimeOffset: DurationOffset(2 * time.Hour)},
+		{Id: "cue-9", TimeOffset: PositionOffset(9)},
+		{Id: "unset"},
+		{Id: "ten-2", TimeOffset: PositionOffset(1)},
+	}}
+	// Cue points out of order on purpose; #1 is 10 minutes, #2 is 30.
+	cues := []time.Duration{30 * time.Minute, 10 * time.Minute}
+
+	tl := v.Timeline(time.Hour, cues)
+
+	type slot struct {
+		offset time.Duration
+		ids    []string
+	}
+	var got []slot
+	for _, s := range tl.Slots {
+		var ids []string
+		for _, ab := range s.Breaks {
+			ids = append(ids, ab.Id)
+		}
+		got = append(got, slot{s.Offset, ids})
+	}
+	is.Equal(got, []slot{
+		{0, []string{"pre-1", "pre-2"}},
+		{10 * time.Minute, []string{"ten", "ten-2"}},
+		{15 * time.Minute, []string{"quarter"}},
+		{30 * time.Minute, []string{"cue-2"}},
+		{time.Hour, []string{"post"}},
+	})
+
+	is.Equal(len(tl.Unplaced), 3)
+	is.Equal(tl.Unplaced[0].Break.Id, "late")
+	is.True(errors.Is(tl.Unplaced[0].Err, ErrOutsideContent))
+	is.Equal(tl.Unplaced[1].Break.Id, "cue-9")
+	is.True(errors.Is(tl.Unplaced[1].Err, ErrNoCuePoint))
+	is.Equal(tl.Unplaced[2].Break.Id, "unset")
+	is.True(errors.Is(tl.Unplaced[2].Err, ErrOffsetUnset))
+
+	// Slots point into the VMAP rather than copying the breaks.
+	is.True(tl.Slots[0].Breaks[0] == &v.AdBreaks[2])
+}
+
+func TestTimelineSample(t *testing.T) {
+	is := is.New(t)
+	doc, err := os.ReadFile("sample-vmap/testVmap.xml")
+	is.NoErr(err)
+	v, err := DecodeVmap(doc)
+	is.NoErr(err)
+
+	tl := v.Timeline(6*time.Minute, nil)
+	is.Equal(len(tl.Slots), 2)
+	is.Equal(tl.Slots[0].Offset, time.Duration(0))
+	is.Equal(tl.Slots[1].Offset, 5*time.Minute)
+	is.Equal(len(tl.Unplaced), 1)
+	is.Equal(tl.Unplaced[0].Break.Id, "midroll.ad-3")
+}
@@ -0,0 +1,327 @@
+package vmap
+
+import (
+	"math/rand/v2"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tracking event names, as used in the event attribute of VAST and VMAP
+// Tracking elements.
+const (
+	EventBreakStart    = "breakStart"
+	EventBreakEnd      = "breakEnd"
+	EventStart         = "start"
+	EventFirstQuartile = "firstQuartile"
+	EventMidpoint      = "midpoint"
+	EventThirdQuartile = "thirdQuartile"
+	EventComplete      = "complete"
+	EventPause         = "pause"
+	EventResume        = "resume"
+	EventMute          = "mute"
+	EventUnmute        = "unmute"
+	EventSkip          = "skip"
+)
+
+// TrackerOptions configures a Tracker.
+type TrackerOptions struct {
+	// Duration overrides the duration of the creative, for when the
+	// player knows the real media duration. Defaults to Linear.Duration.
+	Duration time.Duration
+	// ContentPlayhead is the position in the content at which the ad break
+	// plays, substituted for [CONTENTPLAYHEAD].
+	ContentPlayhead time.Duration
+	// AssetURI is the media file being played, substituted for [ASSETURI].
+	AssetURI string
+	// Clock returns the current time for [TIMESTAMP]. Defaults to time.Now.
+	Clock func() time.Time
+	// CacheBuster returns the value for [CACHEBUSTING]. Defaults to a
+	// random 8-digit number.
+	CacheBuster func() string
+}
+
+// Tracker works out which tracking URLs are due while a linear creative
+// plays. It is fed the playhead position and player state changes, and
+// returns the URLs to request with their macros expanded.
+//
+// Breaks, impressions, start, quartiles, complete and skip fire at most once.
+// Pause, resume, mute and unmute fire once per change of player state.
+//
+// A Tracker is not safe for concurrent use.
+type Tracker struct {
+	adBreak  *AdBreak
+	ad       *Ad
+	creative *Creative
+	opts     TrackerOptions
+
+	duration   time.Duration
+	position   time.Duration
+	firstInAd  bool
+	firstBreak bool
+	lastBreak  bool
+
+	fired  map[string]bool
+	paused bool
+	muted  bool
+	done   bool
+}
+
+// NewTracker creates a Tracker for creative c of ad, played as part of
+// adBreak. adBreak may be nil when the ad does not come from a VMAP.
+//
+// breakStart fires with the first event when ad is the first ad of the
+// break's VAST, and breakEnd on completion or skip when it is the last.
+// Impressions fire with the first creative of the ad.
+func NewTracker(adBreak *AdBreak, ad *Ad, c *Creative, opts TrackerOptions) *Tracker {
+	t := &Tracker{
+		adBreak:  adBreak,
+		ad:       ad,
+		creative: c,
+		opts:     opts,
+		fired:    make(map[string]bool),
+	}
+	if t.opts.Clock == nil {
+		t.opts.Clock = time.Now
+	}
+	if t.opts.CacheBuster == nil {
+		t.opts.CacheBuster = randomCacheBuster
+	}
+
+	t.duration = opts.Duration
+	if t.duration == 0 && c != nil && c.Linear != nil {
+		t.duration = c.Linear.Duration.Duration
+	}
+	t.firstInAd = true
+	if ad != nil && ad.InLine != nil && len(ad.InLine.Creatives) > 0 {
+		t.firstInAd = &ad.InLine.Creatives[0] == c
+	}
+	if adBreak != nil {
+		t.firstBreak, t.lastBreak = true, true
+		if vast := adBreak.vast(); vast != nil && len(vast.Ad) > 0 {
+			t.firstBreak = &vast.Ad[0] == ad
+			t.lastBreak = &vast.Ad[len(vast.Ad)-1] == ad
+		}
+	}
+	return t
+}
+
+// vast returns the inline VAST of the break, or nil, decoding it first if
+// the break was decoded lazily.
+func (ab *AdBreak) vast() *VAST {
+	vast, _, _ := ab.Vast()
+	return vast
+}
+
+// Progress reports the playhead position within the creative and returns
+// the URLs that are now due. The first call starts the ad; quartiles fire
+// once the position reaches them, also when it jumps past several at once.
+func (t *Tracker) Progress(pos time.Duration) []string {
+	if t.done {
+		return nil
+	}
+	t.position = pos
+	urls := t.begin(nil)
+	if t.duration <= 0 {
+		return urls
+	}
+	quartiles := [...]string{EventFirstQuartile, EventMidpoint, EventThirdQuartile}
+	for i, event := range quartiles {
+		if pos >= t.duration*time.Duration(i+1)/4 {
+			urls = t.once(urls, event)
+		}
+	}
+	return urls
+}
+
+// SetPaused reports that the player paused or resumed playback.
+func (t *Tracker) SetPaused(paused bool) []string {
+	if t.done || paused == t.paused {
+		return nil
+	}
+	t.paused = paused
+	if paused {
+		return t.creativeURLs(nil, EventPause)
+	}
+	return t.creativeURLs(nil, EventResume)
+}
+
+// SetMuted reports that the player was muted or unmuted.
+func (t *Tracker) SetMuted(muted bool) []string {
+	if t.done || muted == t.muted {
+		return nil
+	}
+	t.muted = muted
+	if muted {
+		return t.creativeURLs(nil, EventMute)
+	}
+	return t.creativeURLs(nil, EventUnmute)
+}
+
+// Skip reports that the viewer skipped the creative. No further URLs are
+// returned afterwards.
+func (t *Tracker) Skip() []string {
+	if t.done {
+		return nil
+	}
+	urls := t.once(nil, EventSkip)
+	return t.finish(urls)
+}
+
+// Complete reports that the creative played to the end. Quartiles that were
+// not reached by Progress fire too. No further URLs are returned afterwards.
+func (t *Tracker) Complete() []string {
+	if t.done {
+		return nil
+	}
+	urls := t.Progress(t.duration)
+	urls = t.once(urls, EventComplete)
+	return t.finish(urls)
+}
+
+// Error returns the error URLs of the ad with [ERRORCODE] set to code, and
+// ends tracking.
+func (t *Tracker) Error(code int) []string {
+	if t.done {
+		return nil
+	}
+	t.done = true
+	var urls []string
+	if t.ad != nil && t.ad.InLine != nil && t.ad.InLine.Error != nil {
+		urls = t.appendURL(urls, t.ad.InLine.Error.Value, code)
+	}
+	if t.adBreak != nil {
+		for _, te := range t.adBreak.TrackingEvents {
+			if te.Event == "error" {
+				urls = t.appendURL(urls, te.Text, code)
+			}
+		}
+	}
+	return urls
+}
+
+// begin fires the events that mark the start of the ad, once.
+func (t *Tracker) begin(urls []string) []string {
+	if t.fired[EventStart] {
+		return urls
+	}
+	if t.firstBreak {
+		urls = t.breakURLs(urls, EventBreakStart)
+	}
+	if t.firstInAd && t.ad != nil && t.ad.InLine != nil {
+		for _, imp := range t.ad.InLine.Impression {
+			urls = t.appendURL(urls, imp.Text, 0)
+		}
+	}
+	return t.once(urls, EventStart)
+}
+
+func (t *Tracker) finish(urls []string) []string {
+	if t.lastBreak {
+		urls = t.breakURLs(urls, EventBreakEnd)
+	}
+	t.done = true
+	return urls
+}
+
+// once appends the creative URLs for event unless it fired before.
+func (t *Tracker) once(urls []string, event string) []string {
+	if t.fired[event] {
+		return urls
+	}
+	t.fired[event] = true
+	return t.creativeURLs(urls, event)
+}
+
+func (t *Tracker) creativeURLs(urls []string, event string) []string {
+	if t.creative == nil || t.creative.Linear == nil {
+		return urls
+	}
+	for _, te := range t.creative.Linear.TrackingEvents {
+		if te.Event == event {
+			urls = t.appendURL(urls, te.Text, 0)
+		}
+	}
+	return urls
+}
+
+func (t *Tracker) breakURLs(urls []string, event string) []string {
+	for _, te := range t.adBreak.TrackingEvents {
+		if te.Event == event {
+			urls = t.appendURL(urls, te.Text, 0)
+		}
+	}
+	return urls
+}
+
+func (t *Tracker) appendURL(urls []string, raw string, errorCode int) []string {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return urls
+	}
+	return append(urls, expandMacros(raw, func(name string) (string, bool) {
+		return t.macro(name, errorCode)
+	}))
+}
+
+func (t *Tracker) macro(name string, errorCode int) (string, bool) {
+	switch name {
+	case "TIMESTAMP":
+		return formatTimestamp(t.opts.Clock()), true
+	case "CACHEBUSTING":
+		return t.opts.CacheBuster(), true
+	case "CONTENTPLAYHEAD", "MEDIAPLAYHEAD":
+		return formatPlayhead(t.opts.ContentPlayhead), true
+	case "ADPLAYHEAD":
+		return formatPlayhead(t.position), true
+	case "ASSETURI":
+		return t.opts.AssetURI, t.opts.AssetURI != ""
+	case "ERRORCODE":
+		return strconv.Itoa(errorCode), errorCode != 0
+	}
+	return "", false
+}
+
+// expandMacros replaces the [NAME] macros in u for which value returns true.
+// Values are percent-encoded; other macros are left untouched.
+func expandMacros(u string, value func(name string) (string, bool)) string {
+	if !strings.Contains(u, "[") {
+		return u
+	}
+	var sb strings.Builder
+	for {
+		i := strings.IndexByte(u, '[')
+		if i < 0 {
+			break
+		}
+		j := strings.IndexByte(u[i:], ']')
+		if j < 0 {
+			break
+		}
+		sb.WriteString(u[:i])
+		if v, ok := value(u[i+1 : i+j]); ok {
+			sb.WriteString(url.QueryEscape(v))
+		} else {
+			sb.WriteString(u[i : i+j+1])
+		}
+		u = u[i+j+1:]
+	}
+	sb.WriteString(u)
+	return sb.String()
+}
+
+// formatTimestamp formats t for [TIMESTAMP]: ISO 8601 with milliseconds.
+func formatTimestamp(t time.Time) string {
+	return t.Format("2006-01-02T15:04:05.000Z07:00")
+}
+
+// formatPlayhead formats d for the playhead macros: HH:MM:SS.mmm.
+func formatPlayhead(d time.Duration) string {
+	return string(appendDuration(nil, Duration{max(d, 0).Truncate(time.Millisecond)}))
+}
+
+// randomCacheBuster returns a random 8-digit number for [CACHEBUSTING].
+func randomCacheBuster() string {
+	return strconv.Itoa(10000000 + rand.IntN(90000000))
+}
@@ -0,0 +1,182 @@
+package vmap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+// fakeClock is a simulated clock that only moves when told to.
+type fakeClock struct{ now time.Time }
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time          { return c.now }
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func trackerTestOpts(c *fakeClock) TrackerOptions {
+	return TrackerOptions{Clock: c.Now, CacheBuster: func() string { return "12345678" }}
+}
+
+func tracking(event, url string) TrackingEvent {
+	return TrackingEvent{Event: event, Text: url}
+}
+
+func linearCreative(d time.Duration) Creative {
+	return Creative{Linear: &Linear{Duration: Duration{d}}}
+}
+
+func trackerTestBreak() *AdBreak {
+	events := func(ad string) []TrackingEvent {
+		var te []TrackingEvent
+		for _, e := range []string{
+			EventStart, EventFirstQuartile, EventMidpoint, EventThirdQuartile, EventComplete,
+			EventPause, EventResume, EventMute, EventUnmute, EventSkip,
+		} {
+			te = append(te, tracking(e, "http://t/"+ad+"/"+e))
+		}
+		return te
+	}
+	ad := func(id string) Ad {
+		c := linearCreative(20 * time.Second)
+		c.Linear.TrackingEvents = events(id)
+		return Ad{Id: id, InLine: &InLine{
+			Impression: []Impression{{Text: " \n http://t/" + id + "/impression\n "}},
+			Creatives:  []Creative{c},
+			Error:      &Error{Value: "http://t/" + id + "/error?code=[ERRORCODE]"},
+		}}
+	}
+	return &AdBreak{
+		TrackingEvents: []TrackingEvent{
+			tracking(EventBreakStart, "http://t/breakStart"),
+			tracking(EventBreakEnd, "http://t/breakEnd"),
+			tracking("error", "http://t/breakError?code=[ERRORCODE]"),
+		},
+		AdSource: &AdSource{VASTData: &VASTData{VAST: &VAST{Ad: []Ad{ad("a1"), ad("a2")}}}},
+	}
+}
+
+func TestTrackerPlayback(t *testing.T) {
+	is := is.New(t)
+	clock := newFakeClock()
+	ab := trackerTestBreak()
+	ads := ab.AdSource.VASTData.VAST.Ad
+
+	// The first ad opens the break and plays through on 250ms ticks.
+	tr := NewTracker(ab, &ads[0], &ads[0].InLine.Creatives[0], trackerTestOpts(clock))
+	var fired []string
+	for pos := time.Duration(0); pos < 20*time.Second; pos += 250 * time.Millisecond {
+		fired = append(fired, tr.Progress(pos)...)
+		clock.Advance(250 * time.Millisecond)
+	}
+	fired = append(fired, tr.Complete()...)
+	is.Equal(fired, []string{
+		"http://t/breakStart",
+		"http://t/a1/impression",
+		"http://t/a1/start",
+		"http://t/a1/firstQuartile",
+		"http://t/a1/midpoint",
+		"http://t/a1/thirdQuartile",
+		"http://t/a1/complete",
+	})
+	is.Equal(tr.Progress(time.Second), nil)
+	is.Equal(tr.Complete(), nil)
+
+	// The last ad closes the break.
+	tr = NewTracker(ab, &ads[1], &ads[1].InLine.Creatives[0], trackerTestOpts(clock))
+	is.Equal(tr.Progress(0), []string{"http://t/a2/impression", "http://t/a2/start"})
+	is.Equal(tr.Skip(), []string{"http://t/a2/skip", "http://t/breakEnd"})
+	is.Equal(tr.Complete(), nil)
+}
+
+func TestTrackerQuartilesFireOnce(t *testing.T) {
+	is := is.New(t)
+	ab := trackerTestBreak()
+	ad := &ab.AdSource.VASTData.VAST.Ad[1]
+	tr := NewTracker(ab, ad, &ad.InLine.Creatives[0], trackerTestOpts(newFakeClock()))
+
+	is.Equal(tr.Progress(4*time.Second), []string{"http://t/a2/impression", "http://t/a2/start"})
+	// A jump fires every quartile passed on the way.
+	is.Equal(tr.Progress(15*time.Second), []string{
+		"http://t/a2/firstQuartile", "http://t/a2/midpoint", "http://t/a2/thirdQuartile",
+	})
+	// Seeking back and playing through again fires nothing.
+	is.Equal(tr.Progress(2*time.Second), nil)
+	is.Equal(tr.Progress(16*time.Second), nil)
+	is.Equal(tr.Complete(), []string{"http://t/a2/complete", "http://t/breakEnd"})
+}
+
+func TestTrackerCompleteFiresMissedQuartiles(t *testing.T) {
+	is := is.New(t)
+	ab := trackerTestBreak()
+	ad := &ab.AdSource.VASTData.VAST.Ad[0]
+	tr := NewTracker(ab, ad, &ad.InLine.Creatives[0], trackerTestOpts(newFakeClock()))
+
+	is.Equal(tr.Complete(), []string{
+		"http://t/breakStart",
+		"http://t/a1/impression",
+		"http://t/a1/start",
+		"http://t/a1/firstQuartile",
+		"http://t/a1/midpoint",
+		"http://t/a1/thirdQuartile",
+		"http://t/a1/complete",
+	})
+}
+
+func TestTrackerPlayerState(t *testing.T) {
+	is := is.New(t)
+	ab := trackerTestBreak()
+	ad := &ab.AdSource.VASTData.VAST.Ad[0]
+	tr := NewTracker(ab, ad, &ad.InLine.Creatives[0], trackerTestOpts(newFakeClock()))
+
+	is.Equal(tr.SetPaused(false), nil) // not paused to begin with
+	is.Equal(tr.SetPaused(true), []string{"http://t/a1/pause"})
+	is.Equal(tr.SetPaused(true), nil)
+	is.Equal(tr.SetPaused(false), []string{"http://t/a1/resume"})
+	is.Equal(tr.SetPaused(true), []string{"http://t/a1/pause"})
+
+	is.Equal(tr.SetMuted(true), []string{"http://t/a1/mute"})
+	is.Equal(tr.SetMuted(true), nil)
+	is.Equal(tr.SetMuted(false), []string{"http://t/a1/unmute"})
+
+	tr.Skip()
+	is.Equal(tr.SetPaused(false), nil)
+	is.Equal(tr.SetMuted(true), nil)
+}
+
+func TestTrackerError(t *testing.T) {
+	is := is.New(t)
+	ab := trackerTestBreak()
+	ad := &ab.AdSource.VASTData.VAST.Ad[0]
+	tr := NewTracker(ab, ad, &ad.InLine.Creatives[0], trackerTestOpts(newFakeClock()))
+
+	is.Equal(tr.Error(405), []string{"http://t/a1/error?code=405", "http://t/breakError?code=405"})
+	is.Equal(tr.Error(405), nil)
+	is.Equal(tr.Progress(0), nil)
+}
+
+func TestTrackerMacros(t *testing.T) {
+	is := is.New(t)
+	clock := newFakeClock()
+	c := linearCreative(30 * time.Second)
+	c.Linear.TrackingEvents = []TrackingEvent{
+		tracking(EventStart, "http://t/start?ts=[TIMESTAMP]&cb=[CACHEBUSTING]&asset=[ASSETURI]"),
+		tracking(EventMidpoint, "http://t/mid?ad=[ADPLAYHEAD]&content=[CONTENTPLAYHEAD]&x=[UNKNOWN]"),
+	}
+	ad := &Ad{InLine: &InLine{Creatives: []Creative{c}}}
+	opts := trackerTestOpts(clock)
+	opts.ContentPlayhead = 10*time.Minute + 1500*time.Millisecond
+	opts.AssetURI = "https://cdn/ad.mp4?a=1"
+	tr := NewTracker(nil, ad, &ad.InLine.Creatives[0], opts)
+
+	is.Equal(tr.Progress(0), []string{
+		"http://t/start?ts=2024-05-01T12%3A00%3A00.000Z&cb=12345678&asset=https%3A%2F%2Fcdn%2Fad.mp4%3Fa%3D1",
+	})
+	clock.Advance(15 * time.Second)
+	is.Equal(tr.Progress(15*time.Second+250*time.Millisecond), []string{
+		"http://t/mid?ad=00%3A00%3A15.250&content=00%3A10%3A01.500&x=[UNKNOWN]",
+	})
+}
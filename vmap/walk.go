@@ -0,0 +1,159 @@
+package vmap
+
+import (
+	"strconv"
+	"strings"
+)
+
+// URLKind tells what a URL in a document is for.
+type URLKind int
+
+const (
+	// URLImpression is the text of an Impression.
+	URLImpression URLKind = iota
+	// URLError is the text of the Error of an InLine.
+	URLError
+	// URLTracking is the text of a Tracking element of a creative.
+	URLTracking
+	// URLMediaFile is the text of a MediaFile.
+	URLMediaFile
+	// URLClickThrough is the text of a ClickThrough.
+	URLClickThrough
+	// URLClickTracking is the text of a ClickTracking.
+	URLClickTracking
+	// URLCustomClick is the text of a CustomClick.
+	URLCustomClick
+	// URLBreakTracking is the text of a Tracking element of an AdBreak.
+	URLBreakTracking
+)
+
+var urlKindNames = [...]string{
+	URLImpression:    "impression",
+	URLError:         "error",
+	URLTracking:      "tracking",
+	URLMediaFile:     "mediaFile",
+	URLClickThrough:  "clickThrough",
+	URLClickTracking: "clickTracking",
+	URLCustomClick:   "customClick",
+	URLBreakTracking: "breakTracking",
+}
+
+func (k URLKind) String() string {
+	if k < 0 || int(k) >= len(urlKindNames) {
+		return "URLKind(" + strconv.Itoa(int(k)) + ")"
+	}
+	return urlKindNames[k]
+}
+
+// WalkFunc is called by Walk for every URL field in a document, with the
+// kind of URL, where it is, and the field, which it may change. Returning
+// an error stops the walk.
+type WalkFunc func(kind URLKind, loc Location, u *string) error
+
+// Walk calls fn for every URL field of the document in document order,
+// including empty ones. It returns the error returned by fn, if any.
+func (v *VMAP) Walk(fn WalkFunc) error {
+	for i := range v.AdBreaks {
+		ab := &v.AdBreaks[i]
+		if vast := ab.vast(); vast != nil {
+			if err := vast.walk(ab, fn); err != nil {
+				return err
+			}
+		}
+		for j := range ab.TrackingEvents {
+			if err := fn(URLBreakTracking, Location{AdBreak: ab}, &ab.TrackingEvents[j].Text); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Walk calls fn for every URL field of the document in document order,
+// including empty ones. It returns the error returned by fn, if any.
+func (v *VAST) Walk(fn WalkFunc) error {
+	return v.walk(nil, fn)
+}
+
+func (v *VAST) walk(ab *AdBreak, fn WalkFunc) error {
+	for i := range v.Ad {
+		ad := &v.Ad[i]
+		il := ad.InLine
+		if il == nil {
+			continue
+		}
+		loc := Location{AdBreak: ab, Ad: ad}
+		for j := range il.Impression {
+			if err := fn(URLImpression, loc, &il.Impression[j].Text); err != nil {
+				return err
+			}
+		}
+		for j := range il.Creatives {
+			c := &il.Creatives[j]
+			if c.Linear == nil {
+				continue
+			}
+			if err := c.Linear.walk(Location{AdBreak: ab, Ad: ad, Creative: c}, fn); err != nil {
+				return err
+			}
+		}
+		if il.Error != nil {
+			if err := fn(URLError, loc, &il.Error.Value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (l *Linear) walk(loc Location, fn WalkFunc) error {
+	for i := range l.TrackingEvents {
+		if err := fn(URLTracking, loc, &l.TrackingEvents[i].Text); err != nil {
+			return err
+		}
+	}
+	for i := range l.MediaFiles {
+		if err := fn(URLMediaFile, loc, &l.MediaFiles[i].Text); err != nil {
+			return err
+		}
+	}
+	if l.ClickThrough != nil {
+		if err := fn(URLClickThrough, loc, &l.ClickThrough.Text); err != nil {
+			return err
+		}
+	}
+	for i := range l.ClickTracking {
+		if err := fn(URLClickTracking, loc, &l.ClickTracking[i].Text); err != nil {
+			return err
+		}
+	}
+	for i := range l.CustomClick {
+		if err := fn(URLCustomClick, loc, &l.CustomClick[i].Text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RewriteURLs replaces every URL in the document with what fn returns for
+// it. fn gets URLs with surrounding whitespace trimmed, and is not called
+// for empty ones.
+func (v *VMAP) RewriteURLs(fn func(kind URLKind, u string) string) {
+	_ = v.Walk(rewriter(fn))
+}
+
+// RewriteURLs replaces every URL in the document with what fn returns for
+// it. fn gets URLs with surrounding whitespace trimmed, and is not called
+// for empty ones.
+func (v *VAST) RewriteURLs(fn func(kind URLKind, u string) string) {
+	_ = v.Walk(rewriter(fn))
+}
+
+func rewriter(fn func(kind URLKind, u string) string) WalkFunc {
+	return func(kind URLKind, _ Location, u *string) error {
+		if trimmed := strings.TrimSpace(*u); trimmed != "" {
+			*u = fn(kind, trimmed)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,137 @@
+package vmap
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func walkTestVmap() *VMAP {
+	return &VMAP{AdBreaks: []AdBreak{
+		{Id: "empty"},
+		{
+			Id:             "b1",
+			TrackingEvents: []TrackingEvent{{Event: EventBreakStart, Text: "http://t/bs"}},
+			AdSource: &AdSource{VASTData: &VASTData{VAST: &VAST{Ad: []Ad{
+				{Id: "wrapper"},
+				{Id: "a1", InLine: &InLine{
+					Impression: []Impression{{Text: "\n  http://t/imp \n"}},
+					Creatives: []Creative{
+						{Id: "companion"},
+						{Id: "c1", Linear: &Linear{
+							TrackingEvents: []TrackingEvent{{Event: EventStart, Text: "http://t/start"}},
+							MediaFiles:     []MediaFile{{Text: "http://cdn/a.mp4"}},
+							ClickThrough:   &ClickThrough{Text: "http://t/ct"},
+							ClickTracking:  []ClickTracking{{Text: "http://t/ctr"}},
+							CustomClick:    []CustomClick{{Text: ""}},
+						}},
+					},
+					Error: &Error{Value: "http://t/err"},
+				}},
+			}}}},
+		},
+	}}
+}
+
+func TestWalk(t *testing.T) {
+	is := is.New(t)
+	v := walkTestVmap()
+
+	var got []string
+	err := v.Walk(func(kind URLKind, loc Location, u *string) error {
+		where := loc.AdBreak.Id
+		if loc.Ad != nil {
+			where += "/" + loc.Ad.Id
+		}
+		if loc.Creative != nil {
+			where += "/" + loc.Creative.Id
+		}
+		got = append(got, kind.String()+" "+where+" "+strings.TrimSpace(*u))
+		return nil
+	})
+	is.NoErr(err)
+	is.Equal(got, []string{
+		"impression b1/a1 http://t/imp",
+		"tracking b1/a1/c1 http://t/start",
+		"mediaFile b1/a1/c1 http://cdn/a.mp4",
+		"clickThrough b1/a1/c1 http://t/ct",
+		"clickTracking b1/a1/c1 http://t/ctr",
+		"customClick b1/a1/c1 ",
+		"error b1/a1 http://t/err",
+		"breakTracking b1 http://t/bs",
+	})
+}
+
+func TestWalkStops(t *testing.T) {
+	is := is.New(t)
+	errStop := errors.New("stop")
+	n := 0
+	err := walkTestVmap().Walk(func(URLKind, Location, *string) error {
+		n++
+		if n == 2 {
+			return errStop
+		}
+		return nil
+	})
+	is.Equal(err, errStop)
+	is.Equal(n, 2)
+}
+
+func TestRewriteURLs(t *testing.T) {
+	is := is.New(t)
+	v := walkTestVmap()
+	v.RewriteURLs(func(kind URLKind, u string) string {
+		if kind == URLMediaFile {
+			return strings.Replace(u, "http://cdn/", "https://cdn2/", 1)
+		}
+		return "https://proxy/?u=" + u
+	})
+
+	vast := v.AdBreaks[1].AdSource.VASTData.VAST
+	il := vast.Ad[1].InLine
+	is.Equal(il.Impression[0].Text, "https://proxy/?u=http://t/imp") // trimmed
+	is.Equal(il.Creatives[1].Linear.MediaFiles[0].Text, "https://cdn2/a.mp4")
+	is.Equal(il.Creatives[1].Linear.CustomClick[0].Text, "") // empty ones are left alone
+	is.Equal(v.AdBreaks[1].TrackingEvents[0].Text, "https://proxy/?u=http://t/bs")
+
+	vast.RewriteURLs(func(_ URLKind, u string) string { return strings.ToUpper(u) })
+	is.Equal(il.Error.Value, "HTTPS://PROXY/?U=HTTP://T/ERR")
+	is.Equal(v.AdBreaks[1].TrackingEvents[0].Text, "https://proxy/?u=http://t/bs") // not part of the VAST
+}
+
+func TestRewriteURLsSample(t *testing.T) {
+	is := is.New(t)
+	doc, err := os.ReadFile("sample-vmap/testVmap.xml")
+	is.NoErr(err)
+	v, err := DecodeVmap(doc)
+	is.NoErr(err)
+
+	kinds := map[URLKind]int{}
+	v.RewriteURLs(func(kind URLKind, u string) string {
+		kinds[kind]++
+		return "https://proxy/" + u
+	})
+	is.True(kinds[URLImpression] > 0)
+	is.True(kinds[URLTracking] > 0)
+	is.True(kinds[URLMediaFile] > 0)
+
+	out, err := MarshalVmap(&v)
+	is.NoErr(err)
+	back, err := DecodeVmap(out)
+	is.NoErr(err)
+	_ = back.Walk(func(_ URLKind, _ Location, u *string) error {
+		if *u != "" {
+			is.True(strings.HasPrefix(*u, "https://proxy/"))
+		}
+		return nil
+	})
+}
+
+func TestURLKindString(t *testing.T) {
+	is := is.New(t)
+	is.Equal(URLBreakTracking.String(), "breakTracking")
+	is.Equal(URLKind(42).String(), "URLKind(42)")
+}